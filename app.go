@@ -23,6 +23,9 @@ const (
 	configDefaultUserKey = "userConfig.defaultUser"
 	configUsersKey       = "userConfig.users"
 	configExportPathKey  = "exportPath"
+	configVoiceKey       = "voiceConfig"
+	configTimeZoneKey    = "timeZone"
+	configSearchIndexKey = "searchAutoIndex"
 	appVersion           = "v1.2.3"
 )
 
@@ -33,6 +36,9 @@ type FileLoader struct {
 
 func NewFileLoader(prefix string) *FileLoader {
 	mime.AddExtensionType(".mp3", "audio/mpeg")
+	mime.AddExtensionType(".wav", "audio/wav")
+	mime.AddExtensionType(".ogg", "audio/ogg")
+	mime.AddExtensionType(".webp", "image/webp")
 	return &FileLoader{FilePrefix: prefix}
 }
 
@@ -122,6 +128,8 @@ type App struct {
 	firstStart  bool
 	firstInit   bool
 	FLoader     *FileLoader
+	// build the search index when an account is opened
+	searchAutoIndex bool
 }
 
 type WeChatInfo struct {
@@ -153,6 +161,7 @@ func NewApp() *App {
 	a := &App{}
 	log.Println("App version:", appVersion)
 	a.firstInit = true
+	a.searchAutoIndex = true
 	a.FLoader = NewFileLoader(".\\")
 	viper.SetConfigName(defaultConfig)
 	viper.SetConfigType("json")
@@ -165,6 +174,22 @@ func NewApp() *App {
 			log.Println("SetFilePrefix", prefix)
 			a.FLoader.SetFilePrefix(prefix)
 		}
+		if viper.IsSet(configVoiceKey) {
+			voiceConfig := wechat.GetVoiceExportConfig()
+			if err := viper.UnmarshalKey(configVoiceKey, &voiceConfig); err != nil {
+				log.Println("UnmarshalKey voiceConfig:", err)
+			} else if err := wechat.SetVoiceExportConfig(voiceConfig); err != nil {
+				log.Println("SetVoiceExportConfig:", err)
+			}
+		}
+		if timeZone := viper.GetString(configTimeZoneKey); timeZone != "" {
+			if err := wechat.SetTimeZone(timeZone); err != nil {
+				log.Println("SetTimeZone:", err)
+			}
+		}
+		if viper.IsSet(configSearchIndexKey) {
+			a.searchAutoIndex = viper.GetBool(configSearchIndexKey)
+		}
 	} else {
 		log.Println("not config exist")
 	}
@@ -308,6 +333,9 @@ func (a *App) createWechatDataProvider(resPath string, prefix string) error {
 	}
 
 	a.provider = provider
+	if a.searchAutoIndex {
+		go a.BuildSearchIndex()
+	}
 	// infoJson, _ := json.Marshal(a.provider.SelfInfo)
 	// runtime.EventsEmit(a.ctx, "selfInfo", string(infoJson))
 	return nil
@@ -400,7 +428,7 @@ func (a *App) GetWechatMessageListByType(userName string, time int64, pageSize i
 	} else if direction == "both" {
 		dire = wechat.Message_Search_Both
 	}
-	list, err := a.provider.WeChatGetMessageListByType(userName, time, pageSize, msgType, dire)
+	list, err := a.provider.WeChatGetMessageListByType(userName, time, pageSize, wechat.MessageFilterFromLegacy(msgType), dire)
 	if err != nil {
 		log.Println("WeChatGetMessageListByType failed:", err)
 		return ""
@@ -416,7 +444,9 @@ func (a *App) GetWechatMessageListByKeyWord(userName string, time int64, keyword
 	if len(userName) == 0 {
 		return "{\"Total\":0, \"Rows\":[]}"
 	}
-	list, err := a.provider.WeChatGetMessageListByKeyWord(userName, time, keyword, msgType, pageSize)
+	filter := wechat.MessageFilterFromLegacy(msgType)
+	filter.KeyWord = keyword
+	list, err := a.provider.WeChatGetMessageListByKeyWord(userName, time, filter, pageSize)
 	if err != nil {
 		log.Println("WeChatGetMessageListByKeyWord failed:", err)
 		return ""
@@ -427,6 +457,133 @@ func (a *App) GetWechatMessageListByKeyWord(userName string, time int64, keyword
 	return string(listStr)
 }
 
+func (a *App) GetWechatMessageListByFilter(userName string, time int64, pageSize int, filterStr string, direction string) string {
+	log.Println("GetWechatMessageListByFilter:", userName, pageSize, time, filterStr, direction)
+	if len(userName) == 0 {
+		return "{\"Total\":0, \"Rows\":[]}"
+	}
+
+	filter := &wechat.MessageFilter{}
+	if err := json.Unmarshal([]byte(filterStr), filter); err != nil {
+		log.Println("json.Unmarshal filter failed:", err)
+		return "{\"Total\":0, \"Rows\":[]}"
+	}
+
+	dire := wechat.Message_Search_Forward
+	if direction == "backward" {
+		dire = wechat.Message_Search_Backward
+	} else if direction == "both" {
+		dire = wechat.Message_Search_Both
+	}
+	list, err := a.provider.WeChatGetMessageListByType(userName, time, pageSize, filter, dire)
+	if err != nil {
+		log.Println("WeChatGetMessageListByType failed:", err)
+		return ""
+	}
+	list.KeyWord = filter.KeyWord
+	listStr, _ := json.Marshal(list)
+	log.Println("GetWechatMessageListByFilter:", list.Total)
+
+	return string(listStr)
+}
+
+func (a *App) GetWechatMessageListByCursor(userName string, cursor string, pageSize int, filterStr string, direction string) string {
+	log.Println("GetWechatMessageListByCursor:", userName, pageSize, cursor, filterStr, direction)
+	if len(userName) == 0 {
+		return "{\"Total\":0, \"Rows\":[]}"
+	}
+
+	var filter *wechat.MessageFilter
+	if len(filterStr) > 0 {
+		filter = &wechat.MessageFilter{}
+		if err := json.Unmarshal([]byte(filterStr), filter); err != nil {
+			log.Println("json.Unmarshal filter failed:", err)
+			return "{\"Total\":0, \"Rows\":[]}"
+		}
+	}
+
+	dire := wechat.Message_Search_Forward
+	if direction == "backward" {
+		dire = wechat.Message_Search_Backward
+	} else if direction == "both" {
+		dire = wechat.Message_Search_Both
+	}
+	list, err := a.provider.WeChatGetMessageListByCursor(userName, cursor, pageSize, dire, filter)
+	if err != nil {
+		log.Println("WeChatGetMessageListByCursor failed:", err)
+		return "{\"Total\":0, \"Rows\":[]}"
+	}
+	listStr, _ := json.Marshal(list)
+	log.Println("GetWechatMessageListByCursor:", list.Total)
+
+	return string(listStr)
+}
+
+func (a *App) GetWechatMessageByServerId(userName string, svrId string) string {
+	log.Println("GetWechatMessageByServerId:", userName, svrId)
+	if a.provider == nil || len(svrId) == 0 {
+		return ""
+	}
+
+	msg, err := a.provider.WeChatGetMessageByServerId(userName, svrId)
+	if err != nil {
+		log.Println("WeChatGetMessageByServerId failed:", err)
+		return ""
+	}
+	msgStr, _ := json.Marshal(msg)
+
+	return string(msgStr)
+}
+
+func (a *App) GetWechatMediaStatus(userName string, svrId string) string {
+	log.Println("GetWechatMediaStatus:", userName, svrId)
+	if a.provider == nil || len(svrId) == 0 {
+		return ""
+	}
+
+	status, err := a.provider.WeChatGetMediaStatus(userName, svrId)
+	if err != nil {
+		log.Println("WeChatGetMediaStatus failed:", err)
+		return ""
+	}
+	statusStr, _ := json.Marshal(status)
+
+	return string(statusStr)
+}
+
+func (a *App) GetWechatMediaStatusList(userName string, svrIds []string) string {
+	log.Println("GetWechatMediaStatusList:", userName, len(svrIds))
+	if a.provider == nil || len(userName) == 0 {
+		return "[]"
+	}
+
+	list, err := a.provider.WeChatGetMediaStatusList(userName, svrIds)
+	if err != nil {
+		log.Println("WeChatGetMediaStatusList failed:", err)
+		return "[]"
+	}
+	listStr, _ := json.Marshal(list)
+
+	return string(listStr)
+}
+
+func (a *App) GetWechatMessageContext(userName string, svrId string, before int, after int) string {
+	log.Println("GetWechatMessageContext:", userName, svrId, before, after)
+	if a.provider == nil || len(svrId) == 0 {
+		return "{\"Total\":0, \"Rows\":[]}"
+	}
+
+	list, err := a.provider.WeChatGetMessageContext(userName, svrId, before, after)
+	if err != nil {
+		log.Println("WeChatGetMessageContext failed:", err)
+		return "{\"Total\":0, \"Rows\":[]}"
+	}
+	listStr, _ := json.Marshal(list)
+	log.Println("GetWechatMessageContext:", list.Total)
+
+	return string(listStr)
+}
+
 func (a *App) GetWechatMessageDate(userName string) string {
 	log.Println("GetWechatMessageDate:", userName)
 	if len(userName) == 0 {
@@ -445,10 +602,137 @@ func (a *App) GetWechatMessageDate(userName string) string {
 	return string(messageDataStr)
 }
 
+func (a *App) GetWechatMessageHistogram(userName string, granularity string) string {
+	log.Println("GetWechatMessageHistogram:", userName, granularity)
+	if a.provider == nil {
+		return "{\"Total\":0, \"Items\":[]}"
+	}
+
+	histogram, err := a.provider.WeChatGetMessageHistogram(userName, granularity)
+	if err != nil {
+		log.Println("WeChatGetMessageHistogram failed:", err)
+		return "{\"Total\":0, \"Items\":[]}"
+	}
+	histogramStr, _ := json.Marshal(histogram)
+
+	return string(histogramStr)
+}
+
+func (a *App) GetWechatChatReport(userName string, useCache bool) string {
+	log.Println("GetWechatChatReport:", userName, useCache)
+	if a.provider == nil || len(userName) == 0 {
+		return "{\"Total\":0}"
+	}
+
+	report, err := a.provider.WeChatGetChatReport(userName, useCache)
+	if err != nil {
+		log.Println("WeChatGetChatReport failed:", err)
+		return "{\"Total\":0}"
+	}
+	reportStr, _ := json.Marshal(report)
+
+	return string(reportStr)
+}
+
+func (a *App) GetWechatGroupAnalytics(chatroom string, silentDays int) string {
+	log.Println("GetWechatGroupAnalytics:", chatroom, silentDays)
+	if a.provider == nil || !strings.HasSuffix(chatroom, "@chatroom") {
+		return "{\"Total\":0}"
+	}
+
+	analytics, err := a.provider.WeChatGetGroupAnalytics(chatroom, silentDays)
+	if err != nil {
+		log.Println("WeChatGetGroupAnalytics failed:", err)
+		return "{\"Total\":0}"
+	}
+	analyticsStr, _ := json.Marshal(analytics)
+
+	return string(analyticsStr)
+}
+
+func (a *App) GetWechatStorageUsage() string {
+	log.Println("GetWechatStorageUsage")
+	if a.provider == nil {
+		return "{\"Total\":0}"
+	}
+
+	usage, err := a.provider.WeChatGetStorageUsage()
+	if err != nil {
+		log.Println("WeChatGetStorageUsage failed:", err)
+		return "{\"Total\":0}"
+	}
+	usageStr, _ := json.Marshal(usage)
+
+	return string(usageStr)
+}
+
+func (a *App) GetWechatMediaAudit(userName string) string {
+	log.Println("GetWechatMediaAudit:", userName)
+	if a.provider == nil {
+		return "{\"Total\":0}"
+	}
+
+	audit, err := a.provider.WeChatGetMediaAudit(userName)
+	if err != nil {
+		log.Println("WeChatGetMediaAudit failed:", err)
+		return "{\"Total\":0}"
+	}
+	auditStr, _ := json.Marshal(audit)
+
+	return string(auditStr)
+}
+
+func (a *App) GetWechatMessageThread(userName string, svrId string) string {
+	log.Println("GetWechatMessageThread:", userName, svrId)
+	if a.provider == nil || len(userName) == 0 {
+		return "{\"Total\":0}"
+	}
+
+	thread, err := a.provider.WeChatGetMessageThread(userName, svrId)
+	if err != nil {
+		log.Println("WeChatGetMessageThread failed:", err)
+		return "{\"Total\":0}"
+	}
+	threadStr, _ := json.Marshal(thread)
+
+	return string(threadStr)
+}
+
+func (a *App) GetWechatMentionList(cursor string, pageSize int) string {
+	log.Println("GetWechatMentionList:", cursor, pageSize)
+	if a.provider == nil {
+		return "{\"Total\":0, \"Rows\":[]}"
+	}
+
+	list, err := a.provider.WeChatGetMentionList(cursor, pageSize)
+	if err != nil {
+		log.Println("WeChatGetMentionList failed:", err)
+		return "{\"Total\":0, \"Rows\":[]}"
+	}
+	listStr, _ := json.Marshal(list)
+	log.Println("GetWechatMentionList:", list.Total)
+
+	return string(listStr)
+}
+
+func (a *App) GetWechatMessageCount(userName string) string {
+	if a.provider == nil || len(userName) == 0 {
+		return "{\"Total\":0}"
+	}
+
+	count := a.provider.WeChatGetMessageCount(userName)
+	countStr, _ := json.Marshal(count)
+
+	return string(countStr)
+}
+
 func (a *App) setCurrentConfig() {
 	viper.Set(configDefaultUserKey, a.defaultUser)
 	viper.Set(configUsersKey, a.users)
 	viper.Set(configExportPathKey, a.FLoader.FilePrefix)
+	viper.Set(configVoiceKey, wechat.GetVoiceExportConfig())
+	viper.Set(configTimeZoneKey, wechat.GetTimeZone())
+	viper.Set(configSearchIndexKey, a.searchAutoIndex)
 	err := viper.SafeWriteConfig()
 	if err != nil {
 		log.Println(err)
@@ -838,6 +1122,7 @@ func (a *App) ExportWeChatDataByUserName(userName, path string) string {
 			"defaultuser": a.defaultUser,
 			"users":       []string{a.defaultUser},
 		},
+		"timezone": wechat.GetTimeZone(),
 	}
 
 	configJson, err := json.MarshalIndent(config, "", "	")
@@ -871,6 +1156,101 @@ func (a *App) ExportWeChatDataByUserName(userName, path string) string {
 	return ""
 }
 
+func (a *App) GetTimeZone() string {
+	return wechat.GetTimeZone()
+}
+
+func (a *App) SetTimeZone(timeZone string) string {
+	err := wechat.SetTimeZone(timeZone)
+	if err != nil {
+		log.Println("SetTimeZone failed:", err)
+		return err.Error()
+	}
+
+	a.setCurrentConfig()
+	return ""
+}
+
+func (a *App) GetVoiceExportConfig() string {
+	config := wechat.GetVoiceExportConfig()
+	configStr, _ := json.Marshal(config)
+	return string(configStr)
+}
+
+func (a *App) SetVoiceExportConfig(format string, bitrate int, sampleRate int, keepSilk bool) string {
+	config := wechat.VoiceExportConfig{
+		Format:     format,
+		Bitrate:    bitrate,
+		SampleRate: sampleRate,
+		KeepSilk:   keepSilk,
+	}
+	err := wechat.SetVoiceExportConfig(config)
+	if err != nil {
+		log.Println("SetVoiceExportConfig failed:", err)
+		return err.Error()
+	}
+
+	a.setCurrentConfig()
+	return ""
+}
+
+func (a *App) PrefetchWechatAssets(userName string) {
+	if a.provider == nil {
+		runtime.EventsEmit(a.ctx, "prefetchAssets", "{\"status\":\"error\", \"result\":\"provider is nil\"}")
+		return
+	}
+
+	progress := make(chan string)
+	go a.provider.WeChatPrefetchAssets(userName, progress)
+	go func() {
+		for p := range progress {
+			log.Println(p)
+			runtime.EventsEmit(a.ctx, "prefetchAssets", p)
+		}
+	}()
+}
+
+func (a *App) BuildSearchIndex() {
+	provider := a.provider
+	if provider == nil {
+		runtime.EventsEmit(a.ctx, "searchIndex", "{\"status\":\"error\", \"result\":\"provider is nil\"}")
+		return
+	}
+
+	progress := make(chan string)
+	go provider.WeChatBuildSearchIndex(progress)
+	for p := range progress {
+		log.Println(p)
+		runtime.EventsEmit(a.ctx, "searchIndex", p)
+	}
+}
+
+func (a *App) GetSearchAutoIndex() bool {
+	return a.searchAutoIndex
+}
+
+// SetSearchAutoIndex turns building the search index when an account is
+// opened on or off, BuildSearchIndex still builds it on demand.
+func (a *App) SetSearchAutoIndex(enable bool) string {
+	a.searchAutoIndex = enable
+	a.setCurrentConfig()
+	return ""
+}
+
+func (a *App) SearchWechatMessages(keyWord string, userName string, pageIndex int, pageSize int) string {
+	if a.provider == nil {
+		log.Println("provider not init")
+		return "{\"Total\":0, \"Rows\":[]}"
+	}
+
+	list, err := a.provider.WeChatSearchMessages(keyWord, userName, pageIndex, pageSize)
+	if err != nil {
+		log.Println("WeChatSearchMessages failed:", err)
+	}
+	listStr, _ := json.Marshal(list)
+	return string(listStr)
+}
+
 func (a *App) GetAppIsShareData() bool {
 	if a.provider != nil {
 		return a.provider.IsShareData
@@ -5,6 +5,8 @@ import (
 	"io"
 	"log"
 	"os"
+	// the zone database for Windows machines without Go installed
+	_ "time/tzdata"
 
 	"github.com/wailsapp/wails/v2"
 	"github.com/wailsapp/wails/v2/pkg/options"
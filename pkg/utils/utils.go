@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -234,3 +235,24 @@ func Hash256Sum(data []byte) string {
 
 	return hex.EncodeToString(hashSum)
 }
+
+// GetImageExt sniffs the image format of data and returns its file
+// extension, or "" when data is not a known image.
+func GetImageExt(data []byte) string {
+	switch http.DetectContentType(data) {
+	case "image/jpeg":
+		return ".jpg"
+	case "image/png":
+		return ".png"
+	case "image/gif":
+		return ".gif"
+	case "image/webp":
+		return ".webp"
+	case "image/bmp":
+		return ".bmp"
+	case "image/x-icon":
+		return ".ico"
+	}
+
+	return ""
+}
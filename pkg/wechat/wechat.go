@@ -20,8 +20,6 @@ import (
 	"time"
 	"unsafe"
 
-	"github.com/git-jiadong/go-lame"
-	"github.com/git-jiadong/go-silk"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/shirou/gopsutil/v3/process"
 	"golang.org/x/sys/windows"
@@ -45,13 +43,14 @@ type WeChatInfoList struct {
 
 type wechatMediaMSG struct {
 	Key      string
-	MsgSvrID int
+	MsgSvrID int64
 	Buf      []byte
 }
 
 type wechatHeadImgMSG struct {
 	userName string
 	Buf      []byte
+	BigBuf   []byte
 }
 
 func GetWeChatAllInfo() *WeChatInfoList {
@@ -79,6 +78,7 @@ func ExportWeChatAllData(info WeChatInfo, expPath string, progress chan<- string
 	exportWeChatVideoAndFile(info, expPath, progress)
 	exportWeChatVoice(info, expPath, progress)
 	exportWeChatHeadImage(info, expPath, progress)
+	exportWeChatEmotion(info, expPath, progress)
 }
 
 func exportWeChatHeadImage(info WeChatInfo, expPath string, progress chan<- string) {
@@ -122,15 +122,19 @@ func exportWeChatHeadImage(info WeChatInfo, expPath string, progress chan<- stri
 				break
 			}
 			log.Println("ContactHeadImg1 fileNumber", fileNumber)
-			rows, err := db.Query("select ifnull(usrName,'') as usrName, ifnull(smallHeadBuf,'') as smallHeadBuf from ContactHeadImg1;")
+			querySql := "select ifnull(usrName,'') as usrName, ifnull(smallHeadBuf,'') as smallHeadBuf, '' as bigHeadBuf from ContactHeadImg1;"
+			if tableHasColumn(db, "ContactHeadImg1", "bigHeadBuf") {
+				querySql = "select ifnull(usrName,'') as usrName, ifnull(smallHeadBuf,'') as smallHeadBuf, ifnull(bigHeadBuf,'') as bigHeadBuf from ContactHeadImg1;"
+			}
+			rows, err := db.Query(querySql)
 			if err != nil {
 				log.Printf("Query failed: %v\n", err)
 				break
 			}
 
-			msg := wechatHeadImgMSG{}
 			for rows.Next() {
-				err := rows.Scan(&msg.userName, &msg.Buf)
+				msg := wechatHeadImgMSG{}
+				err := rows.Scan(&msg.userName, &msg.Buf, &msg.BigBuf)
 				if err != nil {
 					log.Println("Scan failed: ", err)
 					break
@@ -148,22 +152,8 @@ func exportWeChatHeadImage(info WeChatInfo, expPath string, progress chan<- stri
 		go func() {
 			defer wg.Done()
 			for msg := range MSGChan {
-				imgPath := fmt.Sprintf("%s\\%s.headimg", headImgPath, msg.userName)
-				for {
-					// log.Println("imgPath:", imgPath, len(msg.Buf))
-					_, err := os.Stat(imgPath)
-					if err == nil {
-						break
-					}
-					if len(msg.userName) == 0 || len(msg.Buf) == 0 {
-						break
-					}
-					err = os.WriteFile(imgPath, msg.Buf[:], 0666)
-					if err != nil {
-						log.Println("WriteFile:", imgPath, err)
-					}
-					break
-				}
+				writeHeadImg(headImgPath, msg.userName, "", msg.Buf)
+				writeHeadImg(headImgPath, msg.userName, headImgHDSuffix, msg.BigBuf)
 				atomic.AddInt64(&handleNumber, 1)
 			}
 		}()
@@ -180,7 +170,7 @@ func exportWeChatHeadImage(info WeChatInfo, expPath string, progress chan<- stri
 			default:
 				if fileNumber != 0 {
 					filePercent := float64(handleNumber) / float64(fileNumber)
-					totalPercent := 81 + (filePercent * (100 - 81))
+					totalPercent := 81 + (filePercent * (95 - 81))
 					totalPercentStr := fmt.Sprintf("{\"status\":\"processing\", \"result\":\"export WeChat Head Image doing\", \"progress\": %d}", int(totalPercent))
 					progress <- totalPercentStr
 				}
@@ -192,7 +182,7 @@ func exportWeChatHeadImage(info WeChatInfo, expPath string, progress chan<- stri
 	wg.Wait()
 	close(quitChan)
 	reportWg.Wait()
-	progress <- "{\"status\":\"processing\", \"result\":\"export WeChat Head Image end\", \"progress\": 100}"
+	progress <- "{\"status\":\"processing\", \"result\":\"export WeChat Head Image end\", \"progress\": 95}"
 }
 
 func exportWeChatVoice(info WeChatInfo, expPath string, progress chan<- string) {
@@ -262,20 +252,29 @@ func exportWeChatVoice(info WeChatInfo, expPath string, progress chan<- string)
 		close(MSGChan)
 	}()
 
+	var infoWg sync.WaitGroup
+	sidecarPath := fmt.Sprintf("%s\\Msg\\%s", expPath, SidecarDB)
+	hasInfo := wechatVoiceInfoIDs(sidecarPath)
+	infoChan := make(chan wechatVoiceInfoMSG, 100)
+	infoWg.Add(1)
+	go func() {
+		defer infoWg.Done()
+		wechatSaveVoiceInfo(sidecarPath, infoChan)
+	}()
+
+	config := GetVoiceExportConfig()
+	log.Printf("export voice config: %+v\n", config)
 	for i := 0; i < 20; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 			for msg := range MSGChan {
-				mp3Path := fmt.Sprintf("%s\\%d.mp3", voicePath, msg.MsgSvrID)
-				_, err := os.Stat(mp3Path)
-				if err == nil {
-					continue
-				}
-
-				err = silkToMp3(msg.Buf[:], mp3Path)
+				voiceInfo, err := exportVoiceFile(msg.Buf[:], voicePath, msg.MsgSvrID, config, hasInfo[msg.MsgSvrID])
 				if err != nil {
-					log.Printf("silkToMp3 %s failed: %v\n", mp3Path, err)
+					log.Printf("exportVoiceFile %d failed: %v\n", msg.MsgSvrID, err)
+				}
+				if voiceInfo != nil {
+					infoChan <- wechatVoiceInfoMSG{MsgSvrID: msg.MsgSvrID, Info: voiceInfo}
 				}
 			}
 		}()
@@ -300,6 +299,8 @@ func exportWeChatVoice(info WeChatInfo, expPath string, progress chan<- string)
 	}()
 
 	wg.Wait()
+	close(infoChan)
+	infoWg.Wait()
 	close(quitChan)
 	reportWg.Wait()
 	progress <- "{\"status\":\"processing\", \"result\":\"export WeChat voice end\", \"progress\": 80}"
@@ -310,7 +311,8 @@ func exportWeChatVideoAndFile(info WeChatInfo, expPath string, progress chan<- s
 	videoRootPath := info.FilePath + "\\FileStorage\\Video"
 	fileRootPath := info.FilePath + "\\FileStorage\\File"
 	cacheRootPath := info.FilePath + "\\FileStorage\\Cache"
-	rootPaths := []string{videoRootPath, fileRootPath, cacheRootPath}
+	customEmotionRootPath := info.FilePath + "\\FileStorage\\CustomEmotion"
+	rootPaths := []string{videoRootPath, fileRootPath, cacheRootPath, customEmotionRootPath}
 
 	handleNumber := int64(0)
 	fileNumber := int64(0)
@@ -326,6 +328,10 @@ func exportWeChatVideoAndFile(info WeChatInfo, expPath string, progress chan<- s
 	go func() {
 		for _, rootPath := range rootPaths {
 			log.Println(rootPath)
+			if _, err := os.Stat(rootPath); err != nil {
+				log.Println("no exist:", rootPath)
+				continue
+			}
 			err := filepath.Walk(rootPath, func(path string, finfo os.FileInfo, err error) error {
 				if err != nil {
 					log.Printf("filepath.Walk：%v\n", err)
@@ -868,39 +874,6 @@ func copyFile(src, dst string) (int64, error) {
 	return bytesWritten, nil
 }
 
-func silkToMp3(amrBuf []byte, mp3Path string) error {
-	amrReader := bytes.NewReader(amrBuf)
-
-	var pcmBuffer bytes.Buffer
-	sr := silk.NewWriter(&pcmBuffer)
-	sr.Decoder.SetSampleRate(24000)
-	amrReader.WriteTo(sr)
-	sr.Close()
-
-	if pcmBuffer.Len() == 0 {
-		return errors.New("silk to mp3 failed " + mp3Path)
-	}
-
-	of, err := os.Create(mp3Path)
-	if err != nil {
-		return nil
-	}
-	defer of.Close()
-
-	wr := lame.NewWriter(of)
-	wr.Encoder.SetInSamplerate(24000)
-	wr.Encoder.SetOutSamplerate(24000)
-	wr.Encoder.SetNumChannels(1)
-	wr.Encoder.SetQuality(5)
-	// IMPORTANT!
-	wr.Encoder.InitParams()
-
-	pcmBuffer.WriteTo(wr)
-	wr.Close()
-
-	return nil
-}
-
 func getPathFileNumber(targetPath string, fileSuffix string) int64 {
 
 	number := int64(0)
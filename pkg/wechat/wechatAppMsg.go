@@ -0,0 +1,200 @@
+package wechat
+
+import (
+	"log"
+	"net/url"
+	"strings"
+)
+
+const (
+	RedPacketUnopened = "unopened"
+	RedPacketReceived = "received"
+	RedPacketFinished = "finished"
+	RedPacketExpired  = "expired"
+)
+
+type RedPacketInfo struct {
+	Greeting  string `json:"Greeting"`
+	SceneText string `json:"SceneText"`
+	SendId    string `json:"SendId"`
+	Status    string `json:"Status"`
+	Receipts  int    `json:"Receipts"`
+}
+
+type NoticeInfo struct {
+	Text       string `json:"Text"`
+	Editor     string `json:"Editor"`
+	EditorName string `json:"EditorName"`
+}
+
+type AppletInfo struct {
+	AppId       string `json:"AppId"`
+	UserName    string `json:"UserName"`
+	PagePath    string `json:"PagePath"`
+	IconPath    string `json:"IconPath"`
+	DisPlayName string `json:"DisPlayName"`
+}
+
+type GameInfo struct {
+	Name string `json:"Name"`
+}
+
+// redPacketSendId returns the sendid of a red packet url, receipts link to
+// the red packet with the same sendid.
+func redPacketSendId(rawUrl string) string {
+	index := strings.Index(rawUrl, "?")
+	if index == -1 {
+		return ""
+	}
+
+	values, err := url.ParseQuery(rawUrl[index+1:])
+	if err != nil {
+		return ""
+	}
+
+	return values.Get("sendid")
+}
+
+func (P *WechatDataProvider) wechatMessageRedPacketParse(msg *WeChatMessage, root *xmlDocument) {
+	msg.RedPacketInfo.Greeting = root.FindElementValue("/msg/appmsg/wcpayinfo/receivertitle")
+	if len(msg.RedPacketInfo.Greeting) == 0 {
+		msg.RedPacketInfo.Greeting = root.FindElementValue("/msg/appmsg/wcpayinfo/sendertitle")
+	}
+	msg.RedPacketInfo.SceneText = root.FindElementValue("/msg/appmsg/wcpayinfo/scenetext")
+	msg.RedPacketInfo.SendId = redPacketSendId(root.FindElementValue("/msg/appmsg/wcpayinfo/nativeurl"))
+	if len(msg.RedPacketInfo.SendId) == 0 {
+		msg.RedPacketInfo.SendId = redPacketSendId(root.FindElementValue("/msg/appmsg/wcpayinfo/url"))
+	}
+}
+
+func (P *WechatDataProvider) wechatMessageNoticeParse(msg *WeChatMessage, root *xmlDocument) {
+	msg.NoticeInfo.Text = root.FindElementValue("/msg/appmsg/textannouncement")
+	if len(msg.NoticeInfo.Text) == 0 {
+		msg.NoticeInfo.Text = root.FindElementValue("/msg/appmsg/des")
+	}
+
+	msg.NoticeInfo.Editor = root.FindElementValue("/msg/fromusername")
+	if len(msg.NoticeInfo.Editor) == 0 {
+		msg.NoticeInfo.Editor = messageSenderName(msg, P.SelfInfo.UserName)
+	}
+	if info, err := P.WechatGetUserInfoByNameOnCache(msg.NoticeInfo.Editor); err == nil {
+		msg.NoticeInfo.EditorName = userDisplayName(info)
+	}
+}
+
+func (P *WechatDataProvider) wechatMessageAppletParse(msg *WeChatMessage, root *xmlDocument) {
+	msg.AppletInfo.AppId = root.FindElementValue("/msg/appmsg/weappinfo/appid")
+	msg.AppletInfo.UserName = root.FindElementValue("/msg/appmsg/weappinfo/username")
+	msg.AppletInfo.PagePath = root.FindElementValue("/msg/appmsg/weappinfo/pagepath")
+	msg.AppletInfo.DisPlayName = root.FindElementValue("/msg/appmsg/sourcedisplayname")
+	if iconUrl := root.FindElementValue("/msg/appmsg/weappinfo/weappiconurl"); len(iconUrl) > 0 {
+		msg.AppletInfo.IconPath = P.wechatGetAssetPath(iconUrl)
+	}
+}
+
+func (P *WechatDataProvider) wechatMessageGameParse(msg *WeChatMessage, root *xmlDocument) {
+	msg.GameInfo.Name = root.FindElementValue("/msg/appinfo/appname")
+	if len(msg.GameInfo.Name) == 0 {
+		msg.GameInfo.Name = root.FindElementValue("/msg/appmsg/sourcedisplayname")
+	}
+}
+
+func (P *WechatDataProvider) wechatMessageCustomEmojiParse(msg *WeChatMessage, root *xmlDocument) {
+	md5 := root.FindElementValue("/msg/appmsg/appattach/emoticonmd5")
+	if len(md5) == 0 {
+		return
+	}
+
+	msg.EmojiPath = P.wechatGetEmojiLocalPath(md5)
+	if len(msg.EmojiPath) == 0 {
+		msg.EmojiPath = P.wechatGetAssetPath(root.FindElementValue("/msg/appmsg/appattach/cdnthumburl"))
+	}
+}
+
+// redPacketReceipts is what the system messages linking to a red packet
+// tell, status is empty unless it is finished or expired.
+type redPacketReceipts struct {
+	status   string
+	receipts int
+}
+
+// wechatRedPacketReceipts maps the sendids of the red packets of talker to
+// their receipts, the session is read once.
+func (P *WechatDataProvider) wechatRedPacketReceipts(talker string) map[string]*redPacketReceipts {
+	if receipts, ok := P.redPacketCache.Load(talker); ok {
+		return receipts.(map[string]*redPacketReceipts)
+	}
+
+	receipts := make(map[string]*redPacketReceipts)
+	querySql := "select ifnull(StrContent,'') from MSG where StrTalker=? And Type=? And instr(StrContent, 'sendid=')>0;"
+	for _, info := range P.shardIndex[talker] {
+		err := func() error {
+			rows, err := P.wechatQuery(P.msgDBs[info.index].db, querySql, talker, Wechat_Message_Type_System)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+
+			for rows.Next() {
+				var content string
+				if err := rows.Scan(&content); err != nil {
+					return err
+				}
+
+				match := systemSendIdRe.FindStringSubmatch(content)
+				if match == nil {
+					continue
+				}
+				receipt, ok := receipts[match[1]]
+				if !ok {
+					receipt = &redPacketReceipts{}
+					receipts[match[1]] = receipt
+				}
+
+				text := systemMsgParse(Wechat_Message_Type_System, content)
+				if strings.Contains(text, "领完") {
+					receipt.status = RedPacketFinished
+				} else if strings.Contains(text, "过期") {
+					receipt.status = RedPacketExpired
+				} else {
+					receipt.receipts += 1
+				}
+			}
+
+			return rows.Err()
+		}()
+		if err != nil {
+			// not cached, the next red packet tries again
+			log.Println("select red packet receipts failed:", err)
+			return receipts
+		}
+	}
+	P.redPacketCache.Store(talker, receipts)
+
+	return receipts
+}
+
+// wechatMessageRedPacketStatusHandle sets the status of a red packet from
+// the receipts of its sendid.
+func (P *WechatDataProvider) wechatMessageRedPacketStatusHandle(msg *WeChatMessage) {
+	if msg.Type != Wechat_Message_Type_Misc || msg.SubType != Wechat_Misc_Message_RedPacket {
+		return
+	}
+
+	msg.RedPacketInfo.Status = RedPacketUnopened
+	if len(msg.RedPacketInfo.SendId) == 0 {
+		return
+	}
+
+	receipt, ok := P.wechatRedPacketReceipts(msg.Talker)[msg.RedPacketInfo.SendId]
+	if !ok {
+		return
+	}
+
+	msg.RedPacketInfo.Receipts = receipt.receipts
+	if len(receipt.status) > 0 {
+		msg.RedPacketInfo.Status = receipt.status
+	} else if receipt.receipts > 0 {
+		msg.RedPacketInfo.Status = RedPacketReceived
+	}
+}
@@ -0,0 +1,45 @@
+package wechat
+
+import "testing"
+
+func TestRedPacketSendId(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"wxpay://c2cbizmessagehandler/hongbao/receivehongbao?msgtype=1&channelid=1&sendid=1000039401202310187&sendusername=wxid_a", "1000039401202310187"},
+		{"https://wxapp.tenpay.com/mmpayhb/wxhb_personalreceive?showwxpaytitle=1&sendid=1000039&ver=6", "1000039"},
+		{"https://wxapp.tenpay.com/mmpayhb/wxhb_personalreceive", ""},
+		{"https://example.com/?msgtype=1", ""},
+		{"?sendid=%zz", ""},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		if got := redPacketSendId(test.url); got != test.want {
+			t.Errorf("redPacketSendId(%q) = %q, want %q", test.url, got, test.want)
+		}
+	}
+}
+
+func TestSearchIndexText(t *testing.T) {
+	tests := []struct {
+		msg  WeChatMessage
+		want string
+	}{
+		{WeChatMessage{Type: Wechat_Message_Type_Text, Content: " hello "}, "hello"},
+		{WeChatMessage{Type: Wechat_Message_Type_Picture, Content: "<msg/>"}, ""},
+		{WeChatMessage{Type: Wechat_Message_Type_Misc, SubType: Wechat_Misc_Message_Applet,
+			LinkInfo: LinkInfo{Title: "title"}, AppletInfo: AppletInfo{DisPlayName: "applet"}}, "title\napplet"},
+		{WeChatMessage{Type: Wechat_Message_Type_Misc, SubType: Wechat_Misc_Message_RedPacket,
+			RedPacketInfo: RedPacketInfo{Greeting: "恭喜发财"}}, "恭喜发财"},
+		{WeChatMessage{Type: Wechat_Message_Type_Misc, SubType: Wechat_Misc_Message_Game,
+			LinkInfo: LinkInfo{Title: "play"}, GameInfo: GameInfo{Name: "game"}}, "play\ngame"},
+	}
+
+	for _, test := range tests {
+		if got := searchIndexText(&test.msg); got != test.want {
+			t.Errorf("searchIndexText(%d/%d) = %q, want %q", test.msg.Type, test.msg.SubType, got, test.want)
+		}
+	}
+}
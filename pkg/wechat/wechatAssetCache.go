@@ -0,0 +1,378 @@
+package wechat
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"wechatDataBackup/pkg/utils"
+)
+
+const (
+	assetCacheDir       = "FileStorage\\Cache\\Asset"
+	assetMaxSize        = 20 * 1024 * 1024
+	assetDefaultRetries = 3
+	assetDefaultRate    = 200 * time.Millisecond
+	assetFetchWorkers   = 4
+)
+
+// Fetcher downloads the content of url, the asset cache only deals with
+// this interface so that downloads can be replaced, e.g. by a local http
+// server.
+type Fetcher interface {
+	Fetch(url string) ([]byte, error)
+}
+
+type HTTPFetcher struct {
+	Client    *http.Client
+	UserAgent string
+}
+
+func NewHTTPFetcher() *HTTPFetcher {
+	return &HTTPFetcher{
+		Client:    &http.Client{Timeout: 30 * time.Second},
+		UserAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64)",
+	}
+}
+
+func (f *HTTPFetcher) Fetch(url string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if f.UserAgent != "" {
+		req.Header.Set("User-Agent", f.UserAgent)
+	}
+
+	resp, err := f.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch %s status %d", url, resp.StatusCode)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, assetMaxSize))
+}
+
+// AssetCache keeps remote images under FileStorage\Cache\Asset, named by
+// the sha256 of their url.
+type AssetCache struct {
+	cachePath  string
+	prefixPath string
+	Retries    int
+	Interval   time.Duration
+
+	fetcherMtx sync.Mutex
+	fetcher    Fetcher
+
+	filesMtx  sync.Mutex
+	files     map[string]string
+	rateMtx   sync.Mutex
+	lastFetch time.Time
+}
+
+type AssetPrefetchResult struct {
+	Total   int `json:"Total"`
+	Fetched int `json:"Fetched"`
+	Cached  int `json:"Cached"`
+	Failed  int `json:"Failed"`
+}
+
+func NewAssetCache(resPath, prefixResPath string, fetcher Fetcher) *AssetCache {
+	c := &AssetCache{
+		cachePath:  resPath + "\\" + assetCacheDir,
+		prefixPath: prefixResPath + "\\" + assetCacheDir,
+		fetcher:    fetcher,
+		Retries:    assetDefaultRetries,
+		Interval:   assetDefaultRate,
+		files:      make(map[string]string),
+	}
+
+	entries, err := os.ReadDir(c.cachePath)
+	if err == nil {
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			name := entry.Name()
+			c.files[strings.TrimSuffix(name, filepath.Ext(name))] = name
+		}
+	}
+
+	return c
+}
+
+func (c *AssetCache) SetFetcher(fetcher Fetcher) {
+	c.fetcherMtx.Lock()
+	defer c.fetcherMtx.Unlock()
+	c.fetcher = fetcher
+}
+
+func (c *AssetCache) getFetcher() Fetcher {
+	c.fetcherMtx.Lock()
+	defer c.fetcherMtx.Unlock()
+	return c.fetcher
+}
+
+func isRemoteUrl(url string) bool {
+	return strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")
+}
+
+// Lookup returns the relative path of the cached url, or "" when it has
+// not been downloaded.
+func (c *AssetCache) Lookup(url string) string {
+	if c == nil || !isRemoteUrl(url) {
+		return ""
+	}
+
+	c.filesMtx.Lock()
+	defer c.filesMtx.Unlock()
+	if name, ok := c.files[utils.Hash256Sum([]byte(url))]; ok {
+		return c.prefixPath + "\\" + name
+	}
+
+	return ""
+}
+
+func (c *AssetCache) wait() {
+	if c.Interval <= 0 {
+		return
+	}
+
+	c.rateMtx.Lock()
+	now := time.Now()
+	next := c.lastFetch.Add(c.Interval)
+	if next.Before(now) {
+		next = now
+	}
+	c.lastFetch = next
+	c.rateMtx.Unlock()
+
+	time.Sleep(next.Sub(now))
+}
+
+// Fetch downloads url into the cache, retrying with a growing delay, and
+// returns its relative path.
+func (c *AssetCache) Fetch(url string) (string, error) {
+	if path := c.Lookup(url); path != "" {
+		return path, nil
+	}
+	if !isRemoteUrl(url) {
+		return "", errors.New("not remote url: " + url)
+	}
+	fetcher := c.getFetcher()
+	if fetcher == nil {
+		return "", errors.New("asset fetcher not set")
+	}
+
+	var buf []byte
+	var err error
+	for i := 0; i <= c.Retries; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(1<<(i-1)) * time.Second)
+		}
+		c.wait()
+		buf, err = fetcher.Fetch(url)
+		if err == nil {
+			break
+		}
+		log.Printf("fetch %s failed (%d): %v\n", url, i, err)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	ext := utils.GetImageExt(buf)
+	if ext == "" {
+		return "", errors.New("not image: " + url)
+	}
+
+	if _, err := os.Stat(c.cachePath); err != nil {
+		if err := os.MkdirAll(c.cachePath, 0644); err != nil {
+			return "", err
+		}
+	}
+
+	key := utils.Hash256Sum([]byte(url))
+	name := key + ext
+	if err := os.WriteFile(c.cachePath+"\\"+name, buf, 0666); err != nil {
+		return "", err
+	}
+
+	c.filesMtx.Lock()
+	c.files[key] = name
+	c.filesMtx.Unlock()
+
+	return c.prefixPath + "\\" + name, nil
+}
+
+// Prefetch downloads every url not yet cached, report is called after each
+// url with the current result. No url is started once quit is closed.
+func (c *AssetCache) Prefetch(urls []string, quit <-chan struct{}, report func(result AssetPrefetchResult)) AssetPrefetchResult {
+	var fetched, cached, failed int64
+	total := 0
+	urlChan := make(chan string, 100)
+	var wg sync.WaitGroup
+
+	snapshot := func() AssetPrefetchResult {
+		return AssetPrefetchResult{
+			Total:   total,
+			Fetched: int(atomic.LoadInt64(&fetched)),
+			Cached:  int(atomic.LoadInt64(&cached)),
+			Failed:  int(atomic.LoadInt64(&failed)),
+		}
+	}
+
+	uniq := make(map[string]bool)
+	for _, url := range urls {
+		if isRemoteUrl(url) && !uniq[url] {
+			uniq[url] = true
+		}
+	}
+	total = len(uniq)
+
+	for i := 0; i < assetFetchWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for url := range urlChan {
+				if c.Lookup(url) != "" {
+					atomic.AddInt64(&cached, 1)
+				} else if _, err := c.Fetch(url); err != nil {
+					atomic.AddInt64(&failed, 1)
+				} else {
+					atomic.AddInt64(&fetched, 1)
+				}
+				if report != nil {
+					report(snapshot())
+				}
+			}
+		}()
+	}
+
+feed:
+	for url := range uniq {
+		select {
+		case urlChan <- url:
+		case <-quit:
+			log.Println("prefetch assets quit")
+			break feed
+		}
+	}
+	close(urlChan)
+	wg.Wait()
+
+	return snapshot()
+}
+
+// wechatGetAssetPath returns the cached copy of url, or url itself when it
+// has not been downloaded.
+func (P *WechatDataProvider) wechatGetAssetPath(url string) string {
+	if path := P.assetCache.Lookup(url); path != "" {
+		return path
+	}
+
+	return url
+}
+
+func (P *WechatDataProvider) WeChatSetAssetFetcher(fetcher Fetcher) {
+	P.assetCache.SetFetcher(fetcher)
+}
+
+func userInfoAssetUrls(info *WeChatUserInfo) []string {
+	if info.LocalHeadImgUrl != "" {
+		return nil
+	}
+
+	if info.BigHeadImgUrl != "" {
+		return []string{info.BigHeadImgUrl}
+	}
+
+	return []string{info.SmallHeadImgUrl}
+}
+
+func (P *WechatDataProvider) wechatGetMessageAssetUrls(userName string) ([]string, error) {
+	urls := make([]string, 0)
+	pageSize := 600
+	cursor := ""
+	for {
+		mlist, err := P.WeChatGetMessageListByCursor(userName, cursor, pageSize, Message_Search_Forward, nil)
+		if err != nil {
+			return urls, err
+		}
+
+		for _, m := range mlist.Rows {
+			urls = append(urls, userInfoAssetUrls(&m.UserInfo)...)
+			switch m.Type {
+			case Wechat_Message_Type_Emoji:
+				urls = append(urls, m.EmojiPath)
+			case Wechat_Message_Type_Visit_Card:
+				urls = append(urls, userInfoAssetUrls(&m.VisitInfo)...)
+			case Wechat_Message_Type_Misc:
+				urls = append(urls, m.ThumbPath, m.ChannelsInfo.ThumbPath)
+			}
+		}
+
+		if mlist.Total < pageSize {
+			break
+		}
+		cursor = mlist.NextCursor
+	}
+
+	return urls, nil
+}
+
+// WeChatPrefetchAssets downloads the remote images of userName's messages
+// into the asset cache, or the head images of every contact when userName
+// is empty.
+func (P *WechatDataProvider) WeChatPrefetchAssets(userName string, progress chan<- string) {
+	defer close(progress)
+	if !P.wechatBackgroundStart() {
+		progress <- "{\"status\":\"error\", \"result\":\"provider is closing\"}"
+		return
+	}
+	defer P.bgWg.Done()
+
+	progress <- "{\"status\":\"processing\", \"result\":\"prefetch assets start\", \"progress\": 0}"
+
+	urls := make([]string, 0)
+	if userName == "" {
+		for i := range P.ContactList.Users {
+			urls = append(urls, userInfoAssetUrls(&P.ContactList.Users[i].WeChatUserInfo)...)
+		}
+	} else {
+		msgUrls, err := P.wechatGetMessageAssetUrls(userName)
+		if err != nil {
+			log.Println("wechatGetMessageAssetUrls failed:", err)
+			progress <- fmt.Sprintf("{\"status\":\"error\", \"result\":\"%v error\"}", err)
+			return
+		}
+		urls = append(urls, msgUrls...)
+	}
+
+	lastPercent := 0
+	var reportMtx sync.Mutex
+	result := P.assetCache.Prefetch(urls, P.quit, func(result AssetPrefetchResult) {
+		done := result.Fetched + result.Cached + result.Failed
+		percent := done * 100 / result.Total
+		reportMtx.Lock()
+		defer reportMtx.Unlock()
+		if percent > lastPercent && percent < 100 {
+			lastPercent = percent
+			progress <- fmt.Sprintf("{\"status\":\"processing\", \"result\":\"prefetch assets %d/%d\", \"progress\": %d}", done, result.Total, percent)
+		}
+	})
+
+	log.Printf("prefetch assets: %+v\n", result)
+	progress <- fmt.Sprintf("{\"status\":\"processing\", \"result\":\"prefetch assets end, fetched %d, failed %d\", \"progress\": 100}", result.Fetched, result.Failed)
+}
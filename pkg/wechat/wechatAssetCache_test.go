@@ -0,0 +1,138 @@
+package wechat
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+var testPNG = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR")
+
+func newTestAssetServer(t *testing.T, requests *int64) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(requests, 1)
+		switch r.URL.Path {
+		case "/image":
+			w.Write(testPNG)
+		case "/text":
+			w.Write([]byte("hello"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestAssetCacheFetch(t *testing.T) {
+	var requests int64
+	server := newTestAssetServer(t, &requests)
+	dir := t.TempDir()
+	cache := NewAssetCache(dir, "prefix", NewHTTPFetcher())
+	cache.Interval = 0
+
+	url := server.URL + "/image"
+	if path := cache.Lookup(url); path != "" {
+		t.Fatalf("Lookup before Fetch = %q", path)
+	}
+
+	path, err := cache.Fetch(url)
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	if !strings.HasPrefix(path, "prefix\\"+assetCacheDir+"\\") || !strings.HasSuffix(path, ".png") {
+		t.Errorf("Fetch = %q, want a .png under the cache prefix", path)
+	}
+	if got := cache.Lookup(url); got != path {
+		t.Errorf("Lookup = %q, want %q", got, path)
+	}
+
+	if again, err := cache.Fetch(url); err != nil || again != path {
+		t.Errorf("second Fetch = %q, %v", again, err)
+	}
+	if n := atomic.LoadInt64(&requests); n != 1 {
+		t.Errorf("%d requests, want 1", n)
+	}
+
+	// a new cache finds the files of the previous one, the cache paths are
+	// only directories on Windows
+	if runtime.GOOS != "windows" {
+		return
+	}
+	reopened := NewAssetCache(dir, "prefix", nil)
+	if got := reopened.Lookup(url); got != path {
+		t.Errorf("Lookup after reopen = %q, want %q", got, path)
+	}
+}
+
+func TestAssetCacheFetchFailure(t *testing.T) {
+	var requests int64
+	server := newTestAssetServer(t, &requests)
+	cache := NewAssetCache(t.TempDir(), "prefix", NewHTTPFetcher())
+	cache.Interval = 0
+	cache.Retries = 0
+
+	tests := []struct {
+		name string
+		url  string
+	}{
+		{"not found", server.URL + "/missing"},
+		{"not image", server.URL + "/text"},
+		{"not remote", "file:///etc/passwd"},
+	}
+
+	for _, test := range tests {
+		if path, err := cache.Fetch(test.url); err == nil {
+			t.Errorf("%s: Fetch = %q, want an error", test.name, path)
+		}
+		if path := cache.Lookup(test.url); path != "" {
+			t.Errorf("%s: Lookup = %q after a failed Fetch", test.name, path)
+		}
+	}
+	if n := atomic.LoadInt64(&requests); n != 2 {
+		t.Errorf("%d requests, want 2", n)
+	}
+
+	cache.SetFetcher(nil)
+	if _, err := cache.Fetch(server.URL + "/image"); err == nil {
+		t.Error("Fetch without fetcher succeeded")
+	}
+}
+
+func TestAssetCachePrefetch(t *testing.T) {
+	var requests int64
+	server := newTestAssetServer(t, &requests)
+	cache := NewAssetCache(t.TempDir(), "prefix", NewHTTPFetcher())
+	cache.Interval = 0
+	cache.Retries = 0
+
+	if _, err := cache.Fetch(server.URL + "/image?cached"); err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+
+	urls := []string{server.URL + "/image", server.URL + "/image", server.URL + "/image?cached",
+		server.URL + "/missing", "", "local\\path"}
+	result := cache.Prefetch(urls, nil, nil)
+	want := AssetPrefetchResult{Total: 3, Fetched: 1, Cached: 1, Failed: 1}
+	if result != want {
+		t.Errorf("Prefetch = %+v, want %+v", result, want)
+	}
+}
+
+func TestAssetCachePrefetchQuit(t *testing.T) {
+	var requests int64
+	server := newTestAssetServer(t, &requests)
+	cache := NewAssetCache(t.TempDir(), "prefix", NewHTTPFetcher())
+	cache.Interval = 0
+
+	quit := make(chan struct{})
+	close(quit)
+	result := cache.Prefetch([]string{server.URL + "/image"}, quit, nil)
+	if result.Fetched != 0 || atomic.LoadInt64(&requests) != 0 {
+		t.Errorf("Prefetch after quit = %+v with %d requests", result, requests)
+	}
+}
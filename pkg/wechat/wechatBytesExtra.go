@@ -0,0 +1,123 @@
+package wechat
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/beevik/etree"
+	"google.golang.org/protobuf/proto"
+)
+
+// keys of the MessageBytesExtra string entries. Only these are decoded,
+// the int pair of Message1 and the other string keys carry nothing the
+// frontend shows and are ignored.
+const (
+	bytesExtraSender    = 1
+	bytesExtraThumb     = 3
+	bytesExtraFile      = 4
+	bytesExtraMsgSource = 7
+)
+
+const mentionAll = "notify@all"
+
+// MessageSourceInfo is the msgsource XML of a message. AtUserList holds
+// the mentioned user names, "notify@all" is reported as AtAll instead.
+type MessageSourceInfo struct {
+	AtUserList  []string `json:"AtUserList"`
+	AtAll       bool     `json:"AtAll"`
+	Silence     bool     `json:"Silence"`
+	MemberCount int      `json:"MemberCount"`
+}
+
+// messageExtra is a decoded BytesExtra, strings keeps every string entry
+// by key.
+type messageExtra struct {
+	strings map[int32][]string
+}
+
+func decodeMessageExtra(bytesExtra []byte) (*messageExtra, error) {
+	var extra MessageBytesExtra
+	if err := proto.Unmarshal(bytesExtra, &extra); err != nil {
+		return nil, err
+	}
+
+	decoded := &messageExtra{strings: make(map[int32][]string)}
+	for _, ext := range extra.Message2 {
+		decoded.strings[ext.Field1] = append(decoded.strings[ext.Field1], ext.Field2)
+	}
+
+	return decoded, nil
+}
+
+// value returns the first string entry of key.
+func (e *messageExtra) value(key int32) string {
+	if values := e.strings[key]; len(values) > 0 {
+		return values[0]
+	}
+
+	return ""
+}
+
+// msgSource parses the msgsource XML of the extra.
+func (e *messageExtra) msgSource() MessageSourceInfo {
+	source := MessageSourceInfo{AtUserList: make([]string, 0)}
+	xmlSource := e.value(bytesExtraMsgSource)
+	if len(xmlSource) == 0 {
+		return source
+	}
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromString(xmlSource); err != nil {
+		return source
+	}
+
+	root := doc.SelectElement("msgsource")
+	if root == nil {
+		return source
+	}
+
+	for _, userName := range strings.Split(elementValue(root, "atuserlist"), ",") {
+		userName = strings.TrimSpace(userName)
+		if len(userName) == 0 {
+			continue
+		}
+		if userName == mentionAll {
+			source.AtAll = true
+		} else {
+			source.AtUserList = append(source.AtUserList, userName)
+		}
+	}
+	source.Silence = elementValue(root, "silence") == "1"
+	source.MemberCount, _ = strconv.Atoi(elementValue(root, "membercount"))
+
+	return source
+}
+
+// bytesExtraSenderName returns the sender of a chat room message.
+func bytesExtraSenderName(bytesExtra []byte) string {
+	extra, err := decodeMessageExtra(bytesExtra)
+	if err != nil {
+		return ""
+	}
+
+	return extra.value(bytesExtraSender)
+}
+
+// wechatMessageMentionHandle resolves the mentioned users of a message.
+// Group members that are not contacts get their group display name as
+// NickName, other unknown user names only have their UserName set.
+func (P *WechatDataProvider) wechatMessageMentionHandle(msg *WeChatMessage) {
+	msg.Mentions = make([]WeChatUserInfo, 0, len(msg.SourceInfo.AtUserList))
+	for _, userName := range msg.SourceInfo.AtUserList {
+		if info, err := P.WechatGetUserInfoByNameOnCache(userName); err == nil {
+			msg.Mentions = append(msg.Mentions, *info)
+			continue
+		}
+
+		member := WeChatUserInfo{UserName: userName}
+		if msg.IsChatRoom {
+			member.NickName = P.wechatChatRoomDisplayNames(msg.Talker)[userName]
+		}
+		msg.Mentions = append(msg.Mentions, member)
+	}
+}
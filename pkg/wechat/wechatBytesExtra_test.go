@@ -0,0 +1,71 @@
+package wechat
+
+import (
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func bytesExtraOf(t *testing.T, entries map[int32]string) []byte {
+	extra := &MessageBytesExtra{Message1: &SubMessage1{Field1: 1, Field2: 2}}
+	for key, value := range entries {
+		extra.Message2 = append(extra.Message2, &SubMessage2{Field1: key, Field2: value})
+	}
+	buf, err := proto.Marshal(extra)
+	if err != nil {
+		t.Fatalf("proto.Marshal failed: %v", err)
+	}
+
+	return buf
+}
+
+func TestMsgSource(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   MessageSourceInfo
+	}{
+		{"empty", "", MessageSourceInfo{AtUserList: []string{}}},
+		{"invalid", "<msgsource>", MessageSourceInfo{AtUserList: []string{}}},
+		{"other root", "<foo><silence>1</silence></foo>", MessageSourceInfo{AtUserList: []string{}}},
+		{"mentions",
+			"<msgsource><atuserlist>,wxid_a, wxid_b,</atuserlist><membercount>12</membercount></msgsource>",
+			MessageSourceInfo{AtUserList: []string{"wxid_a", "wxid_b"}, MemberCount: 12}},
+		{"mention all",
+			"<msgsource><atuserlist>notify@all</atuserlist><silence>1</silence></msgsource>",
+			MessageSourceInfo{AtUserList: []string{}, AtAll: true, Silence: true}},
+		{"silence off",
+			"<msgsource><silence>0</silence><membercount>x</membercount></msgsource>",
+			MessageSourceInfo{AtUserList: []string{}}},
+	}
+
+	for _, test := range tests {
+		extra, err := decodeMessageExtra(bytesExtraOf(t, map[int32]string{bytesExtraMsgSource: test.source}))
+		if err != nil {
+			t.Fatalf("%s: decodeMessageExtra failed: %v", test.name, err)
+		}
+		if got := extra.msgSource(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: msgSource = %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestBytesExtraSenderName(t *testing.T) {
+	tests := []struct {
+		name       string
+		bytesExtra []byte
+		want       string
+	}{
+		{"sender", bytesExtraOf(t, map[int32]string{bytesExtraSender: "wxid_a", bytesExtraThumb: "thumb"}), "wxid_a"},
+		{"no sender", bytesExtraOf(t, map[int32]string{bytesExtraThumb: "thumb"}), ""},
+		{"empty", nil, ""},
+		{"invalid", []byte{0xff, 0xff}, ""},
+	}
+
+	for _, test := range tests {
+		if got := bytesExtraSenderName(test.bytesExtra); got != test.want {
+			t.Errorf("%s: bytesExtraSenderName = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package wechat
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// messageCursor is a position in the message list of a session, either a
+// message (shard, Sequence, localId) or, when shard is -1, a timestamp.
+// An inclusive message cursor sits just before its message, so going
+// Forward starts with the message itself.
+type messageCursor struct {
+	shard     int
+	sequence  int64
+	localId   int
+	time      int64
+	inclusive bool
+}
+
+func timeCursor(t int64) *messageCursor {
+	return &messageCursor{shard: -1, time: t}
+}
+
+func (c *messageCursor) isTime() bool {
+	return c.shard < 0
+}
+
+// messageCursorOf returns the position of msg, which must come from
+// wechatQueryMessageList.
+func messageCursorOf(msg *WeChatMessage) *messageCursor {
+	return &messageCursor{shard: msg.shard, sequence: msg.sequence, localId: msg.LocalId}
+}
+
+// jumpCursorOf returns the cursor opening a session at msg, msg included.
+func jumpCursorOf(msg *WeChatMessage) *messageCursor {
+	c := messageCursorOf(msg)
+	c.inclusive = true
+	return c
+}
+
+// encodeMessageCursor returns the opaque string given to the frontend, the
+// shard is stored by file name so a cursor survives a reopen.
+func (P *WechatDataProvider) encodeMessageCursor(c *messageCursor) string {
+	var raw string
+	if c.isTime() {
+		raw = fmt.Sprintf("@%d", c.time)
+	} else {
+		raw = fmt.Sprintf("%s:%d:%d", filepath.Base(P.msgDBs[c.shard].path), c.sequence, c.localId)
+		if c.inclusive {
+			raw = "=" + raw
+		}
+	}
+
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// decodeMessageCursor parses a cursor from encodeMessageCursor, an empty
+// cursor starts at the newest (Forward) or oldest (Backward) message.
+func (P *WechatDataProvider) decodeMessageCursor(cursor string, direction Message_Search_Direction) (*messageCursor, error) {
+	if len(cursor) == 0 {
+		if direction == Message_Search_Backward {
+			return timeCursor(0), nil
+		}
+		return timeCursor(math.MaxInt64), nil
+	}
+
+	buf, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor: %v", err)
+	}
+	raw := string(buf)
+
+	if strings.HasPrefix(raw, "@") {
+		t, err := strconv.ParseInt(raw[1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cursor time: %v", err)
+		}
+		return timeCursor(t), nil
+	}
+
+	c := &messageCursor{shard: -1}
+	if strings.HasPrefix(raw, "=") {
+		c.inclusive = true
+		raw = raw[1:]
+	}
+
+	fields := strings.Split(raw, ":")
+	if len(fields) != 3 {
+		return nil, errors.New("invalid cursor")
+	}
+
+	for i, msgDB := range P.msgDBs {
+		if filepath.Base(msgDB.path) == fields[0] {
+			c.shard = i
+			break
+		}
+	}
+	if c.shard == -1 {
+		return nil, fmt.Errorf("cursor shard %s not found", fields[0])
+	}
+
+	if c.sequence, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid cursor sequence: %v", err)
+	}
+	if c.localId, err = strconv.Atoi(fields[2]); err != nil {
+		return nil, fmt.Errorf("invalid cursor localId: %v", err)
+	}
+
+	return c, nil
+}
+
+// sqlCondition returns the " And ..." clause selecting the messages after
+// the cursor in direction, inside the cursor's shard.
+func (c *messageCursor) sqlCondition(direction Message_Search_Direction) (string, []interface{}) {
+	if c.isTime() {
+		if direction == Message_Search_Backward {
+			return " And CreateTime>?", []interface{}{c.time}
+		}
+		return " And CreateTime<=?", []interface{}{c.time}
+	}
+
+	if direction == Message_Search_Backward {
+		return " And (Sequence>? OR (Sequence=? And localId>?))", []interface{}{c.sequence, c.sequence, c.localId}
+	}
+	if c.inclusive {
+		return " And (Sequence<? OR (Sequence=? And localId<=?))", []interface{}{c.sequence, c.sequence, c.localId}
+	}
+	return " And (Sequence<? OR (Sequence=? And localId<?))", []interface{}{c.sequence, c.sequence, c.localId}
+}
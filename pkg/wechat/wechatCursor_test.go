@@ -0,0 +1,100 @@
+package wechat
+
+import (
+	"encoding/base64"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestMessageCursorEncodeDecode(t *testing.T) {
+	P := &WechatDataProvider{msgDBs: []*wechatMsgDB{{path: "Multi/MSG1.db"}, {path: "Multi/MSG0.db"}}}
+
+	tests := []struct {
+		name   string
+		cursor *messageCursor
+	}{
+		{"message", &messageCursor{shard: 1, sequence: 1704067200000, localId: 42}},
+		{"first shard", &messageCursor{shard: 0, sequence: 0, localId: 1}},
+		{"inclusive", &messageCursor{shard: 0, sequence: 5, localId: 7, inclusive: true}},
+		{"time", timeCursor(1704067200)},
+		{"zero time", timeCursor(0)},
+	}
+
+	for _, test := range tests {
+		encoded := P.encodeMessageCursor(test.cursor)
+		decoded, err := P.decodeMessageCursor(encoded, Message_Search_Forward)
+		if err != nil {
+			t.Errorf("%s: decodeMessageCursor(%q) failed: %v", test.name, encoded, err)
+			continue
+		}
+		if !reflect.DeepEqual(decoded, test.cursor) {
+			t.Errorf("%s: decoded %+v, want %+v", test.name, decoded, test.cursor)
+		}
+	}
+}
+
+func TestMessageCursorDecode(t *testing.T) {
+	P := &WechatDataProvider{msgDBs: []*wechatMsgDB{{path: "Multi/MSG0.db"}}}
+	raw := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+
+	tests := []struct {
+		name      string
+		cursor    string
+		direction Message_Search_Direction
+		want      *messageCursor
+	}{
+		{"newest", "", Message_Search_Forward, timeCursor(math.MaxInt64)},
+		{"oldest", "", Message_Search_Backward, timeCursor(0)},
+		{"message", raw("MSG0.db:5:7"), Message_Search_Forward, &messageCursor{shard: 0, sequence: 5, localId: 7}},
+		{"inclusive", raw("=MSG0.db:5:7"), Message_Search_Forward, &messageCursor{shard: 0, sequence: 5, localId: 7, inclusive: true}},
+		{"not base64", "!!", Message_Search_Forward, nil},
+		{"inclusive time", raw("=@5"), Message_Search_Forward, nil},
+		{"bad time", raw("@x"), Message_Search_Forward, nil},
+		{"missing field", raw("MSG0.db:5"), Message_Search_Forward, nil},
+		{"unknown shard", raw("MSG9.db:5:7"), Message_Search_Forward, nil},
+		{"bad sequence", raw("MSG0.db:x:7"), Message_Search_Forward, nil},
+		{"bad localId", raw("MSG0.db:5:x"), Message_Search_Forward, nil},
+	}
+
+	for _, test := range tests {
+		got, err := P.decodeMessageCursor(test.cursor, test.direction)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%s: decodeMessageCursor = %+v, want an error", test.name, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: decodeMessageCursor = %+v, %v, want %+v", test.name, got, err, test.want)
+		}
+	}
+}
+
+func TestMessageCursorSqlCondition(t *testing.T) {
+	tests := []struct {
+		name      string
+		cursor    *messageCursor
+		direction Message_Search_Direction
+		condition string
+		args      []interface{}
+	}{
+		{"time forward", timeCursor(100), Message_Search_Forward, " And CreateTime<=?", []interface{}{int64(100)}},
+		{"time backward", timeCursor(100), Message_Search_Backward, " And CreateTime>?", []interface{}{int64(100)}},
+		{"message forward", &messageCursor{sequence: 5, localId: 7}, Message_Search_Forward,
+			" And (Sequence<? OR (Sequence=? And localId<?))", []interface{}{int64(5), int64(5), 7}},
+		{"message backward", &messageCursor{sequence: 5, localId: 7}, Message_Search_Backward,
+			" And (Sequence>? OR (Sequence=? And localId>?))", []interface{}{int64(5), int64(5), 7}},
+		{"inclusive forward", &messageCursor{sequence: 5, localId: 7, inclusive: true}, Message_Search_Forward,
+			" And (Sequence<? OR (Sequence=? And localId<=?))", []interface{}{int64(5), int64(5), 7}},
+		{"inclusive backward", &messageCursor{sequence: 5, localId: 7, inclusive: true}, Message_Search_Backward,
+			" And (Sequence>? OR (Sequence=? And localId>?))", []interface{}{int64(5), int64(5), 7}},
+	}
+
+	for _, test := range tests {
+		condition, args := test.cursor.sqlCondition(test.direction)
+		if condition != test.condition || !reflect.DeepEqual(args, test.args) {
+			t.Errorf("%s: sqlCondition = %q %v, want %q %v", test.name, condition, args, test.condition, test.args)
+		}
+	}
+}
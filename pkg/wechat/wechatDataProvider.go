@@ -17,8 +17,6 @@ import (
 
 	"github.com/beevik/etree"
 	_ "github.com/mattn/go-sqlite3"
-	"github.com/pierrec/lz4"
-	"google.golang.org/protobuf/proto"
 )
 
 const (
@@ -32,6 +30,7 @@ const (
 	Wechat_Message_Type_Misc       = 49
 	Wechat_Message_Type_Voip       = 50
 	Wechat_Message_Type_System     = 10000
+	Wechat_Message_Type_SysMsg     = 10002
 )
 
 const (
@@ -152,39 +151,65 @@ type LocationInfo struct {
 	ThumbPath string
 }
 
+// WeChatMessage is a message as returned to the frontend, LocalTime is
+// CreateTime in the configured time zone.
 type WeChatMessage struct {
-	LocalId         int            `json:"LocalId"`
-	MsgSvrId        string         `json:"MsgSvrId"`
-	Type            int            `json:"type"`
-	SubType         int            `json:"SubType"`
-	IsSender        int            `json:"IsSender"`
-	CreateTime      int64          `json:"createTime"`
-	Talker          string         `json:"talker"`
-	Content         string         `json:"content"`
-	ThumbPath       string         `json:"ThumbPath"`
-	ImagePath       string         `json:"ImagePath"`
-	VideoPath       string         `json:"VideoPath"`
-	FileInfo        FileInfo       `json:"fileInfo"`
-	EmojiPath       string         `json:"EmojiPath"`
-	VoicePath       string         `json:"VoicePath"`
-	IsChatRoom      bool           `json:"isChatRoom"`
-	UserInfo        WeChatUserInfo `json:"userInfo"`
-	LinkInfo        LinkInfo       `json:"LinkInfo"`
-	ReferInfo       ReferInfo      `json:"ReferInfo"`
-	PayInfo         PayInfo        `json:"PayInfo"`
-	VoipInfo        VoipInfo       `json:"VoipInfo"`
-	VisitInfo       WeChatUserInfo `json:"VisitInfo"`
-	ChannelsInfo    ChannelsInfo   `json:"ChannelsInfo"`
-	MusicInfo       MusicInfo      `json:"MusicInfo"`
-	LocationInfo    LocationInfo   `json:"LocationInfo"`
+	LocalId         int               `json:"LocalId"`
+	MsgSvrId        string            `json:"MsgSvrId"`
+	Type            int               `json:"type"`
+	SubType         int               `json:"SubType"`
+	IsSender        int               `json:"IsSender"`
+	CreateTime      int64             `json:"createTime"`
+	LocalTime       string            `json:"LocalTime"`
+	Talker          string            `json:"talker"`
+	Content         string            `json:"content"`
+	ThumbPath       string            `json:"ThumbPath"`
+	ImagePath       string            `json:"ImagePath"`
+	VideoPath       string            `json:"VideoPath"`
+	FileInfo        FileInfo          `json:"fileInfo"`
+	EmojiPath       string            `json:"EmojiPath"`
+	VoicePath       string            `json:"VoicePath"`
+	IsChatRoom      bool              `json:"isChatRoom"`
+	UserInfo        WeChatUserInfo    `json:"userInfo"`
+	LinkInfo        LinkInfo          `json:"LinkInfo"`
+	ReferInfo       ReferInfo         `json:"ReferInfo"`
+	PayInfo         PayInfo           `json:"PayInfo"`
+	VoipInfo        VoipInfo          `json:"VoipInfo"`
+	VisitInfo       WeChatUserInfo    `json:"VisitInfo"`
+	ChannelsInfo    ChannelsInfo      `json:"ChannelsInfo"`
+	MusicInfo       MusicInfo         `json:"MusicInfo"`
+	LocationInfo    LocationInfo      `json:"LocationInfo"`
+	VoiceInfo       VoiceInfo         `json:"VoiceInfo"`
+	ForwardInfo     ForwardInfo       `json:"ForwardInfo"`
+	RedPacketInfo   RedPacketInfo     `json:"RedPacketInfo"`
+	NoticeInfo      NoticeInfo        `json:"NoticeInfo"`
+	AppletInfo      AppletInfo        `json:"AppletInfo"`
+	GameInfo        GameInfo          `json:"GameInfo"`
+	SystemInfo      SystemInfo        `json:"SystemInfo"`
+	SourceInfo      MessageSourceInfo `json:"SourceInfo"`
+	MediaInfo       MediaInfo         `json:"MediaInfo"`
+	Mentions        []WeChatUserInfo  `json:"Mentions"`
 	compressContent []byte
+	systemContent   string
 	bytesExtra      []byte
+	handled         int
+	shard           int
+	sequence        int64
 }
 
+// WeChatMessage.handled bits, handlers run by a filter are not run again.
+const (
+	msgHandledExtra = 1 << iota
+	msgHandledContent
+	msgHandledSystem
+)
+
 type WeChatMessageList struct {
-	KeyWord string          `json:"KeyWord"`
-	Total   int             `json:"Total"`
-	Rows    []WeChatMessage `json:"Rows"`
+	KeyWord    string          `json:"KeyWord"`
+	Total      int             `json:"Total"`
+	Rows       []WeChatMessage `json:"Rows"`
+	NextCursor string          `json:"NextCursor"`
+	PrevCursor string          `json:"PrevCursor"`
 }
 
 type WeChatMessageDate struct {
@@ -250,9 +275,39 @@ type WechatDataProvider struct {
 	microMsg      *sql.DB
 	openIMContact *sql.DB
 	userData      *sql.DB
+	sidecar       *sql.DB
+	searchIndex   *sql.DB
 	msgDBs        []*wechatMsgDB
-	userInfoMap   map[string]WeChatUserInfo
-	userInfoMtx   sync.Mutex
+	shardIndex    map[string][]wechatTalkerShard
+	mediaMsgDBs   []*sql.DB
+	mediaMsgOnce  sync.Once
+	emotionCache  wechatEmotionCache
+	headImgCache  wechatHeadImgCache
+	assetCache    *AssetCache
+	stmtCache     wechatStmtCache
+
+	recordMediaCache    sync.Map
+	chatRoomNameCache   sync.Map
+	chatRoomMemberCache sync.Map
+	redPacketCache      sync.Map
+
+	// voices without info in Sidecar.db, see wechatMessageVoiceInfo
+	voiceInfoMiss  sync.Map
+	voiceInfoOnce  sync.Once
+	voiceInfoQueue chan int64
+
+	chatReportOnce  sync.Once
+	chatReportReady bool
+
+	referIndex wechatReferIndex
+
+	searchBuilding int32
+	quit           chan struct{}
+	closing        bool
+	bgMtx          sync.Mutex
+	bgWg           sync.WaitGroup
+	userInfoMap    map[string]WeChatUserInfo
+	userInfoMtx    sync.Mutex
 
 	SelfInfo    *WeChatUserInfo
 	ContactList *WeChatContactList
@@ -263,8 +318,11 @@ const (
 	MicroMsgDB      = "MicroMsg.db"
 	OpenIMContactDB = "OpenIMContact.db"
 	UserDataDB      = "UserData.db"
+	SidecarDB       = "Sidecar.db"
 )
 
+const copyChunkSize = 100
+
 type byTime []*wechatMsgDB
 
 func (a byTime) Len() int           { return len(a) }
@@ -297,6 +355,7 @@ func CreateWechatDataProvider(resPath string, prefixRes string) (*WechatDataProv
 	provider.resPath = resPath
 	provider.prefixResPath = prefixRes
 	provider.msgDBs = make([]*wechatMsgDB, 0)
+	provider.quit = make(chan struct{})
 	log.Println(resPath)
 
 	userName := filepath.Base(resPath)
@@ -327,6 +386,19 @@ func CreateWechatDataProvider(resPath string, prefixRes string) (*WechatDataProv
 		return provider, err
 	}
 
+	SidecarDBPath := resPath + "\\Msg\\" + SidecarDB
+	provider.sidecar = openSidecarDB(SidecarDBPath)
+	if provider.sidecar == nil {
+		log.Printf("open db %s failed", SidecarDBPath)
+	}
+	provider.assetCache = NewAssetCache(resPath, prefixRes, NewHTTPFetcher())
+
+	SearchIndexDBPath := resPath + "\\Msg\\" + SearchIndexDB
+	provider.searchIndex = openSearchIndexDB(SearchIndexDBPath)
+	if provider.searchIndex == nil {
+		log.Printf("open db %s failed", SearchIndexDBPath)
+	}
+
 	msgDBPath := fmt.Sprintf("%s\\Msg\\Multi\\MSG.db", provider.resPath)
 	if _, err := os.Stat(msgDBPath); err == nil {
 		log.Println("msgDBPath", msgDBPath)
@@ -362,6 +434,7 @@ func CreateWechatDataProvider(resPath string, prefixRes string) (*WechatDataProv
 	for _, db := range provider.msgDBs {
 		log.Printf("%s start %d - %d end\n", db.path, db.startTime, db.endTime)
 	}
+	provider.wechatBuildShardIndex()
 	provider.userInfoMap = make(map[string]WeChatUserInfo)
 	provider.microMsg = microMsg
 	provider.openIMContact = openIMContact
@@ -385,6 +458,16 @@ func CreateWechatDataProvider(resPath string, prefixRes string) (*WechatDataProv
 }
 
 func (P *WechatDataProvider) WechatWechatDataProviderClose() {
+	P.bgMtx.Lock()
+	if !P.closing {
+		P.closing = true
+		close(P.quit)
+	}
+	P.bgMtx.Unlock()
+	P.bgWg.Wait()
+
+	P.stmtCache.closeAll()
+
 	if P.microMsg != nil {
 		err := P.microMsg.Close()
 		if err != nil {
@@ -406,22 +489,56 @@ func (P *WechatDataProvider) WechatWechatDataProviderClose() {
 		}
 	}
 
+	if P.sidecar != nil {
+		err := P.sidecar.Close()
+		if err != nil {
+			log.Println("db close:", err)
+		}
+	}
+
+	if P.searchIndex != nil {
+		err := P.searchIndex.Close()
+		if err != nil {
+			log.Println("db close:", err)
+		}
+	}
+
 	for _, db := range P.msgDBs {
 		err := db.db.Close()
 		if err != nil {
 			log.Println("db close:", err)
 		}
 	}
+
+	for _, db := range P.mediaMsgDBs {
+		err := db.Close()
+		if err != nil {
+			log.Println("db close:", err)
+		}
+	}
 	log.Println("WechatWechatDataProviderClose:", P.resPath)
 }
 
+// wechatBackgroundStart registers a background job on bgWg, it fails once
+// the provider is closing.
+func (P *WechatDataProvider) wechatBackgroundStart() bool {
+	P.bgMtx.Lock()
+	defer P.bgMtx.Unlock()
+	if P.closing {
+		return false
+	}
+	P.bgWg.Add(1)
+
+	return true
+}
+
 func (P *WechatDataProvider) WechatGetUserInfoByName(name string) (*WeChatUserInfo, error) {
 	info := &WeChatUserInfo{}
 
 	var UserName, Alias, ReMark, NickName string
-	querySql := fmt.Sprintf("select ifnull(UserName,'') as UserName, ifnull(Alias,'') as Alias, ifnull(ReMark,'') as ReMark, ifnull(NickName,'') as NickName from Contact where UserName='%s';", name)
+	querySql := "select ifnull(UserName,'') as UserName, ifnull(Alias,'') as Alias, ifnull(ReMark,'') as ReMark, ifnull(NickName,'') as NickName from Contact where UserName=?;"
 	// log.Println(querySql)
-	err := P.microMsg.QueryRow(querySql).Scan(&UserName, &Alias, &ReMark, &NickName)
+	err := P.wechatQueryRow(P.microMsg, querySql, name).Scan(&UserName, &Alias, &ReMark, &NickName)
 	if err != nil {
 		// log.Println("not found User:", err)
 		return info, err
@@ -430,9 +547,9 @@ func (P *WechatDataProvider) WechatGetUserInfoByName(name string) (*WeChatUserIn
 	// log.Printf("UserName %s, Alias %s, ReMark %s, NickName %s\n", UserName, Alias, ReMark, NickName)
 
 	var smallHeadImgUrl, bigHeadImgUrl string
-	querySql = fmt.Sprintf("select ifnull(smallHeadImgUrl,'') as smallHeadImgUrl, ifnull(bigHeadImgUrl,'') as bigHeadImgUrl from ContactHeadImgUrl where usrName='%s';", UserName)
+	querySql = "select ifnull(smallHeadImgUrl,'') as smallHeadImgUrl, ifnull(bigHeadImgUrl,'') as bigHeadImgUrl from ContactHeadImgUrl where usrName=?;"
 	// log.Println(querySql)
-	err = P.microMsg.QueryRow(querySql).Scan(&smallHeadImgUrl, &bigHeadImgUrl)
+	err = P.wechatQueryRow(P.microMsg, querySql, UserName).Scan(&smallHeadImgUrl, &bigHeadImgUrl)
 	if err != nil {
 		log.Println("not find headimg", err)
 	}
@@ -445,11 +562,7 @@ func (P *WechatDataProvider) WechatGetUserInfoByName(name string) (*WeChatUserIn
 	info.BigHeadImgUrl = bigHeadImgUrl
 	info.IsGroup = strings.HasSuffix(UserName, "@chatroom")
 
-	localHeadImgPath := fmt.Sprintf("%s\\FileStorage\\HeadImage\\%s.headimg", P.resPath, name)
-	relativePath := fmt.Sprintf("%s\\FileStorage\\HeadImage\\%s.headimg", P.prefixResPath, name)
-	if _, err = os.Stat(localHeadImgPath); err == nil {
-		info.LocalHeadImgUrl = relativePath
-	}
+	info.LocalHeadImgUrl = P.wechatGetLocalHeadImg(name, bigHeadImgUrl, smallHeadImgUrl)
 	// log.Println(info)
 	return info, nil
 }
@@ -458,10 +571,10 @@ func (P *WechatDataProvider) WechatGetOpenIMMUserInfoByName(name string) (*WeCha
 	info := &WeChatUserInfo{}
 
 	var UserName, ReMark, NickName string
-	querySql := fmt.Sprintf("select ifnull(UserName,'') as UserName, ifnull(ReMark,'') as ReMark, ifnull(NickName,'') as NickName from OpenIMContact where UserName='%s';", name)
+	querySql := "select ifnull(UserName,'') as UserName, ifnull(ReMark,'') as ReMark, ifnull(NickName,'') as NickName from OpenIMContact where UserName=?;"
 	// log.Println(querySql)
 	if P.openIMContact != nil {
-		err := P.openIMContact.QueryRow(querySql).Scan(&UserName, &ReMark, &NickName)
+		err := P.wechatQueryRow(P.openIMContact, querySql, name).Scan(&UserName, &ReMark, &NickName)
 		if err != nil {
 			log.Println("not found User:", err)
 			return info, err
@@ -471,9 +584,9 @@ func (P *WechatDataProvider) WechatGetOpenIMMUserInfoByName(name string) (*WeCha
 	log.Printf("UserName %s, ReMark %s, NickName %s\n", UserName, ReMark, NickName)
 
 	var smallHeadImgUrl, bigHeadImgUrl string
-	querySql = fmt.Sprintf("select ifnull(smallHeadImgUrl,'') as smallHeadImgUrl, ifnull(bigHeadImgUrl,'') as bigHeadImgUrl from ContactHeadImgUrl where usrName='%s';", UserName)
+	querySql = "select ifnull(smallHeadImgUrl,'') as smallHeadImgUrl, ifnull(bigHeadImgUrl,'') as bigHeadImgUrl from ContactHeadImgUrl where usrName=?;"
 	// log.Println(querySql)
-	err := P.microMsg.QueryRow(querySql).Scan(&smallHeadImgUrl, &bigHeadImgUrl)
+	err := P.wechatQueryRow(P.microMsg, querySql, UserName).Scan(&smallHeadImgUrl, &bigHeadImgUrl)
 	if err != nil {
 		log.Println("not find headimg", err)
 	}
@@ -486,11 +599,7 @@ func (P *WechatDataProvider) WechatGetOpenIMMUserInfoByName(name string) (*WeCha
 	info.BigHeadImgUrl = bigHeadImgUrl
 	info.IsGroup = strings.HasSuffix(UserName, "@chatroom")
 
-	localHeadImgPath := fmt.Sprintf("%s\\FileStorage\\HeadImage\\%s.headimg", P.resPath, name)
-	relativePath := fmt.Sprintf("%s\\FileStorage\\HeadImage\\%s.headimg", P.prefixResPath, name)
-	if _, err = os.Stat(localHeadImgPath); err == nil {
-		info.LocalHeadImgUrl = relativePath
-	}
+	info.LocalHeadImgUrl = P.wechatGetLocalHeadImg(name, bigHeadImgUrl, smallHeadImgUrl)
 	// log.Println(info)
 	return info, nil
 }
@@ -499,8 +608,8 @@ func (P *WechatDataProvider) WeChatGetSessionList(pageIndex int, pageSize int) (
 	List := &WeChatSessionList{}
 	List.Rows = make([]WeChatSession, 0)
 
-	querySql := fmt.Sprintf("select ifnull(strUsrName,'') as strUsrName,ifnull(strNickName,'') as strNickName,ifnull(strContent,'') as strContent, nMsgType, nTime from Session order by nOrder desc limit %d, %d;", pageIndex*pageSize, pageSize)
-	dbRows, err := P.microMsg.Query(querySql)
+	querySql := "select ifnull(strUsrName,'') as strUsrName,ifnull(strNickName,'') as strNickName,ifnull(strContent,'') as strContent, nMsgType, nTime from Session order by nOrder desc limit ?, ?;"
+	dbRows, err := P.wechatQuery(P.microMsg, querySql, pageIndex*pageSize, pageSize)
 	if err != nil {
 		log.Println(err)
 		return List, err
@@ -564,96 +673,203 @@ func (P *WechatDataProvider) WeChatGetContactList(pageIndex int, pageSize int) (
 }
 
 func (P *WechatDataProvider) WeChatGetMessageListByTime(userName string, time int64, pageSize int, direction Message_Search_Direction) (*WeChatMessageList, error) {
+	return P.wechatGetMessageList(userName, timeCursor(time), pageSize, direction, nil)
+}
+
+// WeChatGetMessageListByCursor pages through the messages of userName from
+// a NextCursor (Forward) or PrevCursor (Backward) of a previous list.
+func (P *WechatDataProvider) WeChatGetMessageListByCursor(userName string, cursor string, pageSize int, direction Message_Search_Direction, filter *MessageFilter) (*WeChatMessageList, error) {
+	c, err := P.decodeMessageCursor(cursor, direction)
+	if err != nil {
+		log.Println("decodeMessageCursor failed:", err)
+		return nil, err
+	}
 
+	List, err := P.wechatGetMessageList(userName, c, pageSize, direction, filter)
+	if err != nil {
+		return List, err
+	}
+	if filter != nil {
+		List.KeyWord = filter.KeyWord
+	}
+
+	return List, nil
+}
+
+// wechatGetMessageList returns up to pageSize messages of userName next to
+// cursor, newest first. Forward goes to the older messages, Backward to the
+// newer ones and Both takes pageSize/2 of each.
+func (P *WechatDataProvider) wechatGetMessageList(userName string, cursor *messageCursor, pageSize int, direction Message_Search_Direction, filter *MessageFilter) (*WeChatMessageList, error) {
 	List := &WeChatMessageList{}
 	List.Rows = make([]WeChatMessage, 0)
-	selectTime := time
-	selectpageSize := pageSize
+	List.NextCursor = P.encodeMessageCursor(cursor)
+	List.PrevCursor = List.NextCursor
 
-	if direction == Message_Search_Both {
-		selectpageSize = pageSize / 2
+	forwardSize, backwardSize := pageSize, 0
+	if direction == Message_Search_Backward {
+		forwardSize, backwardSize = 0, pageSize
+	} else if direction == Message_Search_Both {
+		forwardSize, backwardSize = pageSize/2, pageSize/2
 	}
-	for direction == Message_Search_Forward || direction == Message_Search_Both {
-		selectList, err := P.weChatGetMessageListByTime(userName, selectTime, selectpageSize, Message_Search_Forward)
+
+	if backwardSize > 0 {
+		rows, last, err := P.wechatScanMessageList(userName, cursor, backwardSize, Message_Search_Backward, filter)
 		if err != nil {
 			return List, err
 		}
-
-		if selectList.Total == 0 {
-			break
-		}
-
-		selectTime = selectList.Rows[selectList.Total-1].CreateTime - 1
-		selectpageSize -= selectList.Total
-		List.Total += selectList.Total
-		List.Rows = append(List.Rows, selectList.Rows...)
-		if selectpageSize <= 0 {
-			break
+		for i := len(rows) - 1; i >= 0; i-- {
+			List.Rows = append(List.Rows, rows[i])
 		}
-		log.Printf("Forward selectTime %d, selectpageSize %d\n", selectTime, selectpageSize)
+		List.PrevCursor = P.encodeMessageCursor(last)
 	}
 
-	selectTime = time
-	if direction == Message_Search_Both {
-		selectpageSize = pageSize / 2
-	}
-	for direction == Message_Search_Backward || direction == Message_Search_Both {
-		selectList, err := P.weChatGetMessageListByTime(userName, selectTime, selectpageSize, Message_Search_Backward)
+	if forwardSize > 0 {
+		rows, last, err := P.wechatScanMessageList(userName, cursor, forwardSize, Message_Search_Forward, filter)
 		if err != nil {
 			return List, err
 		}
+		List.Rows = append(List.Rows, rows...)
+		List.NextCursor = P.encodeMessageCursor(last)
+	}
 
-		if selectList.Total == 0 {
-			break
+	List.Total = len(List.Rows)
+	if List.Total > 0 {
+		if backwardSize == 0 {
+			List.PrevCursor = P.encodeMessageCursor(messageCursorOf(&List.Rows[0]))
 		}
-
-		selectTime = selectList.Rows[0].CreateTime + 1
-		selectpageSize -= selectList.Total
-		List.Total += selectList.Total
-		List.Rows = append(selectList.Rows, List.Rows...)
-		if selectpageSize <= 0 {
-			break
+		if forwardSize == 0 {
+			List.NextCursor = P.encodeMessageCursor(messageCursorOf(&List.Rows[List.Total-1]))
 		}
-		log.Printf("Backward selectTime %d, selectpageSize %d\n", selectTime, selectpageSize)
 	}
 
 	return List, nil
 }
 
-func (P *WechatDataProvider) weChatGetMessageListByTime(userName string, time int64, pageSize int, direction Message_Search_Direction) (*WeChatMessageList, error) {
-	List := &WeChatMessageList{}
-	List.Rows = make([]WeChatMessage, 0)
-	index := P.wechatFindDBIndex(userName, time, direction)
-	if index == -1 {
-		log.Printf("Not found %s %d data\n", userName, time)
-		return List, nil
+// wechatScanMessageList walks the shards from cursor in direction and
+// returns up to pageSize matching messages in scan order, with the position
+// to go on from: the last returned message when the page is full, else the
+// last scanned one. Messages are ordered by (Sequence, localId) inside a
+// shard and by shard order across shards, so pages never overlap or leave
+// a gap.
+func (P *WechatDataProvider) wechatScanMessageList(userName string, cursor *messageCursor, pageSize int, direction Message_Search_Direction, filter *MessageFilter) ([]WeChatMessage, *messageCursor, error) {
+	rows := make([]WeChatMessage, 0)
+	last := cursor
+	if pageSize <= 0 {
+		return rows, last, nil
+	}
+
+	condition, conditionArgs := filter.sqlCondition(userName, P.SelfInfo.UserName)
+	startTime, endTime := filter.timeRange()
+	batchSize := pageSize
+	if filter.needMatch() {
+		batchSize = max(pageSize, 30)
+	}
+
+	// a time cursor bounds every shard, a message cursor only its own
+	var bound string
+	var boundArgs []interface{}
+	if cursor.isTime() {
+		bound, boundArgs = cursor.sqlCondition(direction)
+	}
+
+	index, step := 0, 1
+	if direction == Message_Search_Backward {
+		index, step = len(P.msgDBs)-1, -1
+	}
+	if !cursor.isTime() {
+		index = cursor.shard
+	}
+
+	for ; index >= 0 && index < len(P.msgDBs); index += step {
+		info := P.wechatTalkerShard(userName, index)
+		if info == nil {
+			continue
+		}
+		if cursor.isTime() {
+			if (direction == Message_Search_Forward && info.minTime > cursor.time) ||
+				(direction == Message_Search_Backward && info.maxTime <= cursor.time) {
+				continue
+			}
+		}
+		if (startTime > 0 && info.maxTime < startTime) || (endTime > 0 && info.minTime > endTime) {
+			continue
+		}
+
+		var position string
+		var positionArgs []interface{}
+		if !cursor.isTime() && index == cursor.shard {
+			position, positionArgs = cursor.sqlCondition(direction)
+		}
+
+		for {
+			args := append(append(append([]interface{}{}, boundArgs...), positionArgs...), conditionArgs...)
+			batch, err := P.wechatQueryMessageList(index, userName, batchSize, direction, bound+position+condition, args)
+			if err != nil {
+				return rows, last, err
+			}
+
+			for i := range batch {
+				msg := &batch[i]
+				last = messageCursorOf(msg)
+				if !P.wechatMessageFilterMatch(msg, filter) {
+					continue
+				}
+				P.wechatMessageHandle(msg)
+				rows = append(rows, *msg)
+				if len(rows) >= pageSize {
+					return rows, last, nil
+				}
+			}
+
+			if len(batch) < batchSize {
+				break
+			}
+			position, positionArgs = last.sqlCondition(direction)
+		}
 	}
 
-	sqlFormat := "select localId,MsgSvrID,Type,SubType,IsSender,CreateTime,ifnull(StrTalker,'') as StrTalker, ifnull(StrContent,'') as StrContent,ifnull(CompressContent,'') as CompressContent,ifnull(BytesExtra,'') as BytesExtra from MSG Where StrTalker='%s' And CreateTime<=%d order by Sequence desc limit %d;"
+	return rows, last, nil
+}
+
+// wechatQueryMessageList returns up to limit raw messages of userName, or of
+// all sessions when userName is empty, in the shard index, in scan order of
+// direction. Callers run wechatMessageHandle on the messages they keep.
+func (P *WechatDataProvider) wechatQueryMessageList(index int, userName string, limit int, direction Message_Search_Direction, condition string, conditionArgs []interface{}) ([]WeChatMessage, error) {
+	order := " order by Sequence desc, localId desc limit ?;"
 	if direction == Message_Search_Backward {
-		sqlFormat = "select localId,MsgSvrID,Type,SubType,IsSender,CreateTime,ifnull(StrTalker,'') as StrTalker, ifnull(StrContent,'') as StrContent,ifnull(CompressContent,'') as CompressContent,ifnull(BytesExtra,'') as BytesExtra from ( select localId, MsgSvrID, Type, SubType, IsSender, CreateTime, Sequence, StrTalker, StrContent, CompressContent, BytesExtra FROM MSG Where StrTalker='%s' And CreateTime>%d order by Sequence asc limit %d) AS SubQuery order by Sequence desc;"
+		order = " order by Sequence asc, localId asc limit ?;"
+	}
+	querySql := "select localId,MsgSvrID,Type,SubType,IsSender,CreateTime,Sequence,ifnull(StrTalker,'') as StrTalker, ifnull(StrContent,'') as StrContent,ifnull(CompressContent,'') as CompressContent,ifnull(BytesExtra,'') as BytesExtra from MSG Where "
+	args := make([]interface{}, 0, len(conditionArgs)+2)
+	if len(userName) > 0 {
+		querySql += "StrTalker=?"
+		args = append(args, userName)
+	} else {
+		querySql += "1=1"
 	}
-	querySql := fmt.Sprintf(sqlFormat, userName, time, pageSize)
-	log.Println(querySql)
+	querySql += condition + order
 
-	rows, err := P.msgDBs[index].db.Query(querySql)
+	args = append(args, conditionArgs...)
+	args = append(args, limit)
+	rows, err := P.wechatQuery(P.msgDBs[index].db, querySql, args...)
 	if err != nil {
 		log.Printf("%s failed %v\n", querySql, err)
-		return List, nil
+		return nil, err
 	}
 	defer rows.Close()
 	var localId, Type, SubType, IsSender int
-	var MsgSvrID, CreateTime int64
+	var MsgSvrID, CreateTime, Sequence int64
 	var StrTalker, StrContent string
 	var CompressContent, BytesExtra []byte
 
+	messages := make([]WeChatMessage, 0)
 	for rows.Next() {
 		message := WeChatMessage{}
-		err = rows.Scan(&localId, &MsgSvrID, &Type, &SubType, &IsSender, &CreateTime,
+		err = rows.Scan(&localId, &MsgSvrID, &Type, &SubType, &IsSender, &CreateTime, &Sequence,
 			&StrTalker, &StrContent, &CompressContent, &BytesExtra)
 		if err != nil {
 			log.Println("rows.Scan failed", err)
-			return List, err
+			return nil, err
 		}
 
 		message.LocalId = localId
@@ -664,200 +880,172 @@ func (P *WechatDataProvider) weChatGetMessageListByTime(userName string, time in
 		message.CreateTime = CreateTime
 		message.Talker = StrTalker
 		message.Content = systemMsgParse(Type, StrContent)
+		if isSystemMessage(Type) {
+			message.systemContent = StrContent
+		}
 		message.IsChatRoom = strings.HasSuffix(StrTalker, "@chatroom")
 		message.compressContent = make([]byte, len(CompressContent))
 		message.bytesExtra = make([]byte, len(BytesExtra))
 		copy(message.compressContent, CompressContent)
 		copy(message.bytesExtra, BytesExtra)
-		P.wechatMessageExtraHandle(&message)
-		P.wechatMessageGetUserInfo(&message)
-		P.wechatMessageEmojiHandle(&message)
-		P.wechatMessageCompressContentHandle(&message)
-		P.wechatMessageVoipHandle(&message)
-		P.wechatMessageVisitHandke(&message)
-		P.wechatMessageLocationHandke(&message)
-		List.Rows = append(List.Rows, message)
-		List.Total += 1
+		message.shard = index
+		message.sequence = Sequence
+		messages = append(messages, message)
 	}
 
 	if err := rows.Err(); err != nil {
 		log.Println("rows.Scan failed", err)
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+func (P *WechatDataProvider) WeChatGetMessageListByKeyWord(userName string, time int64, filter *MessageFilter, pageSize int) (*WeChatMessageList, error) {
+	if filter == nil {
+		filter = &MessageFilter{}
+	}
+
+	List, err := P.wechatGetMessageList(userName, timeCursor(time), pageSize, Message_Search_Forward, filter)
+	if err != nil {
 		return List, err
 	}
+	List.KeyWord = filter.KeyWord
+	if List.Total == 0 {
+		log.Printf("user %s not find [%s]\n", userName, filter.KeyWord)
+	}
 
 	return List, nil
 }
 
-func (P *WechatDataProvider) WeChatGetMessageListByKeyWord(userName string, time int64, keyWord string, msgType string, pageSize int) (*WeChatMessageList, error) {
-	List := &WeChatMessageList{}
-	List.Rows = make([]WeChatMessage, 0)
-	List.KeyWord = keyWord
-	_time := time
-	selectPagesize := pageSize
-	if keyWord != "" || msgType != "" {
-		selectPagesize = 600
+func (P *WechatDataProvider) WeChatGetMessageListByType(userName string, time int64, pageSize int, filter *MessageFilter, direction Message_Search_Direction) (*WeChatMessageList, error) {
+	return P.wechatGetMessageList(userName, timeCursor(time), pageSize, direction, filter)
+}
+
+// wechatFindMessageByServerId returns the raw message svrId, only the
+// shards of userName are searched when it is given.
+func (P *WechatDataProvider) wechatFindMessageByServerId(userName string, svrId string) (*WeChatMessage, error) {
+	id, err := strconv.ParseInt(svrId, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MsgSvrID %s: %v", svrId, err)
 	}
-	for {
-		log.Println("time:", _time, keyWord)
-		rawList, err := P.weChatGetMessageListByTime(userName, _time, selectPagesize, Message_Search_Forward)
-		if err != nil {
-			log.Println("weChatGetMessageListByTime failed: ", err)
-			return nil, err
-		}
-		log.Println("rawList.Total:", rawList.Total)
-		if rawList.Total == 0 {
-			if List.Total == 0 {
-				log.Printf("user %s not find [%s]\n", userName, keyWord)
-			}
-			break
-		}
 
-		for i, _ := range rawList.Rows {
-			if weChatMessageTypeFilter(&rawList.Rows[i], msgType) && (len(keyWord) == 0 || weChatMessageContains(&rawList.Rows[i], keyWord)) {
-				List.Rows = append(List.Rows, rawList.Rows[i])
-				List.Total += 1
-				if List.Total >= pageSize {
-					return List, nil
+	for index, msgDB := range P.msgDBs {
+		talker := userName
+		if len(talker) > 0 {
+			if P.wechatTalkerShard(talker, index) == nil {
+				continue
+			}
+		} else {
+			err := P.wechatQueryRow(msgDB.db, "select ifnull(StrTalker,'') from MSG where MsgSvrID=? limit 1;", id).Scan(&talker)
+			if err != nil {
+				if err != sql.ErrNoRows {
+					log.Println("select MsgSvrID failed:", msgDB.path, err)
 				}
+				continue
 			}
 		}
 
-		_time = rawList.Rows[rawList.Total-1].CreateTime - 1
+		rows, err := P.wechatQueryMessageList(index, talker, 1, Message_Search_Forward, " And MsgSvrID=?", []interface{}{id})
+		if err != nil {
+			return nil, err
+		}
+		if len(rows) > 0 {
+			return &rows[0], nil
+		}
 	}
 
-	return List, nil
+	return nil, fmt.Errorf("message %s not found", svrId)
 }
 
-func (P *WechatDataProvider) WeChatGetMessageListByType(userName string, time int64, pageSize int, msgType string, direction Message_Search_Direction) (*WeChatMessageList, error) {
-
-	List := &WeChatMessageList{}
-	List.Rows = make([]WeChatMessage, 0)
-	selectTime := time
-	selectpageSize := 30
-	needSize := pageSize
-
-	if msgType != "" {
-		selectpageSize = 600
-	}
-	if direction == Message_Search_Both {
-		needSize = pageSize / 2
+// WeChatGetMessageByServerId returns the message svrId, e.g. the one quoted
+// by ReferInfo.Svrid. userName may be empty when the session is unknown.
+func (P *WechatDataProvider) WeChatGetMessageByServerId(userName string, svrId string) (*WeChatMessage, error) {
+	msg, err := P.wechatFindMessageByServerId(userName, svrId)
+	if err != nil {
+		log.Println("wechatFindMessageByServerId failed:", err)
+		return nil, err
 	}
-	for direction == Message_Search_Forward || direction == Message_Search_Both {
-		selectList, err := P.weChatGetMessageListByTime(userName, selectTime, selectpageSize, Message_Search_Forward)
-		if err != nil {
-			return List, err
-		}
+	P.wechatMessageHandle(msg)
 
-		if selectList.Total == 0 {
-			break
-		}
+	return msg, nil
+}
 
-		for i, _ := range selectList.Rows {
-			if weChatMessageTypeFilter(&selectList.Rows[i], msgType) {
-				List.Rows = append(List.Rows, selectList.Rows[i])
-				List.Total += 1
-				needSize -= 1
-				if needSize <= 0 {
-					break
-				}
-			}
-		}
-		if needSize <= 0 {
-			break
-		}
-		selectTime = selectList.Rows[selectList.Total-1].CreateTime - 1
-		log.Printf("Forward selectTime %d, selectpageSize %d needSize %d\n", selectTime, selectpageSize, needSize)
+// WeChatGetMessageContext returns the message svrId of userName with up to
+// before older and after newer messages around it, newest first. The
+// cursors of the list page on from both ends.
+func (P *WechatDataProvider) WeChatGetMessageContext(userName string, svrId string, before int, after int) (*WeChatMessageList, error) {
+	msg, err := P.wechatFindMessageByServerId(userName, svrId)
+	if err != nil {
+		log.Println("wechatFindMessageByServerId failed:", err)
+		return nil, err
 	}
+	cursor := messageCursorOf(msg)
+	P.wechatMessageHandle(msg)
 
-	selectTime = time
-	if direction == Message_Search_Both {
-		needSize = pageSize / 2
+	newer, last, err := P.wechatScanMessageList(msg.Talker, cursor, after, Message_Search_Backward, nil)
+	if err != nil {
+		return nil, err
 	}
-	for direction == Message_Search_Backward || direction == Message_Search_Both {
-		selectList, err := P.weChatGetMessageListByTime(userName, selectTime, selectpageSize, Message_Search_Backward)
-		if err != nil {
-			return List, err
-		}
 
-		if selectList.Total == 0 {
-			break
-		}
+	List := &WeChatMessageList{}
+	List.Rows = make([]WeChatMessage, 0, len(newer)+1+before)
+	for i := len(newer) - 1; i >= 0; i-- {
+		List.Rows = append(List.Rows, newer[i])
+	}
+	List.Rows = append(List.Rows, *msg)
+	List.PrevCursor = P.encodeMessageCursor(last)
 
-		tmpTotal := 0
-		tmpRows := make([]WeChatMessage, 0)
-		for i := selectList.Total - 1; i >= 0; i-- {
-			if weChatMessageTypeFilter(&selectList.Rows[i], msgType) {
-				tmpRows = append([]WeChatMessage{selectList.Rows[i]}, tmpRows...)
-				tmpTotal += 1
-				needSize -= 1
-				if needSize <= 0 {
-					break
-				}
-			}
-		}
-		if tmpTotal > 0 {
-			List.Rows = append(tmpRows, List.Rows...)
-			List.Total += tmpTotal
-		}
-		selectTime = selectList.Rows[0].CreateTime + 1
-		if needSize <= 0 {
-			break
-		}
-		log.Printf("Backward selectTime %d, selectpageSize %d needSize %d\n", selectTime, selectpageSize, needSize)
+	older, last, err := P.wechatScanMessageList(msg.Talker, cursor, before, Message_Search_Forward, nil)
+	if err != nil {
+		return nil, err
 	}
+	List.Rows = append(List.Rows, older...)
+	List.NextCursor = P.encodeMessageCursor(last)
+	List.Total = len(List.Rows)
 
 	return List, nil
 }
 
+// WeChatGetMessageDate returns the dates userName has messages on, only the
+// shards holding userName are read.
 func (P *WechatDataProvider) WeChatGetMessageDate(userName string) (*WeChatMessageDate, error) {
 	messageData := &WeChatMessageDate{}
 	messageData.Date = make([]string, 0)
 	messageData.Total = 0
 
-	_time := time.Now().Unix()
-
-	for {
-		index := P.wechatFindDBIndex(userName, _time, Message_Search_Forward)
-		if index == -1 {
-			log.Println("wechat find db end")
-			return messageData, nil
-		}
-
-		sqlFormat := " SELECT DISTINCT strftime('%%Y-%%m-%%d', datetime(CreateTime+28800, 'unixepoch')) FROM MSG WHERE StrTalker='%s' order by CreateTime desc;"
-		querySql := fmt.Sprintf(sqlFormat, userName)
-
-		rows, err := P.msgDBs[index].db.Query(querySql)
-		if err != nil {
-			log.Printf("%s failed %v\n", querySql, err)
-			return messageData, nil
-		}
-		defer rows.Close()
-
-		var date string
-		for rows.Next() {
-			err = rows.Scan(&date)
+	// dates are made in Go, in the configured time zone
+	querySql := " SELECT DISTINCT CreateTime/? FROM MSG WHERE StrTalker=?;"
+	buckets := make([]int64, 0)
+	for _, info := range P.shardIndex[userName] {
+		err := func() error {
+			rows, err := P.wechatQuery(P.msgDBs[info.index].db, querySql, timeBucket, userName)
 			if err != nil {
-				log.Println("rows.Scan failed", err)
-				return messageData, err
+				log.Printf("%s failed %v\n", querySql, err)
+				return err
 			}
+			defer rows.Close()
 
-			messageData.Date = append(messageData.Date, date)
-			messageData.Total += 1
-		}
+			var bucket int64
+			for rows.Next() {
+				if err := rows.Scan(&bucket); err != nil {
+					log.Println("rows.Scan failed", err)
+					return err
+				}
+				buckets = append(buckets, bucket)
+			}
 
-		if err := rows.Err(); err != nil {
-			log.Println("rows.Scan failed", err)
+			return rows.Err()
+		}()
+		if err != nil {
 			return messageData, err
 		}
+	}
 
-		_time = P.wechatGetLastMessageCreateTime(userName, index)
-		if -1 == _time {
-			log.Println("wechatGetLastMessageCreateTime failed")
-			return messageData, errors.New("wechatGetLastMessageCreateTime failed")
-		}
+	messageData.Date = bucketsToDates(buckets)
+	messageData.Total = len(messageData.Date)
 
-		_time -= 1
-	}
+	return messageData, nil
 }
 
 func (P *WechatDataProvider) WeChatGetChatRoomUserList(chatroom string) (*WeChatUserList, error) {
@@ -865,11 +1053,10 @@ func (P *WechatDataProvider) WeChatGetChatRoomUserList(chatroom string) (*WeChat
 	userList.Users = make([]WeChatUserInfo, 0)
 	userList.Total = 0
 
-	sqlFormat := "select UserNameList from ChatRoom where ChatRoomName='%s';"
-	querySql := fmt.Sprintf(sqlFormat, chatroom)
+	querySql := "select UserNameList from ChatRoom where ChatRoomName=?;"
 
 	var userNameListStr string
-	err := P.microMsg.QueryRow(querySql).Scan(&userNameListStr)
+	err := P.wechatQueryRow(P.microMsg, querySql, chatroom).Scan(&userNameListStr)
 	if err != nil {
 		log.Println("Scan: ", err)
 		return nil, err
@@ -889,53 +1076,248 @@ func (P *WechatDataProvider) WeChatGetChatRoomUserList(chatroom string) (*WeChat
 	return userList, nil
 }
 
+// wechatChatRoomDisplayNames maps the members of chatroom to the name they
+// set in the group, members without one are left out. DisplayNameList is
+// parallel to UserNameList, the lists are read once per chat room.
+func (P *WechatDataProvider) wechatChatRoomDisplayNames(chatroom string) map[string]string {
+	if names, ok := P.chatRoomMemberCache.Load(chatroom); ok {
+		return names.(map[string]string)
+	}
+
+	names := make(map[string]string)
+	querySql := "select ifnull(UserNameList,''), ifnull(DisplayNameList,'') from ChatRoom where ChatRoomName=?;"
+	var userNameListStr, displayNameListStr string
+	err := P.wechatQueryRow(P.microMsg, querySql, chatroom).Scan(&userNameListStr, &displayNameListStr)
+	if err != nil {
+		log.Println("select ChatRoom failed:", chatroom, err)
+	} else {
+		userNameArray := strings.Split(userNameListStr, "^G")
+		displayNameArray := strings.Split(displayNameListStr, "^G")
+		for i, userName := range userNameArray {
+			if i < len(displayNameArray) && len(userName) > 0 && len(displayNameArray[i]) > 0 {
+				names[userName] = displayNameArray[i]
+			}
+		}
+	}
+	P.chatRoomMemberCache.Store(chatroom, names)
+
+	return names
+}
+
 func (info WeChatUserInfo) String() string {
 	return fmt.Sprintf("NickName:[%s] Alias:[%s], NickName:[%s], ReMark:[%s], SmallHeadImgUrl:[%s], BigHeadImgUrl[%s]",
 		info.NickName, info.Alias, info.NickName, info.ReMark, info.SmallHeadImgUrl, info.BigHeadImgUrl)
 }
 
+// wechatMessageHandle fills in everything shown by the frontend, it is
+// only run on the messages that are returned.
+func (P *WechatDataProvider) wechatMessageHandle(msg *WeChatMessage) {
+	msg.LocalTime = localTimeText(msg.CreateTime)
+	if msg.handled&msgHandledExtra == 0 {
+		P.wechatMessageExtraHandle(msg)
+	}
+	P.wechatMessageMentionHandle(msg)
+	P.wechatMessageVoiceHandle(msg)
+	P.wechatMessageGetUserInfo(msg)
+	P.wechatMessageEmojiHandle(msg)
+	if msg.handled&msgHandledContent == 0 {
+		P.wechatMessageCompressContentHandle(msg)
+		P.wechatMessageLocationHandke(msg)
+	}
+	P.wechatMessageMediaHandle(msg)
+	P.wechatMessageVoipHandle(msg)
+	P.wechatMessageVisitHandke(msg)
+	P.wechatMessageRedPacketStatusHandle(msg)
+	if msg.handled&msgHandledSystem == 0 {
+		P.wechatMessageSystemHandle(msg)
+	}
+}
+
+// wechatMessageFilterMatch parses only what filter.match looks at, the
+// sender for a group member, the text for a keyword and the kind of a
+// system message.
+func (P *WechatDataProvider) wechatMessageFilterMatch(msg *WeChatMessage, filter *MessageFilter) bool {
+	if !filter.needMatch() {
+		return true
+	}
+
+	P.wechatMessageExtraHandle(msg)
+	msg.handled |= msgHandledExtra
+	if len(filter.KeyWord) > 0 {
+		P.wechatMessageCompressContentHandle(msg)
+		P.wechatMessageLocationHandke(msg)
+		msg.handled |= msgHandledContent
+	}
+	if len(filter.SystemKinds) > 0 {
+		P.wechatMessageSystemHandle(msg)
+		msg.handled |= msgHandledSystem
+	}
+
+	return filter.match(msg, P.SelfInfo.UserName)
+}
+
 func (P *WechatDataProvider) wechatMessageExtraHandle(msg *WeChatMessage) {
-	var extra MessageBytesExtra
-	err := proto.Unmarshal(msg.bytesExtra, &extra)
+	extra, err := decodeMessageExtra(msg.bytesExtra)
 	if err != nil {
 		log.Println("proto.Unmarshal failed", err)
 		return
 	}
 
-	for _, ext := range extra.Message2 {
-		switch ext.Field1 {
-		case 1:
+	msg.SourceInfo = extra.msgSource()
+	for key := range extra.strings {
+		value := extra.value(key)
+		switch key {
+		case bytesExtraSender:
 			if msg.IsChatRoom {
-				msg.UserInfo.UserName = ext.Field2
+				msg.UserInfo.UserName = value
 			}
-		case 3:
-			if len(ext.Field2) > 0 {
+		case bytesExtraThumb:
+			if len(value) > 0 {
 				if msg.Type == Wechat_Message_Type_Picture || msg.Type == Wechat_Message_Type_Video || msg.Type == Wechat_Message_Type_Misc {
-					msg.ThumbPath = P.prefixResPath + ext.Field2[len(P.SelfInfo.UserName):]
+					msg.ThumbPath = P.prefixResPath + value[len(P.SelfInfo.UserName):]
 				}
 
 				if msg.Type == Wechat_Message_Type_Misc && (msg.SubType == Wechat_Misc_Message_Music || msg.SubType == Wechat_Misc_Message_TingListen) {
-					msg.MusicInfo.ThumbPath = P.prefixResPath + ext.Field2[len(P.SelfInfo.UserName):]
+					msg.MusicInfo.ThumbPath = P.prefixResPath + value[len(P.SelfInfo.UserName):]
 				} else if msg.Type == Wechat_Message_Type_Location {
-					msg.LocationInfo.ThumbPath = P.prefixResPath + ext.Field2[len(P.SelfInfo.UserName):]
+					msg.LocationInfo.ThumbPath = P.prefixResPath + value[len(P.SelfInfo.UserName):]
 				}
 			}
-		case 4:
-			if len(ext.Field2) > 0 {
+		case bytesExtraFile:
+			if len(value) > 0 {
 				if msg.Type == Wechat_Message_Type_Misc && msg.SubType == Wechat_Misc_Message_File {
-					msg.FileInfo.FilePath = P.prefixResPath + ext.Field2[len(P.SelfInfo.UserName):]
-					msg.FileInfo.FileName = filepath.Base(ext.Field2)
+					msg.FileInfo.FilePath = P.prefixResPath + value[len(P.SelfInfo.UserName):]
+					msg.FileInfo.FileName = filepath.Base(value)
 				} else if msg.Type == Wechat_Message_Type_Picture || msg.Type == Wechat_Message_Type_Video || msg.Type == Wechat_Message_Type_Misc {
-					msg.ImagePath = P.prefixResPath + ext.Field2[len(P.SelfInfo.UserName):]
-					msg.VideoPath = P.prefixResPath + ext.Field2[len(P.SelfInfo.UserName):]
+					msg.ImagePath = P.prefixResPath + value[len(P.SelfInfo.UserName):]
+					msg.VideoPath = P.prefixResPath + value[len(P.SelfInfo.UserName):]
 				}
 			}
 		}
 	}
+}
+
+func (P *WechatDataProvider) wechatMessageVoiceHandle(msg *WeChatMessage) {
+	if msg.Type != Wechat_Message_Type_Voice {
+		return
+	}
+
+	msg.VoicePath = P.wechatGetVoicePath(msg.MsgSvrId)
+	if info := P.wechatMessageVoiceInfo(msg.MsgSvrId); info != nil {
+		msg.VoiceInfo = *info
+	}
+}
+
+// wechatMessageVoiceInfo only reads Sidecar.db. A voice without info is
+// queued to wechatVoiceInfoWorker and skipped by later calls until its info
+// is saved, a voice without media is skipped for good.
+func (P *WechatDataProvider) wechatMessageVoiceInfo(msgSvrId string) *VoiceInfo {
+	if P.sidecar == nil {
+		return nil
+	}
+
+	msgSvrID, err := strconv.ParseInt(msgSvrId, 10, 64)
+	if err != nil {
+		return nil
+	}
+
+	if _, ok := P.voiceInfoMiss.Load(msgSvrID); ok {
+		return nil
+	}
+
+	info, err := P.wechatGetVoiceInfo(msgSvrID)
+	if err == nil {
+		return info
+	}
+
+	P.voiceInfoOnce.Do(func() {
+		P.voiceInfoQueue = make(chan int64, 256)
+		if P.wechatBackgroundStart() {
+			go P.wechatVoiceInfoWorker()
+		}
+	})
+	P.voiceInfoMiss.Store(msgSvrID, true)
+	select {
+	case P.voiceInfoQueue <- msgSvrID:
+	default:
+		// the queue is full, try again on the next call
+		P.voiceInfoMiss.Delete(msgSvrID)
+	}
+
+	return nil
+}
+
+// wechatVoiceInfoWorker decodes the voices queued by wechatMessageVoiceInfo
+// and saves their info to Sidecar.db.
+func (P *WechatDataProvider) wechatVoiceInfoWorker() {
+	defer P.bgWg.Done()
+	for {
+		select {
+		case <-P.quit:
+			return
+		case msgSvrID := <-P.voiceInfoQueue:
+			if P.wechatSaveMessageVoiceInfo(msgSvrID) == nil {
+				continue
+			}
+			P.voiceInfoMiss.Delete(msgSvrID)
+		}
+	}
+}
+
+// wechatSaveMessageVoiceInfo decodes the voice of msgSvrID and saves its
+// info to Sidecar.db, it returns nil when the voice has no media.
+func (P *WechatDataProvider) wechatSaveMessageVoiceInfo(msgSvrID int64) *VoiceInfo {
+	buf := P.wechatGetVoiceBuf(msgSvrID)
+	if len(buf) == 0 {
+		return nil
+	}
+
+	pcm, _ := silkDecode(buf, waveformSampleRate)
+	info := silkVoiceInfo(buf, pcm)
+	if err := wechatSetVoiceInfo(P.sidecar, msgSvrID, info); err != nil {
+		log.Println("wechatSetVoiceInfo failed:", msgSvrID, err)
+	}
+
+	return info
+}
+
+func (P *WechatDataProvider) wechatGetVoiceBuf(msgSvrID int64) []byte {
+	P.mediaMsgOnce.Do(func() {
+		for index := 0; ; index++ {
+			mediaMSGDB := fmt.Sprintf("%s\\Msg\\Multi\\MediaMSG%d.db", P.resPath, index)
+			if _, err := os.Stat(mediaMSGDB); err != nil {
+				break
+			}
+
+			db, err := sql.Open("sqlite3", mediaMSGDB)
+			if err != nil {
+				log.Printf("open %s failed: %v\n", mediaMSGDB, err)
+				continue
+			}
+			P.mediaMsgDBs = append(P.mediaMsgDBs, db)
+		}
+	})
+
+	var buf []byte
+	for _, db := range P.mediaMsgDBs {
+		err := P.wechatQueryRow(db, "select Buf from Media where Reserved0=?;", msgSvrID).Scan(&buf)
+		if err == nil {
+			return buf
+		}
+	}
+
+	return nil
+}
 
-	if msg.Type == Wechat_Message_Type_Voice {
-		msg.VoicePath = fmt.Sprintf("%s\\FileStorage\\Voice\\%s.mp3", P.prefixResPath, msg.MsgSvrId)
+func (P *WechatDataProvider) wechatGetVoicePath(msgSvrId string) string {
+	format := GetVoiceExportConfig().Format
+	msgSvrID, _ := strconv.ParseInt(msgSvrId, 10, 64)
+	voicePath := fmt.Sprintf("%s\\FileStorage\\Voice", P.resPath)
+	if _, f := findVoiceFile(voicePath, msgSvrID, format); f != "" {
+		format = f
 	}
+
+	return fmt.Sprintf("%s\\FileStorage\\Voice\\%s.%s", P.prefixResPath, msgSvrId, format)
 }
 
 type EmojiMsg struct {
@@ -945,6 +1327,7 @@ type EmojiMsg struct {
 
 type Emoji struct {
 	XMLName  xml.Name `xml:"emoji"`
+	Md5      string   `xml:"md5,attr"`
 	CdnURL   string   `xml:"cdnurl,attr"`
 	Thumburl string   `xml:"thumburl,attr"`
 	Width    string   `xml:"width,attr"`
@@ -963,7 +1346,10 @@ func (P *WechatDataProvider) wechatMessageEmojiHandle(msg *WeChatMessage) {
 		return
 	}
 
-	msg.EmojiPath = emojiMsg.Emoji.CdnURL
+	msg.EmojiPath = P.wechatGetAssetPath(emojiMsg.Emoji.CdnURL)
+	if localPath := P.wechatGetEmojiLocalPath(emojiMsg.Emoji.Md5); localPath != "" {
+		msg.EmojiPath = localPath
+	}
 }
 
 type xmlDocument struct {
@@ -988,15 +1374,14 @@ func (P *WechatDataProvider) wechatMessageCompressContentHandle(msg *WeChatMessa
 		return
 	}
 
-	unCompressContent := make([]byte, len(msg.compressContent)*10)
-	ulen, err := lz4.UncompressBlock(msg.compressContent, unCompressContent)
+	unCompressContent, err := uncompressContent(msg.compressContent)
 	if err != nil {
 		log.Println("UncompressBlock failed:", err, msg.MsgSvrId)
 		return
 	}
 
 	compMsg := etree.NewDocument()
-	if err := compMsg.ReadFromBytes(unCompressContent[:ulen-1]); err != nil {
+	if err := compMsg.ReadFromBytes(unCompressContent[:len(unCompressContent)-1]); err != nil {
 		// os.WriteFile("D:\\tmp\\"+string(msg.LocalId)+".xml", unCompressContent[:ulen], 0600)
 		log.Println("ReadFromBytes failed:", err)
 		return
@@ -1013,7 +1398,13 @@ func (P *WechatDataProvider) wechatMessageCompressContentHandle(msg *WeChatMessa
 		}
 		thumburl := root.FindElementValue("/msg/appmsg/thumburl")
 		if len(msg.ThumbPath) == 0 && len(thumburl) > 0 && strings.HasPrefix(thumburl, "http") {
-			msg.ThumbPath = thumburl
+			msg.ThumbPath = P.wechatGetAssetPath(thumburl)
+		}
+
+		if msg.SubType == Wechat_Misc_Message_Applet || msg.SubType == Wechat_Misc_Message_Applet2 {
+			P.wechatMessageAppletParse(msg, root)
+		} else if msg.SubType == Wechat_Misc_Message_Game {
+			P.wechatMessageGameParse(msg, root)
 		}
 	} else if msg.Type == Wechat_Message_Type_Misc && msg.SubType == Wechat_Misc_Message_Refer {
 		msg.Content = root.FindElementValue("/msg/appmsg/title")
@@ -1045,7 +1436,7 @@ func (P *WechatDataProvider) wechatMessageCompressContentHandle(msg *WeChatMessa
 		msg.ChannelsInfo.ThumbPath = root.FindElementValue("/msg/appmsg/finderFeed/mediaList/media/thumbUrl")
 		msg.ChannelsInfo.Description = root.FindElementValue("/msg/appmsg/finderFeed/desc")
 		msg.ChannelsInfo.ThumbPath = P.urlconvertCacheName(msg.ChannelsInfo.ThumbPath, msg.CreateTime)
-	} else if msg.Type == Wechat_Message_Type_Misc && msg.SubType == Wechat_Misc_Message_Live {
+	} else if msg.Type == Wechat_Message_Type_Misc && (msg.SubType == Wechat_Misc_Message_Live || msg.SubType == Wechat_Misc_Message_Live2) {
 		msg.ChannelsInfo.NickName = root.FindElementValue("/msg/appmsg/finderLive/nickname")
 		msg.ChannelsInfo.ThumbPath = root.FindElementValue("/msg/appmsg/finderLive/media/coverUrl")
 		msg.ChannelsInfo.Description = root.FindElementValue("/msg/appmsg/finderLive/desc")
@@ -1055,6 +1446,16 @@ func (P *WechatDataProvider) wechatMessageCompressContentHandle(msg *WeChatMessa
 		msg.MusicInfo.Description = root.FindElementValue("/msg/appmsg/des")
 		msg.MusicInfo.DataUrl = root.FindElementValue("/msg/appmsg/dataurl")
 		msg.MusicInfo.DisPlayName = root.FindElementValue("/msg/appinfo/appname")
+	} else if msg.Type == Wechat_Message_Type_Misc && msg.SubType == Wechat_Misc_Message_ForwardMessage {
+		P.wechatMessageForwardHandle(msg, root)
+	} else if msg.Type == Wechat_Message_Type_Misc && msg.SubType == Wechat_Misc_Message_RedPacket {
+		P.wechatMessageRedPacketParse(msg, root)
+	} else if msg.Type == Wechat_Message_Type_Misc && msg.SubType == Wechat_Misc_Message_Notice {
+		P.wechatMessageNoticeParse(msg, root)
+	} else if msg.Type == Wechat_Message_Type_Misc && msg.SubType == Wechat_Misc_Message_CustomEmoji {
+		P.wechatMessageCustomEmojiParse(msg, root)
+	} else if msg.Type == Wechat_Message_Type_Misc && msg.SubType == Wechat_Misc_Message_File {
+		P.wechatMessageFileParse(msg, root)
 	}
 }
 
@@ -1094,11 +1495,7 @@ func (P *WechatDataProvider) wechatMessageVisitHandke(msg *WeChatMessage) {
 		msg.VisitInfo.NickName = attr["nickname"]
 		msg.VisitInfo.SmallHeadImgUrl = attr["smallheadimgurl"]
 		msg.VisitInfo.BigHeadImgUrl = attr["bigheadimgurl"]
-		localHeadImgPath := fmt.Sprintf("%s\\FileStorage\\HeadImage\\%s.headimg", P.resPath, userName)
-		relativePath := fmt.Sprintf("%s\\FileStorage\\HeadImage\\%s.headimg", P.prefixResPath, userName)
-		if _, err = os.Stat(localHeadImgPath); err == nil {
-			msg.VisitInfo.LocalHeadImgUrl = relativePath
-		}
+		msg.VisitInfo.LocalHeadImgUrl = P.wechatGetLocalHeadImg(userName, msg.VisitInfo.BigHeadImgUrl, msg.VisitInfo.SmallHeadImgUrl)
 	}
 }
 
@@ -1131,94 +1528,6 @@ func (P *WechatDataProvider) wechatMessageGetUserInfo(msg *WeChatMessage) {
 	msg.UserInfo = *pinfo
 }
 
-func (P *WechatDataProvider) wechatFindDBIndex(userName string, time int64, direction Message_Search_Direction) int {
-	if direction == Message_Search_Forward {
-		index := 0
-		for {
-			if index >= len(P.msgDBs) {
-				return -1
-			}
-			msgDB := P.msgDBs[index]
-
-			if msgDB.startTime > time {
-				index += 1
-				continue
-			}
-
-			rowId := 0
-			querySql := fmt.Sprintf("select rowid from Name2ID where UsrName='%s';", userName)
-			err := msgDB.db.QueryRow(querySql).Scan(&rowId)
-			if err != nil {
-				log.Printf("Scan: %v\n", err)
-				index += 1
-				continue
-			}
-
-			querySql = fmt.Sprintf(" select rowid from MSG where StrTalker='%s' AND CreateTime<=%d limit 1;", userName, time)
-			log.Printf("in %s, %s\n", msgDB.path, querySql)
-			err = msgDB.db.QueryRow(querySql).Scan(&rowId)
-			if err != nil {
-				log.Printf("Scan: %v\n", err)
-				index += 1
-				continue
-			}
-
-			log.Printf("Select in %d %s\n", index, msgDB.path)
-			return index
-		}
-	} else {
-		index := len(P.msgDBs) - 1
-		for {
-			if index < 0 {
-				return -1
-			}
-			msgDB := P.msgDBs[index]
-
-			if msgDB.endTime < time {
-				index -= 1
-				continue
-			}
-
-			rowId := 0
-			querySql := fmt.Sprintf("select rowid from Name2ID where UsrName='%s';", userName)
-			err := msgDB.db.QueryRow(querySql).Scan(&rowId)
-			if err != nil {
-				log.Printf("Scan: %v\n", err)
-				index -= 1
-				continue
-			}
-
-			querySql = fmt.Sprintf(" select rowid from MSG where StrTalker='%s' AND CreateTime>%d limit 1;", userName, time)
-			log.Printf("in %s, %s\n", msgDB.path, querySql)
-			err = msgDB.db.QueryRow(querySql).Scan(&rowId)
-			if err != nil {
-				log.Printf("Scan: %v\n", err)
-				index -= 1
-				continue
-			}
-
-			log.Printf("Select in %d %s\n", index, msgDB.path)
-			return index
-		}
-	}
-}
-
-func (P *WechatDataProvider) wechatGetLastMessageCreateTime(userName string, index int) int64 {
-	if index >= len(P.msgDBs) {
-		return -1
-	}
-	sqlFormat := "SELECT CreateTime FROM MSG WHERE StrTalker='%s' order by CreateTime asc limit 1;"
-	querySql := fmt.Sprintf(sqlFormat, userName)
-	var lastTime int64
-	err := P.msgDBs[index].db.QueryRow(querySql).Scan(&lastTime)
-	if err != nil {
-		log.Println("select DB lastTime failed:", index, ":", err)
-		return -1
-	}
-
-	return lastTime
-}
-
 func weChatMessageContains(msg *WeChatMessage, chars string) bool {
 
 	switch msg.Type {
@@ -1230,10 +1539,18 @@ func weChatMessageContains(msg *WeChatMessage, chars string) bool {
 		switch msg.SubType {
 		case Wechat_Misc_Message_CardLink, Wechat_Misc_Message_ThirdVideo, Wechat_Misc_Message_Applet, Wechat_Misc_Message_Applet2:
 			return strings.Contains(msg.LinkInfo.Title, chars) || strings.Contains(msg.LinkInfo.Description, chars)
+		case Wechat_Misc_Message_Game:
+			return strings.Contains(msg.LinkInfo.Title, chars) || strings.Contains(msg.GameInfo.Name, chars)
+		case Wechat_Misc_Message_RedPacket:
+			return strings.Contains(msg.RedPacketInfo.Greeting, chars)
+		case Wechat_Misc_Message_Notice:
+			return strings.Contains(msg.NoticeInfo.Text, chars)
 		case Wechat_Misc_Message_Refer:
 			return strings.Contains(msg.Content, chars)
 		case Wechat_Misc_Message_File:
 			return strings.Contains(msg.FileInfo.FileName, chars)
+		case Wechat_Misc_Message_ForwardMessage:
+			return strings.Contains(msg.ForwardInfo.Title, chars) || strings.Contains(msg.ForwardInfo.Description, chars)
 		default:
 			return false
 		}
@@ -1242,30 +1559,6 @@ func weChatMessageContains(msg *WeChatMessage, chars string) bool {
 	}
 }
 
-func weChatMessageTypeFilter(msg *WeChatMessage, msgType string) bool {
-	switch msgType {
-	case "":
-		return true
-	case "文件":
-		return msg.Type == Wechat_Message_Type_Misc && msg.SubType == Wechat_Misc_Message_File
-	case "图片与视频":
-		return msg.Type == Wechat_Message_Type_Picture || msg.Type == Wechat_Message_Type_Video
-	case "链接":
-		return msg.Type == Wechat_Message_Type_Misc && (msg.SubType == Wechat_Misc_Message_CardLink || msg.SubType == Wechat_Misc_Message_ThirdVideo)
-	case "语音":
-		return msg.Type == Wechat_Message_Type_Voice
-	case "通话":
-		return msg.Type == Wechat_Message_Type_Voip
-	default:
-		if strings.HasPrefix(msgType, "群成员") {
-			userName := msgType[len("群成员"):]
-			return msg.UserInfo.UserName == userName
-		}
-
-		return false
-	}
-}
-
 func wechatOpenMsgDB(path string) (*wechatMsgDB, error) {
 	msgDB := wechatMsgDB{}
 
@@ -1328,8 +1621,8 @@ func (P *WechatDataProvider) wechatGetAllContact() (*WeChatContactList, error) {
 	List := &WeChatContactList{}
 	List.Users = make([]WeChatContact, 0)
 
-	querySql := fmt.Sprintf("select ifnull(UserName,'') as UserName,Reserved1,Reserved2,ifnull(PYInitial,'') as PYInitial,ifnull(QuanPin,'') as QuanPin,ifnull(RemarkPYInitial,'') as RemarkPYInitial,ifnull(RemarkQuanPin,'') as RemarkQuanPin from Contact desc;")
-	dbRows, err := P.microMsg.Query(querySql)
+	querySql := "select ifnull(UserName,'') as UserName,Reserved1,Reserved2,ifnull(PYInitial,'') as PYInitial,ifnull(QuanPin,'') as QuanPin,ifnull(RemarkPYInitial,'') as RemarkPYInitial,ifnull(RemarkQuanPin,'') as RemarkQuanPin from Contact desc;"
+	dbRows, err := P.wechatQuery(P.microMsg, querySql)
 	if err != nil {
 		log.Println(err)
 		return List, err
@@ -1384,9 +1677,9 @@ func WechatGetAccountInfo(resPath, prefixRes, accountName string) (*WeChatAccoun
 	info := &WeChatAccountInfo{}
 
 	var UserName, Alias, ReMark, NickName string
-	querySql := fmt.Sprintf("select ifnull(UserName,'') as UserName, ifnull(Alias,'') as Alias, ifnull(ReMark,'') as ReMark, ifnull(NickName,'') as NickName from Contact where UserName='%s';", accountName)
+	querySql := "select ifnull(UserName,'') as UserName, ifnull(Alias,'') as Alias, ifnull(ReMark,'') as ReMark, ifnull(NickName,'') as NickName from Contact where UserName=?;"
 	// log.Println(querySql)
-	err = microMsg.QueryRow(querySql).Scan(&UserName, &Alias, &ReMark, &NickName)
+	err = microMsg.QueryRow(querySql, accountName).Scan(&UserName, &Alias, &ReMark, &NickName)
 	if err != nil {
 		log.Println("not found User:", err)
 		return nil, err
@@ -1395,9 +1688,9 @@ func WechatGetAccountInfo(resPath, prefixRes, accountName string) (*WeChatAccoun
 	log.Printf("UserName %s, Alias %s, ReMark %s, NickName %s\n", UserName, Alias, ReMark, NickName)
 
 	var smallHeadImgUrl, bigHeadImgUrl string
-	querySql = fmt.Sprintf("select ifnull(smallHeadImgUrl,'') as smallHeadImgUrl, ifnull(bigHeadImgUrl,'') as bigHeadImgUrl from ContactHeadImgUrl where usrName='%s';", UserName)
+	querySql = "select ifnull(smallHeadImgUrl,'') as smallHeadImgUrl, ifnull(bigHeadImgUrl,'') as bigHeadImgUrl from ContactHeadImgUrl where usrName=?;"
 	// log.Println(querySql)
-	err = microMsg.QueryRow(querySql).Scan(&smallHeadImgUrl, &bigHeadImgUrl)
+	err = microMsg.QueryRow(querySql, UserName).Scan(&smallHeadImgUrl, &bigHeadImgUrl)
 	if err != nil {
 		log.Println("not find headimg", err)
 	}
@@ -1409,15 +1702,17 @@ func WechatGetAccountInfo(resPath, prefixRes, accountName string) (*WeChatAccoun
 	info.SmallHeadImgUrl = smallHeadImgUrl
 	info.BigHeadImgUrl = bigHeadImgUrl
 
-	localHeadImgPath := fmt.Sprintf("%s\\FileStorage\\HeadImage\\%s.headimg", resPath, accountName)
-	relativePath := fmt.Sprintf("%s\\FileStorage\\HeadImage\\%s.headimg", prefixRes, accountName)
-	if _, err = os.Stat(localHeadImgPath); err == nil {
-		info.LocalHeadImgUrl = relativePath
-	}
+	info.LocalHeadImgUrl = findLocalHeadImg(resPath, prefixRes, accountName)
 	// log.Println(info)
 	return info, nil
 }
 
+// isSystemMessage reports whether msgType is shown as a system message,
+// Type 10002 carries the sysmsg XML of recalls and pats.
+func isSystemMessage(msgType int) bool {
+	return msgType == Wechat_Message_Type_System || msgType == Wechat_Message_Type_SysMsg
+}
+
 func systemMsgParse(msgType int, content string) string {
 	if msgType != Wechat_Message_Type_System {
 		return content
@@ -1437,7 +1732,7 @@ func (P *WechatDataProvider) urlconvertCacheName(url string, timestamp int64) st
 		return path
 	}
 
-	return url
+	return P.wechatGetAssetPath(url)
 }
 
 func isLinkSubType(subType int) bool {
@@ -1511,6 +1806,66 @@ func openUserDataDB(path string) *sql.DB {
 	return db
 }
 
+// openSidecarDB opens the database that keeps data derived from the
+// WeChat databases, its tables are created on every open so that old
+// exports pick up new ones.
+func openSidecarDB(path string) *sql.DB {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		log.Printf("open db %s error: %v", path, err)
+		return nil
+	}
+
+	createVoiceInfoTable := `
+	CREATE TABLE IF NOT EXISTS voiceInfo (
+		MsgSvrID INTEGER PRIMARY KEY,
+		duration INT DEFAULT 0,
+		waveform TEXT
+	);`
+
+	_, err = db.Exec(createVoiceInfoTable)
+	if err != nil {
+		log.Printf("create voiceInfo table failed: %v", err)
+		db.Close()
+		return nil
+	}
+
+	createShardIndexTable := `
+	CREATE TABLE IF NOT EXISTS shardInfo (
+		shard TEXT PRIMARY KEY,
+		fingerprint TEXT
+	);
+	CREATE TABLE IF NOT EXISTS talkerShard (
+		talker TEXT,
+		shard TEXT,
+		minTime INTEGER DEFAULT 0,
+		maxTime INTEGER DEFAULT 0,
+		count INTEGER DEFAULT 0,
+		PRIMARY KEY (talker, shard)
+	);
+	CREATE TABLE IF NOT EXISTS referShard (
+		shard TEXT PRIMARY KEY,
+		fingerprint TEXT
+	);
+	CREATE TABLE IF NOT EXISTS referIndex (
+		shard TEXT,
+		MsgSvrID INTEGER,
+		referSvrID INTEGER,
+		talker TEXT
+	);
+	CREATE INDEX IF NOT EXISTS referIndexShard ON referIndex (shard);
+	CREATE INDEX IF NOT EXISTS referIndexReferSvrID ON referIndex (referSvrID);`
+
+	_, err = db.Exec(createShardIndexTable)
+	if err != nil {
+		log.Printf("create shard index table failed: %v", err)
+		db.Close()
+		return nil
+	}
+
+	return db
+}
+
 func (P *WechatDataProvider) WeChatGetSessionLastTime(userName string) *WeChatLastTime {
 	lastTime := &WeChatLastTime{}
 	if P.userData == nil {
@@ -1520,8 +1875,8 @@ func (P *WechatDataProvider) WeChatGetSessionLastTime(userName string) *WeChatLa
 
 	var timestamp int64
 	var messageId string
-	querySql := fmt.Sprintf("select timestamp, messageId from lastTime where userName='%s';", userName)
-	err := P.userData.QueryRow(querySql).Scan(&timestamp, &messageId)
+	querySql := "select timestamp, messageId from lastTime where userName=?;"
+	err := P.wechatQueryRow(P.userData, querySql, userName).Scan(&timestamp, &messageId)
 	if err != nil {
 		log.Println("select DB timestamp failed:", err)
 		return lastTime
@@ -1535,20 +1890,20 @@ func (P *WechatDataProvider) WeChatGetSessionLastTime(userName string) *WeChatLa
 
 func (P *WechatDataProvider) WeChatSetSessionLastTime(lastTime *WeChatLastTime) error {
 	var count int
-	querySql := fmt.Sprintf("select COUNT(*) from lastTime where userName='%s';", lastTime.UserName)
-	err := P.userData.QueryRow(querySql).Scan(&count)
+	querySql := "select COUNT(*) from lastTime where userName=?;"
+	err := P.wechatQueryRow(P.userData, querySql, lastTime.UserName).Scan(&count)
 	if err != nil {
 		log.Println("select DB timestamp count failed:", err)
 		return err
 	}
 
 	if count > 0 {
-		_, err := P.userData.Exec("UPDATE lastTime SET timestamp = ?, messageId = ? WHERE userName = ?", lastTime.Timestamp, lastTime.MessageId, lastTime.UserName)
+		_, err := P.wechatExec(P.userData, "UPDATE lastTime SET timestamp = ?, messageId = ? WHERE userName = ?", lastTime.Timestamp, lastTime.MessageId, lastTime.UserName)
 		if err != nil {
 			return fmt.Errorf("update timestamp failed: %v", err)
 		}
 	} else {
-		_, err := P.userData.Exec("INSERT INTO lastTime (userName, timestamp, messageId) VALUES (?, ?, ?)", lastTime.UserName, lastTime.Timestamp, lastTime.MessageId)
+		_, err := P.wechatExec(P.userData, "INSERT INTO lastTime (userName, timestamp, messageId) VALUES (?, ?, ?)", lastTime.UserName, lastTime.Timestamp, lastTime.MessageId)
 		if err != nil {
 			return fmt.Errorf("insert failed: %v", err)
 		}
@@ -1560,10 +1915,10 @@ func (P *WechatDataProvider) WeChatSetSessionLastTime(lastTime *WeChatLastTime)
 
 func (P *WechatDataProvider) WeChatSetSessionBookMask(userName, tag, info string) error {
 	markId := utils.Hash256Sum([]byte(info))
-	querySql := fmt.Sprintf("select COUNT(*) from bookMark where markId='%s';", markId)
+	querySql := "select COUNT(*) from bookMark where markId=?;"
 	var count int
 
-	err := P.userData.QueryRow(querySql).Scan(&count)
+	err := P.wechatQueryRow(P.userData, querySql, markId).Scan(&count)
 	if err != nil {
 		log.Println("select DB markId count failed:", err)
 		return err
@@ -1574,7 +1929,7 @@ func (P *WechatDataProvider) WeChatSetSessionBookMask(userName, tag, info string
 		return nil
 	}
 
-	_, err = P.userData.Exec("INSERT INTO bookMark (userName, markId, tag, info) VALUES (?, ?, ?, ?)", userName, markId, tag, info)
+	_, err = P.wechatExec(P.userData, "INSERT INTO bookMark (userName, markId, tag, info) VALUES (?, ?, ?, ?)", userName, markId, tag, info)
 	if err != nil {
 		return fmt.Errorf("insert failed: %v", err)
 	}
@@ -1583,17 +1938,17 @@ func (P *WechatDataProvider) WeChatSetSessionBookMask(userName, tag, info string
 }
 
 func (P *WechatDataProvider) WeChatDelSessionBookMask(markId string) error {
-	querySql := fmt.Sprintf("select COUNT(*) from bookMark where markId='%s';", markId)
+	querySql := "select COUNT(*) from bookMark where markId=?;"
 	var count int
 
-	err := P.userData.QueryRow(querySql).Scan(&count)
+	err := P.wechatQueryRow(P.userData, querySql, markId).Scan(&count)
 	if err != nil {
 		log.Println("select DB markId count failed:", err)
 		return err
 	}
 
 	if count > 0 {
-		_, err = P.userData.Exec("DELETE from bookMark where markId=?", markId)
+		_, err = P.wechatExec(P.userData, "DELETE from bookMark where markId=?", markId)
 		if err != nil {
 			return fmt.Errorf("delete failed: %v", err)
 		}
@@ -1609,10 +1964,10 @@ func (P *WechatDataProvider) WeChatGetSessionBookMaskList(userName string) (*WeC
 	markList.Marks = make([]WeChatBookMark, 0)
 	markList.Total = 0
 
-	querySql := fmt.Sprintf("select markId, tag, info from bookMark where userName='%s';", userName)
-	log.Println("querySql:", querySql)
+	querySql := "select markId, tag, info from bookMark where userName=?;"
+	log.Println("querySql:", querySql, userName)
 
-	rows, err := P.userData.Query(querySql)
+	rows, err := P.wechatQuery(P.userData, querySql, userName)
 	if err != nil {
 		log.Printf("%s failed %v\n", querySql, err)
 		return markList, err
@@ -1690,6 +2045,12 @@ func (P *WechatDataProvider) WeChatExportDBByUserName(userName, exportPath strin
 		return err
 	}
 
+	err = P.weChatExportSidecarDBByUserName(userName, msgPath)
+	if err != nil {
+		log.Println("weChatExportSidecarDBByUserName failed:", err)
+		return err
+	}
+
 	return nil
 }
 
@@ -1714,7 +2075,7 @@ func (P *WechatDataProvider) weChatExportMicroMsgDBByUserName(userName, exportPa
 		tables = append(tables, "ChatRoom", "ChatRoomInfo")
 	}
 
-	err = wechatCopyDBTables(exMicroMsgDB, P.microMsg, tables)
+	err = P.wechatCopyDBTables(exMicroMsgDB, P.microMsg, tables)
 	if err != nil {
 		log.Println("wechatCopyDBTables:", err)
 		return err
@@ -1722,14 +2083,14 @@ func (P *WechatDataProvider) weChatExportMicroMsgDBByUserName(userName, exportPa
 
 	copyContactData := func(users []string) error {
 		columns := "UserName, Alias, EncryptUserName, DelFlag, Type, VerifyFlag, Reserved1, Reserved2, Reserved3, Reserved4, Remark, NickName, LabelIDList, DomainList, ChatRoomType, PYInitial, QuanPin, RemarkPYInitial, RemarkQuanPin, BigHeadImgUrl, SmallHeadImgUrl, HeadImgMd5, ChatRoomNotify, Reserved5, Reserved6, Reserved7, ExtraBuf, Reserved8, Reserved9, Reserved10, Reserved11"
-		err = wechatCopyTableData(exMicroMsgDB, P.microMsg, "Contact", columns, "UserName", users)
+		err = P.wechatCopyTableData(exMicroMsgDB, P.microMsg, "Contact", columns, "UserName", users)
 		if err != nil {
 			log.Println("wechatCopyTableData Contact:", err)
 			return err
 		}
 
 		columns = "usrName, smallHeadImgUrl, bigHeadImgUrl, headImgMd5, reverse0, reverse1"
-		err = wechatCopyTableData(exMicroMsgDB, P.microMsg, "ContactHeadImgUrl", columns, "usrName", users)
+		err = P.wechatCopyTableData(exMicroMsgDB, P.microMsg, "ContactHeadImgUrl", columns, "usrName", users)
 		if err != nil {
 			log.Println("wechatCopyTableData ContactHeadImgUrl:", err)
 			return err
@@ -1745,7 +2106,7 @@ func (P *WechatDataProvider) weChatExportMicroMsgDBByUserName(userName, exportPa
 	}
 
 	columns := "strUsrName, nOrder, nUnReadCount, parentRef, Reserved0, Reserved1, strNickName, nStatus, nIsSend, strContent, nMsgType, nMsgLocalID, nMsgStatus, nTime, editContent, othersAtMe, Reserved2, Reserved3, Reserved4, Reserved5, bytesXml"
-	err = wechatCopyTableData(exMicroMsgDB, P.microMsg, "Session", columns, "strUsrName", []string{userName})
+	err = P.wechatCopyTableData(exMicroMsgDB, P.microMsg, "Session", columns, "strUsrName", []string{userName})
 	if err != nil {
 		log.Println("wechatCopyTableData Session:", err)
 		return err
@@ -1774,14 +2135,14 @@ func (P *WechatDataProvider) weChatExportMicroMsgDBByUserName(userName, exportPa
 	}
 
 	columns = "ChatRoomName, UserNameList, DisplayNameList, ChatRoomFlag, Owner, IsShowName, SelfDisplayName, Reserved1, Reserved2, Reserved3, Reserved4, Reserved5, Reserved6, RoomData, Reserved7, Reserved8"
-	err = wechatCopyTableData(exMicroMsgDB, P.microMsg, "ChatRoom", columns, "ChatRoomName", []string{userName})
+	err = P.wechatCopyTableData(exMicroMsgDB, P.microMsg, "ChatRoom", columns, "ChatRoomName", []string{userName})
 	if err != nil {
 		log.Println("wechatCopyTableData ChatRoom:", err)
 		return err
 	}
 
 	columns = "ChatRoomName, Announcement, InfoVersion, AnnouncementEditor, AnnouncementPublishTime, ChatRoomStatus, Reserved1, Reserved2, Reserved3, Reserved4, Reserved5, Reserved6, Reserved7, Reserved8"
-	err = wechatCopyTableData(exMicroMsgDB, P.microMsg, "ChatRoomInfo", columns, "ChatRoomName", []string{userName})
+	err = P.wechatCopyTableData(exMicroMsgDB, P.microMsg, "ChatRoomInfo", columns, "ChatRoomName", []string{userName})
 	if err != nil {
 		log.Println("wechatCopyTableData ChatRoom:", err)
 		return err
@@ -1809,7 +2170,7 @@ func (P *WechatDataProvider) weChatExportMsgDBByUserName(userName, exportPath st
 	}
 
 	tables := []string{"MSG", "Name2ID"}
-	err = wechatCopyDBTables(exMsgDB, P.msgDBs[0].db, tables)
+	err = P.wechatCopyDBTables(exMsgDB, P.msgDBs[0].db, tables)
 	if err != nil {
 		log.Println("wechatCopyDBTables:", err)
 		return err
@@ -1817,7 +2178,7 @@ func (P *WechatDataProvider) weChatExportMsgDBByUserName(userName, exportPath st
 
 	columns := "TalkerId, MsgSvrID, Type, SubType, IsSender, CreateTime, Sequence, StatusEx, FlagEx, Status, MsgServerSeq, MsgSequence, StrTalker, StrContent, DisplayContent, Reserved0, Reserved1, Reserved2, Reserved3, Reserved4, Reserved5, Reserved6, CompressContent, BytesExtra, BytesTrans"
 	for _, msgDB := range P.msgDBs {
-		err = wechatCopyTableData(exMsgDB, msgDB.db, "MSG", columns, "StrTalker", []string{userName})
+		err = P.wechatCopyTableData(exMsgDB, msgDB.db, "MSG", columns, "StrTalker", []string{userName})
 		if err != nil {
 			log.Println("wechatCopyTableData MSG:", err)
 			return err
@@ -1826,7 +2187,7 @@ func (P *WechatDataProvider) weChatExportMsgDBByUserName(userName, exportPath st
 
 	columns = "UsrName"
 	for _, msgDB := range P.msgDBs {
-		err = wechatCopyTableData(exMsgDB, msgDB.db, "Name2ID", columns, "UsrName", []string{userName})
+		err = P.wechatCopyTableData(exMsgDB, msgDB.db, "Name2ID", columns, "UsrName", []string{userName})
 		if err != nil {
 			continue
 		}
@@ -1851,21 +2212,21 @@ func (P *WechatDataProvider) weChatExportUserDataDBByUserName(userName, exportPa
 	defer exUserDataDB.Close()
 
 	tables := []string{"lastTime", "bookMark"}
-	err = wechatCopyDBTables(exUserDataDB, P.userData, tables)
+	err = P.wechatCopyDBTables(exUserDataDB, P.userData, tables)
 	if err != nil {
 		log.Println("wechatCopyDBTables:", err)
 		return err
 	}
 
 	columns := "localId,userName,timestamp,messageId,Reserved0,Reserved1,Reserved2,Reserved3"
-	err = wechatCopyTableData(exUserDataDB, P.userData, "lastTime", columns, "userName", []string{userName})
+	err = P.wechatCopyTableData(exUserDataDB, P.userData, "lastTime", columns, "userName", []string{userName})
 	if err != nil {
 		log.Println("wechatCopyTableData lastTime:", err)
 		return err
 	}
 
 	columns = "localId, userName, markId, tag, info, Reserved0, Reserved1, Reserved2, Reserved3"
-	err = wechatCopyTableData(exUserDataDB, P.userData, "bookMark", columns, "userName", []string{userName})
+	err = P.wechatCopyTableData(exUserDataDB, P.userData, "bookMark", columns, "userName", []string{userName})
 	if err != nil {
 		log.Println("wechatCopyTableData bookMark:", err)
 		return err
@@ -1916,7 +2277,7 @@ func (P *WechatDataProvider) weChatExportOpenIMContactDBByUserName(userName, exp
 	defer exOpenIMContactDB.Close()
 
 	tables := []string{"OpenIMContact"}
-	err = wechatCopyDBTables(exOpenIMContactDB, P.openIMContact, tables)
+	err = P.wechatCopyDBTables(exOpenIMContactDB, P.openIMContact, tables)
 	if err != nil {
 		log.Println("wechatCopyDBTables:", err)
 		return err
@@ -1924,7 +2285,7 @@ func (P *WechatDataProvider) weChatExportOpenIMContactDBByUserName(userName, exp
 
 	copyContactData := func(users []string) error {
 		columns := "UserName, NickName, Type, Remark, BigHeadImgUrl, SmallHeadImgUrl, Source, NickNamePYInit, NickNameQuanPin, RemarkPYInit, RemarkQuanPin, CustomInfoDetail, CustomInfoDetailVisible, AntiSpamTicket, AppId, Sex, DescWordingId, Reserved1, Reserved2, Reserved3, Reserved4, Reserved5, Reserved6, Reserved7, Reserved8, ExtraBuf"
-		err = wechatCopyTableData(exOpenIMContactDB, P.openIMContact, "OpenIMContact", columns, "UserName", users)
+		err = P.wechatCopyTableData(exOpenIMContactDB, P.openIMContact, "OpenIMContact", columns, "UserName", users)
 		if err != nil {
 			log.Println("wechatCopyTableData OpenIMContact:", err)
 			return err
@@ -1951,13 +2312,60 @@ func (P *WechatDataProvider) weChatExportOpenIMContactDBByUserName(userName, exp
 	return nil
 }
 
-func wechatCopyDBTables(dts, src *sql.DB, tables []string) error {
+func (P *WechatDataProvider) weChatExportSidecarDBByUserName(userName, exportPath string) error {
+	if P.sidecar == nil {
+		log.Println("not sidecar db")
+		return nil
+	}
+
+	// the Sidecar.db of an earlier export is merged into
+	exSidecarDBPath := exportPath + "\\" + SidecarDB
+	exSidecarDB := openSidecarDB(exSidecarDBPath)
+	if exSidecarDB == nil {
+		return errors.New("open " + exSidecarDBPath + " failed")
+	}
+	defer exSidecarDB.Close()
+
+	msgSvrIDs := make([]string, 0)
+	for _, msgDB := range P.msgDBs {
+		querySql := "select MsgSvrID from MSG where StrTalker=? And Type=?;"
+		rows, err := P.wechatQuery(msgDB.db, querySql, userName, Wechat_Message_Type_Voice)
+		if err != nil {
+			log.Printf("%s failed %v\n", querySql, err)
+			continue
+		}
+
+		var msgSvrID int64
+		for rows.Next() {
+			if err := rows.Scan(&msgSvrID); err != nil {
+				log.Println("rows.Scan failed", err)
+				continue
+			}
+			msgSvrIDs = append(msgSvrIDs, strconv.FormatInt(msgSvrID, 10))
+			// voices never shown before have no info yet
+			if _, err := P.wechatGetVoiceInfo(msgSvrID); err != nil {
+				P.wechatSaveMessageVoiceInfo(msgSvrID)
+			}
+		}
+		rows.Close()
+	}
+
+	columns := "MsgSvrID, duration, waveform"
+	err := P.wechatCopyTableData(exSidecarDB, P.sidecar, "voiceInfo", columns, "MsgSvrID", msgSvrIDs)
+	if err != nil {
+		log.Println("wechatCopyTableData voiceInfo:", err)
+		return err
+	}
+
+	return nil
+}
+
+func (P *WechatDataProvider) wechatCopyDBTables(dts, src *sql.DB, tables []string) error {
 	for _, tab := range tables {
-		querySql := fmt.Sprintf("SELECT sql FROM sqlite_master WHERE tbl_name='%s';", tab)
+		querySql := "SELECT sql FROM sqlite_master WHERE tbl_name=?;"
 		// log.Println("querySql:", querySql)
-		rows, err := src.Query(querySql)
+		rows, err := P.wechatQuery(src, querySql, tab)
 		if err != nil {
-			rows.Close()
 			log.Println("src.Query", err)
 			continue
 		}
@@ -1995,18 +2403,10 @@ func wechatCopyDBTables(dts, src *sql.DB, tables []string) error {
 	return nil
 }
 
-func wechatCopyTableData(dts, src *sql.DB, tableName, columns, conditionField string, conditionValue []string) error {
-	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s = '%s'", columns, tableName, conditionField, conditionValue[0])
-	if len(conditionValue) > 1 {
-		query = fmt.Sprintf("SELECT %s FROM %s WHERE %s IN ('%s')", columns, tableName, conditionField, strings.Join(conditionValue, "','"))
-	}
-	// log.Println("query:", query)
-	rows, err := src.Query(query)
-	if err != nil {
-		return fmt.Errorf("query src failed: %v", err)
-	}
-	defer rows.Close()
-
+// wechatCopyTableData copies the rows whose conditionField is one of
+// conditionValue, the values are bound in chunks of copyChunkSize so only
+// a few statements of each table end up in the statement cache.
+func (P *WechatDataProvider) wechatCopyTableData(dts, src *sql.DB, tableName, columns, conditionField string, conditionValue []string) (err error) {
 	tx, err := dts.Begin()
 	if err != nil {
 		return fmt.Errorf("dts.Begin failed: %v", err)
@@ -2014,15 +2414,13 @@ func wechatCopyTableData(dts, src *sql.DB, tableName, columns, conditionField st
 	defer func() {
 		if err != nil {
 			tx.Rollback()
-		} else {
-			tx.Commit()
+		} else if err = tx.Commit(); err != nil {
+			err = fmt.Errorf("tx.Commit failed: %v", err)
 		}
 	}()
 
 	columnList := strings.Split(columns, ",")
-	placeholders := strings.Repeat("?, ", len(columnList))
-	placeholders = placeholders[:len(placeholders)-2]
-	insertQuery := fmt.Sprintf("INSERT OR IGNORE INTO %s (%s) VALUES (%s)", tableName, columns, placeholders)
+	insertQuery := fmt.Sprintf("INSERT OR IGNORE INTO %s (%s) VALUES (%s)", tableName, columns, sqlPlaceholders(len(columnList)))
 	// log.Println("wechatCopyTableData:", insertQuery)
 	stmt, err := tx.Prepare(insertQuery)
 	if err != nil {
@@ -2030,9 +2428,28 @@ func wechatCopyTableData(dts, src *sql.DB, tableName, columns, conditionField st
 	}
 	defer stmt.Close()
 
+	for i := 0; i < len(conditionValue); i += copyChunkSize {
+		end := min(i+copyChunkSize, len(conditionValue))
+		query := fmt.Sprintf("SELECT %s FROM %s WHERE %s IN (%s)", columns, tableName, conditionField, sqlPlaceholders(end-i))
+		// log.Println("query:", query)
+		if err = P.wechatCopyRows(stmt, src, query, stringsToArgs(conditionValue[i:end]), len(columnList)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (P *WechatDataProvider) wechatCopyRows(stmt *sql.Stmt, src *sql.DB, query string, args []interface{}, columnNum int) error {
+	rows, err := P.wechatQuery(src, query, args...)
+	if err != nil {
+		return fmt.Errorf("query src failed: %v", err)
+	}
+	defer rows.Close()
+
 	for rows.Next() {
-		values := make([]interface{}, len(columnList))
-		valuePtrs := make([]interface{}, len(columnList))
+		values := make([]interface{}, columnNum)
+		valuePtrs := make([]interface{}, columnNum)
 		for i := range values {
 			valuePtrs[i] = &values[i]
 		}
@@ -2046,7 +2463,7 @@ func wechatCopyTableData(dts, src *sql.DB, tableName, columns, conditionField st
 		}
 	}
 
-	return nil
+	return rows.Err()
 }
 
 func (P *WechatDataProvider) WeChatExportFileByUserName(userName, exportPath string) error {
@@ -2054,7 +2471,7 @@ func (P *WechatDataProvider) WeChatExportFileByUserName(userName, exportPath str
 	topDir := filepath.Dir(P.resPath)
 	topDir = filepath.Dir(topDir)
 	pageSize := 600
-	_time := time.Now().Unix()
+	cursor := ""
 	taskChan := make(chan [2]string, 100)
 	var wg sync.WaitGroup
 
@@ -2090,47 +2507,15 @@ func (P *WechatDataProvider) WeChatExportFileByUserName(userName, exportPath str
 	}
 
 	for {
-		mlist, err := P.WeChatGetMessageListByTime(userName, _time, pageSize, Message_Search_Forward)
+		mlist, err := P.WeChatGetMessageListByCursor(userName, cursor, pageSize, Message_Search_Forward, nil)
 		if err != nil {
 			return err
 		}
 
 		paths := make([]string, 0)
-		for _, m := range mlist.Rows {
-			switch m.Type {
-			case Wechat_Message_Type_Picture:
-				paths = append(paths, m.ThumbPath, m.ImagePath)
-			case Wechat_Message_Type_Voice:
-				paths = append(paths, m.VoicePath)
-			case Wechat_Message_Type_Visit_Card:
-				paths = append(paths, m.VisitInfo.LocalHeadImgUrl)
-			case Wechat_Message_Type_Video:
-				paths = append(paths, m.ThumbPath, m.VideoPath)
-			case Wechat_Message_Type_Location:
-				paths = append(paths, m.LocationInfo.ThumbPath)
-			case Wechat_Message_Type_Misc:
-				switch m.SubType {
-				case Wechat_Misc_Message_Music:
-					paths = append(paths, m.MusicInfo.ThumbPath)
-				case Wechat_Misc_Message_ThirdVideo:
-					paths = append(paths, m.ThumbPath)
-				case Wechat_Misc_Message_CardLink:
-					paths = append(paths, m.ThumbPath)
-				case Wechat_Misc_Message_File:
-					paths = append(paths, m.FileInfo.FilePath)
-				case Wechat_Misc_Message_Applet:
-					paths = append(paths, m.ThumbPath)
-				case Wechat_Misc_Message_Applet2:
-					paths = append(paths, m.ThumbPath)
-				case Wechat_Misc_Message_Channels:
-					paths = append(paths, m.ChannelsInfo.ThumbPath)
-				case Wechat_Misc_Message_Live:
-					paths = append(paths, m.ChannelsInfo.ThumbPath)
-				case Wechat_Misc_Message_Game:
-					paths = append(paths, m.ThumbPath)
-				case Wechat_Misc_Message_TingListen:
-					paths = append(paths, m.MusicInfo.ThumbPath)
-				}
+		for i := range mlist.Rows {
+			for _, media := range messageMediaFiles(&mlist.Rows[i]) {
+				paths = append(paths, media.path)
 			}
 		}
 
@@ -2141,7 +2526,7 @@ func (P *WechatDataProvider) WeChatExportFileByUserName(userName, exportPath str
 		if mlist.Total < pageSize {
 			break
 		}
-		_time = mlist.Rows[mlist.Total-1].CreateTime - 1
+		cursor = mlist.NextCursor
 	}
 	log.Println("message file done")
 	//copy HeadImage
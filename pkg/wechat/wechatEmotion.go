@@ -0,0 +1,165 @@
+package wechat
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"wechatDataBackup/pkg/utils"
+)
+
+const (
+	EmotionDB = "Emotion.db"
+)
+
+type wechatEmotionMSG struct {
+	MD5 string
+	Buf []byte
+}
+
+// exportWeChatEmotion writes the stickers kept inside Emotion.db to
+// FileStorage\Emotion\<md5>.<ext> so they can be shown offline.
+func exportWeChatEmotion(info WeChatInfo, expPath string, progress chan<- string) {
+	progress <- "{\"status\":\"processing\", \"result\":\"export WeChat Emotion start\", \"progress\": 96}"
+
+	emotionPath := fmt.Sprintf("%s\\FileStorage\\Emotion", expPath)
+	if _, err := os.Stat(emotionPath); err != nil {
+		if err := os.MkdirAll(emotionPath, 0644); err != nil {
+			log.Printf("MkdirAll %s failed: %v\n", emotionPath, err)
+			progress <- fmt.Sprintf("{\"status\":\"error\", \"result\":\"%v error\"}", err)
+			return
+		}
+	}
+
+	emotionDBPath := fmt.Sprintf("%s\\Msg\\%s", expPath, EmotionDB)
+	if _, err := os.Stat(emotionDBPath); err != nil {
+		log.Println("no exist:", emotionDBPath)
+		progress <- "{\"status\":\"processing\", \"result\":\"export WeChat Emotion end\", \"progress\": 100}"
+		return
+	}
+
+	handleNumber := int64(0)
+	var wg sync.WaitGroup
+	MSGChan := make(chan wechatEmotionMSG, 100)
+	go func() {
+		defer close(MSGChan)
+		db, err := sql.Open("sqlite3", emotionDBPath)
+		if err != nil {
+			log.Printf("open %s failed: %v\n", emotionDBPath, err)
+			return
+		}
+		defer db.Close()
+
+		rows, err := db.Query("select ifnull(MD5,''), Data from EmotionItem where length(Data) > 0;")
+		if err != nil {
+			log.Printf("Query failed: %v\n", err)
+			return
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			msg := wechatEmotionMSG{}
+			err := rows.Scan(&msg.MD5, &msg.Buf)
+			if err != nil {
+				log.Println("Scan failed: ", err)
+				break
+			}
+
+			MSGChan <- msg
+		}
+	}()
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for msg := range MSGChan {
+				atomic.AddInt64(&handleNumber, 1)
+				ext := utils.GetImageExt(msg.Buf)
+				if len(msg.MD5) == 0 || ext == "" {
+					continue
+				}
+
+				emotionFile := fmt.Sprintf("%s\\%s%s", emotionPath, strings.ToLower(msg.MD5), ext)
+				if _, err := os.Stat(emotionFile); err == nil {
+					continue
+				}
+
+				if err := os.WriteFile(emotionFile, msg.Buf, 0666); err != nil {
+					log.Println("WriteFile:", emotionFile, err)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	log.Println("WeChat Emotion number:", handleNumber)
+	progress <- "{\"status\":\"processing\", \"result\":\"export WeChat Emotion end\", \"progress\": 100}"
+}
+
+type wechatEmotionCache struct {
+	once  sync.Once
+	files map[string]string
+}
+
+// load indexes FileStorage\Emotion once, mapping the md5 to the file name.
+func (c *wechatEmotionCache) load(resPath string) {
+	c.once.Do(func() {
+		c.files = make(map[string]string)
+		emotionPath := fmt.Sprintf("%s\\FileStorage\\Emotion", resPath)
+		entries, err := os.ReadDir(emotionPath)
+		if err != nil {
+			return
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			name := entry.Name()
+			md5 := strings.TrimSuffix(name, filepath.Ext(name))
+			c.files[strings.ToLower(md5)] = name
+		}
+		log.Println("Emotion cache number:", len(c.files))
+	})
+}
+
+// wechatGetEmojiLocalPath looks for the sticker md5 in the exported
+// Emotion.db stickers and in the CustomEmotion cache of WeChat.
+func (P *WechatDataProvider) wechatGetEmojiLocalPath(md5 string) string {
+	if len(md5) < 2 {
+		return ""
+	}
+
+	P.emotionCache.load(P.resPath)
+	if name, ok := P.emotionCache.files[strings.ToLower(md5)]; ok {
+		return fmt.Sprintf("%s\\FileStorage\\Emotion\\%s", P.prefixResPath, name)
+	}
+
+	for _, name := range []string{strings.ToUpper(md5), strings.ToLower(md5)} {
+		customPath := fmt.Sprintf("FileStorage\\CustomEmotion\\%s\\%s", name[:2], name)
+		if isImageFile(P.resPath + "\\" + customPath) {
+			return P.prefixResPath + "\\" + customPath
+		}
+	}
+
+	return ""
+}
+
+// isImageFile reports whether path exists and starts like an image, newer
+// WeChat versions keep some caches encrypted.
+func isImageFile(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, _ := f.Read(head)
+	return utils.GetImageExt(head[:n]) != ""
+}
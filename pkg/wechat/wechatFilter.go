@@ -0,0 +1,215 @@
+package wechat
+
+import (
+	"log"
+	"slices"
+	"strings"
+)
+
+// MessageFilter selects messages of a session, zero values match
+// everything. SubTypes only restricts Misc (type 49) messages, so
+// Types [3, 49] with SubTypes [6] selects pictures and files.
+// StartDate and EndDate are "2006-01-02" days in the configured time zone,
+// both included. SystemKinds selects system messages by SystemInfo.Kind.
+type MessageFilter struct {
+	Types     []int  `json:"Types"`
+	SubTypes  []int  `json:"SubTypes"`
+	Sender    string `json:"Sender"`
+	StartTime int64  `json:"StartTime"`
+	EndTime   int64  `json:"EndTime"`
+	StartDate string `json:"StartDate"`
+	EndDate   string `json:"EndDate"`
+	KeyWord   string `json:"KeyWord"`
+	IsSender  *int   `json:"IsSender"`
+	HasMedia  bool   `json:"HasMedia"`
+
+	SystemKinds []string `json:"SystemKinds"`
+}
+
+// MessageFilterFromLegacy converts the type strings used by the frontend,
+// e.g. "文件" or "群成员<wxid>", into a MessageFilter.
+func MessageFilterFromLegacy(msgType string) *MessageFilter {
+	filter := &MessageFilter{}
+	switch msgType {
+	case "":
+	case "文件":
+		filter.Types = []int{Wechat_Message_Type_Misc}
+		filter.SubTypes = []int{Wechat_Misc_Message_File}
+	case "图片与视频":
+		filter.Types = []int{Wechat_Message_Type_Picture, Wechat_Message_Type_Video}
+	case "链接":
+		filter.Types = []int{Wechat_Message_Type_Misc}
+		filter.SubTypes = []int{Wechat_Misc_Message_CardLink, Wechat_Misc_Message_ThirdVideo}
+	case "语音":
+		filter.Types = []int{Wechat_Message_Type_Voice}
+	case "通话":
+		filter.Types = []int{Wechat_Message_Type_Voip}
+	default:
+		if strings.HasPrefix(msgType, "群成员") {
+			filter.Sender = msgType[len("群成员"):]
+		} else {
+			// unknown type matches nothing, as before
+			filter.Types = []int{-1}
+		}
+	}
+
+	return filter
+}
+
+func (f *MessageFilter) IsEmpty() bool {
+	return f == nil || (len(f.Types) == 0 && len(f.SubTypes) == 0 && f.Sender == "" && f.StartTime == 0 &&
+		f.EndTime == 0 && f.StartDate == "" && f.EndDate == "" && f.KeyWord == "" && f.IsSender == nil && !f.HasMedia &&
+		len(f.SystemKinds) == 0)
+}
+
+// timeRange returns the CreateTime range of the filter, 0 for no bound.
+func (f *MessageFilter) timeRange() (int64, int64) {
+	if f.IsEmpty() {
+		return 0, 0
+	}
+
+	start, end := f.StartTime, f.EndTime
+	if len(f.StartDate) > 0 {
+		if t, err := parseLocalDate(f.StartDate); err == nil {
+			start = max(start, t)
+		} else {
+			log.Println("invalid StartDate:", f.StartDate, err)
+		}
+	}
+
+	if len(f.EndDate) > 0 {
+		if t, err := parseLocalDate(f.EndDate); err == nil {
+			// the end of the day, DST days are not 24 hours long
+			t = localTime(t).AddDate(0, 0, 1).Unix() - 1
+			if end == 0 || t < end {
+				end = t
+			}
+		} else {
+			log.Println("invalid EndDate:", f.EndDate, err)
+		}
+	}
+
+	return start, end
+}
+
+// needMatch reports whether match has to check the parsed messages.
+func (f *MessageFilter) needMatch() bool {
+	return !f.IsEmpty() && (len(f.Sender) > 0 || len(f.KeyWord) > 0 || len(f.SystemKinds) > 0)
+}
+
+func intsToArgs(values []int) []interface{} {
+	args := make([]interface{}, len(values))
+	for i, v := range values {
+		args[i] = v
+	}
+
+	return args
+}
+
+// sqlCondition returns the " And ..." clauses of the MSG query for the
+// session userName. The sender and keyword clauses only narrow the rows
+// down, match does the exact check after parsing.
+func (f *MessageFilter) sqlCondition(userName, selfName string) (string, []interface{}) {
+	if f.IsEmpty() {
+		return "", nil
+	}
+
+	conditions := make([]string, 0)
+	args := make([]interface{}, 0)
+
+	if len(f.Types) > 0 {
+		conditions = append(conditions, "Type in ("+sqlPlaceholders(len(f.Types))+")")
+		args = append(args, intsToArgs(f.Types)...)
+	}
+
+	if len(f.SubTypes) > 0 {
+		conditions = append(conditions, "(Type!=? OR SubType in ("+sqlPlaceholders(len(f.SubTypes))+"))")
+		args = append(args, Wechat_Message_Type_Misc)
+		args = append(args, intsToArgs(f.SubTypes)...)
+	}
+
+	startTime, endTime := f.timeRange()
+	if startTime > 0 {
+		conditions = append(conditions, "CreateTime>=?")
+		args = append(args, startTime)
+	}
+
+	if endTime > 0 {
+		conditions = append(conditions, "CreateTime<=?")
+		args = append(args, endTime)
+	}
+
+	if f.IsSender != nil {
+		conditions = append(conditions, "IsSender=?")
+		args = append(args, *f.IsSender)
+	}
+
+	if len(f.Sender) > 0 {
+		if f.Sender == selfName {
+			conditions = append(conditions, "IsSender=1")
+		} else if strings.HasSuffix(userName, "@chatroom") {
+			conditions = append(conditions, "IsSender=0 And instr(BytesExtra, ?)>0")
+			args = append(args, []byte(f.Sender))
+		} else if f.Sender == userName {
+			conditions = append(conditions, "IsSender=0")
+		} else {
+			conditions = append(conditions, "0")
+		}
+	}
+
+	if len(f.SystemKinds) > 0 {
+		conditions = append(conditions, "Type in (?, ?)")
+		args = append(args, Wechat_Message_Type_System, Wechat_Message_Type_SysMsg)
+	}
+
+	if f.HasMedia {
+		conditions = append(conditions, "(Type in (?, ?, ?, ?) OR (Type=? And SubType=?))")
+		args = append(args, Wechat_Message_Type_Picture, Wechat_Message_Type_Voice, Wechat_Message_Type_Video,
+			Wechat_Message_Type_Emoji, Wechat_Message_Type_Misc, Wechat_Misc_Message_File)
+	}
+
+	if len(f.KeyWord) > 0 {
+		// Misc messages keep their text in the compressed content
+		conditions = append(conditions, "(Type=? OR (Type in (?, ?) And StrContent LIKE ? ESCAPE '\\'))")
+		args = append(args, Wechat_Message_Type_Misc, Wechat_Message_Type_Text, Wechat_Message_Type_Location,
+			"%"+sqlLikeEscape(f.KeyWord)+"%")
+	}
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+
+	return " And " + strings.Join(conditions, " And "), args
+}
+
+func messageSenderName(msg *WeChatMessage, selfName string) string {
+	if msg.IsSender == 1 {
+		return selfName
+	} else if msg.IsChatRoom {
+		return msg.UserInfo.UserName
+	}
+
+	return msg.Talker
+}
+
+// match does the checks sqlCondition can not do exactly on a parsed
+// message.
+func (f *MessageFilter) match(msg *WeChatMessage, selfName string) bool {
+	if f.IsEmpty() {
+		return true
+	}
+
+	if len(f.Sender) > 0 && messageSenderName(msg, selfName) != f.Sender {
+		return false
+	}
+
+	if len(f.KeyWord) > 0 && !weChatMessageContains(msg, f.KeyWord) {
+		return false
+	}
+
+	if len(f.SystemKinds) > 0 && !slices.Contains(f.SystemKinds, msg.SystemInfo.Kind) {
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,86 @@
+package wechat
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMessageFilterSqlCondition(t *testing.T) {
+	defer SetTimeZone(GetTimeZone())
+	if err := SetTimeZone("UTC"); err != nil {
+		t.Fatalf("SetTimeZone failed: %v", err)
+	}
+
+	isSender := 0
+	tests := []struct {
+		name      string
+		filter    *MessageFilter
+		userName  string
+		condition string
+		args      []interface{}
+	}{
+		{"nil", nil, "wxid_a", "", nil},
+		{"empty", &MessageFilter{}, "wxid_a", "", nil},
+		{"types", &MessageFilter{Types: []int{3, 49}, SubTypes: []int{6}}, "wxid_a",
+			" And Type in (?, ?) And (Type!=? OR SubType in (?))", []interface{}{3, 49, 49, 6}},
+		{"dates", &MessageFilter{StartDate: "2024-01-01", EndDate: "2024-01-01"}, "wxid_a",
+			" And CreateTime>=? And CreateTime<=?", []interface{}{int64(1704067200), int64(1704153599)}},
+		{"end time before end date", &MessageFilter{EndTime: 1704067300, EndDate: "2024-01-01"}, "wxid_a",
+			" And CreateTime<=?", []interface{}{int64(1704067300)}},
+		{"invalid date", &MessageFilter{StartDate: "yesterday"}, "wxid_a", "", nil},
+		{"is sender", &MessageFilter{IsSender: &isSender}, "wxid_a", " And IsSender=?", []interface{}{0}},
+		{"self sender", &MessageFilter{Sender: "wxid_self"}, "wxid_a", " And IsSender=1", nil},
+		{"chat room sender", &MessageFilter{Sender: "wxid_b"}, "1@chatroom",
+			" And IsSender=0 And instr(BytesExtra, ?)>0", []interface{}{[]byte("wxid_b")}},
+		{"contact sender", &MessageFilter{Sender: "wxid_a"}, "wxid_a", " And IsSender=0", nil},
+		{"other sender", &MessageFilter{Sender: "wxid_b"}, "wxid_a", " And 0", nil},
+		{"system kinds", &MessageFilter{SystemKinds: []string{SystemMessagePat}}, "wxid_a",
+			" And Type in (?, ?)", []interface{}{Wechat_Message_Type_System, Wechat_Message_Type_SysMsg}},
+		{"keyword", &MessageFilter{KeyWord: "50%_off"}, "wxid_a",
+			" And (Type=? OR (Type in (?, ?) And StrContent LIKE ? ESCAPE '\\'))",
+			[]interface{}{Wechat_Message_Type_Misc, Wechat_Message_Type_Text, Wechat_Message_Type_Location, `%50\%\_off%`}},
+	}
+
+	for _, test := range tests {
+		condition, args := test.filter.sqlCondition(test.userName, "wxid_self")
+		if len(args) == 0 {
+			args = nil
+		}
+		if condition != test.condition || !reflect.DeepEqual(args, test.args) {
+			t.Errorf("%s: sqlCondition = %q %v, want %q %v", test.name, condition, args, test.condition, test.args)
+		}
+	}
+}
+
+func TestMessageFilterMatch(t *testing.T) {
+	text := &WeChatMessage{Type: Wechat_Message_Type_Text, Content: "hello world", Talker: "wxid_a"}
+	sent := &WeChatMessage{Type: Wechat_Message_Type_Text, Content: "hi", IsSender: 1, Talker: "wxid_a"}
+	member := &WeChatMessage{Type: Wechat_Message_Type_Text, Content: "hey", Talker: "1@chatroom", IsChatRoom: true,
+		UserInfo: WeChatUserInfo{UserName: "wxid_b"}}
+	pat := &WeChatMessage{Type: Wechat_Message_Type_System, SystemInfo: SystemInfo{Kind: SystemMessagePat}}
+
+	tests := []struct {
+		name   string
+		filter *MessageFilter
+		msg    *WeChatMessage
+		want   bool
+	}{
+		{"nil", nil, text, true},
+		{"keyword", &MessageFilter{KeyWord: "world"}, text, true},
+		{"keyword miss", &MessageFilter{KeyWord: "moon"}, text, false},
+		{"contact sender", &MessageFilter{Sender: "wxid_a"}, text, true},
+		{"self sender", &MessageFilter{Sender: "wxid_self"}, sent, true},
+		{"self sender miss", &MessageFilter{Sender: "wxid_self"}, text, false},
+		{"member sender", &MessageFilter{Sender: "wxid_b"}, member, true},
+		{"member sender miss", &MessageFilter{Sender: "wxid_c"}, member, false},
+		{"system kind", &MessageFilter{SystemKinds: []string{SystemMessagePat, SystemMessageRecall}}, pat, true},
+		{"system kind miss", &MessageFilter{SystemKinds: []string{SystemMessageJoin}}, pat, false},
+		{"sql only", &MessageFilter{Types: []int{3}}, text, true},
+	}
+
+	for _, test := range tests {
+		if got := test.filter.match(test.msg, "wxid_self"); got != test.want {
+			t.Errorf("%s: match = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
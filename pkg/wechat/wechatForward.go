@@ -0,0 +1,200 @@
+package wechat
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+)
+
+// dataitem datatype of a recordinfo
+const (
+	forwardRecordText     = 1
+	forwardRecordImage    = 2
+	forwardRecordVoice    = 3
+	forwardRecordVideo    = 4
+	forwardRecordLink     = 5
+	forwardRecordLocation = 6
+	forwardRecordFile     = 8
+	forwardRecordNested   = 17
+)
+
+// how long the record files of a talker are trusted before the tree is
+// walked again, records may be exported or downloaded at any time
+const recordMediaCheckInterval = 30 * time.Second
+
+type recordMedia struct {
+	files  map[string]string
+	walked time.Time
+}
+
+type ForwardRecord struct {
+	DataType   int             `json:"DataType"`
+	SourceName string          `json:"SourceName"`
+	SourceTime string          `json:"SourceTime"`
+	CreateTime int64           `json:"CreateTime"`
+	HeadImgUrl string          `json:"HeadImgUrl"`
+	Text       string          `json:"Text"`
+	Title      string          `json:"Title"`
+	Url        string          `json:"Url"`
+	FileExt    string          `json:"FileExt"`
+	FileSize   int64           `json:"FileSize"`
+	ThumbPath  string          `json:"ThumbPath"`
+	ImagePath  string          `json:"ImagePath"`
+	VideoPath  string          `json:"VideoPath"`
+	FilePath   string          `json:"FilePath"`
+	Records    []ForwardRecord `json:"Records"`
+}
+
+type ForwardInfo struct {
+	Title       string          `json:"Title"`
+	Description string          `json:"Description"`
+	Records     []ForwardRecord `json:"Records"`
+}
+
+// wechatRecordMedia returns the files saved for the forwarded records of
+// talker, FileStorage\MsgAttach\<md5(talker)>\Rec, by file name with and
+// without extension. The tree is walked again once the last walk is older
+// than recordMediaCheckInterval.
+func (P *WechatDataProvider) wechatRecordMedia(talker string) map[string]string {
+	if cached, ok := P.recordMediaCache.Load(talker); ok {
+		if cached := cached.(*recordMedia); time.Since(cached.walked) < recordMediaCheckInterval {
+			return cached.files
+		}
+	}
+
+	sum := md5.Sum([]byte(talker))
+	recPath := fmt.Sprintf("%s\\FileStorage\\MsgAttach\\%s\\Rec", P.resPath, hex.EncodeToString(sum[:]))
+	walked := time.Now()
+	media := make(map[string]string)
+	filepath.WalkDir(recPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+
+		name := d.Name()
+		relPath := P.prefixResPath + path[len(P.resPath):]
+		media[name] = relPath
+		if ext := filepath.Ext(name); len(ext) > 0 {
+			if _, ok := media[strings.TrimSuffix(name, ext)]; !ok {
+				media[strings.TrimSuffix(name, ext)] = relPath
+			}
+		}
+		return nil
+	})
+	P.recordMediaCache.Store(talker, &recordMedia{files: media, walked: walked})
+
+	return media
+}
+
+func elementValue(e *etree.Element, path string) string {
+	if item := e.FindElement(path); item != nil {
+		return item.Text()
+	}
+
+	return ""
+}
+
+// parseForwardRecords parses the datalist of a recordinfo, nested records
+// are parsed the same way.
+func parseForwardRecords(recordInfo *etree.Element, media map[string]string) []ForwardRecord {
+	records := make([]ForwardRecord, 0)
+	dataList := recordInfo.FindElement("datalist")
+	if dataList == nil {
+		return records
+	}
+
+	for _, item := range dataList.SelectElements("dataitem") {
+		record := ForwardRecord{}
+		record.DataType, _ = strconv.Atoi(item.SelectAttrValue("datatype", "0"))
+		record.SourceName = elementValue(item, "sourcename")
+		record.SourceTime = elementValue(item, "sourcetime")
+		record.CreateTime, _ = strconv.ParseInt(elementValue(item, "srcMsgCreateTime"), 10, 64)
+		record.HeadImgUrl = elementValue(item, "sourceheadurl")
+		record.Text = elementValue(item, "datadesc")
+		record.Title = elementValue(item, "datatitle")
+		record.Url = elementValue(item, "link")
+		record.FileExt = elementValue(item, "datafmt")
+		record.FileSize, _ = strconv.ParseInt(elementValue(item, "datasize"), 10, 64)
+		record.Records = make([]ForwardRecord, 0)
+
+		dataId := item.SelectAttrValue("dataid", "")
+		switch record.DataType {
+		case forwardRecordImage:
+			record.ImagePath = media[dataId]
+			record.ThumbPath = media[dataId+"_t"]
+		case forwardRecordVideo:
+			record.VideoPath = media[dataId]
+			record.ThumbPath = media[dataId+"_t"]
+		case forwardRecordFile:
+			// files are saved by dataid, older versions kept the title
+			record.FilePath = media[dataId]
+			if len(record.FilePath) == 0 {
+				record.FilePath = media[record.Title]
+			}
+		case forwardRecordLink:
+			record.ThumbPath = media[dataId+"_t"]
+		case forwardRecordNested:
+			if nested := item.FindElement("recordxml/recordinfo"); nested != nil {
+				record.Records = parseForwardRecords(nested, media)
+			} else if recordXml := elementValue(item, "recordxml"); len(recordXml) > 0 {
+				doc := etree.NewDocument()
+				if err := doc.ReadFromString(recordXml); err == nil && doc.SelectElement("recordinfo") != nil {
+					record.Records = parseForwardRecords(doc.SelectElement("recordinfo"), media)
+				}
+			}
+		}
+
+		records = append(records, record)
+	}
+
+	return records
+}
+
+// wechatMessageForwardHandle parses the recorditem of a merged forward
+// message, root is its uncompressed content.
+func (P *WechatDataProvider) wechatMessageForwardHandle(msg *WeChatMessage, root *xmlDocument) {
+	msg.ForwardInfo.Title = root.FindElementValue("/msg/appmsg/title")
+	msg.ForwardInfo.Description = root.FindElementValue("/msg/appmsg/des")
+	msg.ForwardInfo.Records = make([]ForwardRecord, 0)
+
+	recordItem := root.FindElementValue("/msg/appmsg/recorditem")
+	if len(recordItem) == 0 {
+		return
+	}
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromString(recordItem); err != nil {
+		log.Println("recorditem ReadFromString failed:", err)
+		return
+	}
+
+	recordInfo := doc.SelectElement("recordinfo")
+	if recordInfo == nil {
+		return
+	}
+	msg.ForwardInfo.Records = parseForwardRecords(recordInfo, P.wechatRecordMedia(msg.Talker))
+}
+
+// forwardRecordPaths returns the local media paths of records and their
+// nested records.
+func forwardRecordPaths(records []ForwardRecord) []string {
+	paths := make([]string, 0)
+	for _, record := range records {
+		for _, path := range []string{record.ThumbPath, record.ImagePath, record.VideoPath, record.FilePath} {
+			if len(path) > 0 {
+				paths = append(paths, path)
+			}
+		}
+		paths = append(paths, forwardRecordPaths(record.Records)...)
+	}
+
+	return paths
+}
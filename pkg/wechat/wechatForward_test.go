@@ -0,0 +1,82 @@
+package wechat
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/beevik/etree"
+)
+
+func TestParseForwardRecords(t *testing.T) {
+	media := map[string]string{
+		"img1":       "Rec/img1.jpg",
+		"img1_t":     "Rec/img1_t.jpg",
+		"vid1":       "Rec/vid1.mp4",
+		"vid1_t":     "Rec/vid1_t.jpg",
+		"file1":      "Rec/file1.pdf",
+		"report.pdf": "Rec/report.pdf",
+		"old.docx":   "Rec/old.docx",
+		"link1_t":    "Rec/link1_t.jpg",
+	}
+
+	tests := []struct {
+		name string
+		xml  string
+		want []ForwardRecord
+	}{
+		{"no datalist", `<recordinfo></recordinfo>`, []ForwardRecord{}},
+		{"text", `<recordinfo><datalist>
+			<dataitem datatype="1"><sourcename>Alice</sourcename><sourcetime>2024-01-01 10:00</sourcetime>
+			<srcMsgCreateTime>1704074400</srcMsgCreateTime><datadesc>hello</datadesc></dataitem>
+			</datalist></recordinfo>`,
+			[]ForwardRecord{{DataType: forwardRecordText, SourceName: "Alice", SourceTime: "2024-01-01 10:00",
+				CreateTime: 1704074400, Text: "hello", Records: []ForwardRecord{}}}},
+		{"image and video", `<recordinfo><datalist>
+			<dataitem datatype="2" dataid="img1"></dataitem>
+			<dataitem datatype="4" dataid="vid1"></dataitem>
+			<dataitem datatype="2" dataid="missing"></dataitem>
+			</datalist></recordinfo>`,
+			[]ForwardRecord{
+				{DataType: forwardRecordImage, ImagePath: "Rec/img1.jpg", ThumbPath: "Rec/img1_t.jpg", Records: []ForwardRecord{}},
+				{DataType: forwardRecordVideo, VideoPath: "Rec/vid1.mp4", ThumbPath: "Rec/vid1_t.jpg", Records: []ForwardRecord{}},
+				{DataType: forwardRecordImage, Records: []ForwardRecord{}},
+			}},
+		{"file by dataid before title", `<recordinfo><datalist>
+			<dataitem datatype="8" dataid="file1"><datatitle>report.pdf</datatitle><datafmt>pdf</datafmt><datasize>1024</datasize></dataitem>
+			</datalist></recordinfo>`,
+			[]ForwardRecord{{DataType: forwardRecordFile, Title: "report.pdf", FileExt: "pdf", FileSize: 1024,
+				FilePath: "Rec/file1.pdf", Records: []ForwardRecord{}}}},
+		{"file by title", `<recordinfo><datalist>
+			<dataitem datatype="8" dataid="file2"><datatitle>old.docx</datatitle></dataitem>
+			</datalist></recordinfo>`,
+			[]ForwardRecord{{DataType: forwardRecordFile, Title: "old.docx", FilePath: "Rec/old.docx", Records: []ForwardRecord{}}}},
+		{"link", `<recordinfo><datalist>
+			<dataitem datatype="5" dataid="link1"><datatitle>News</datatitle><link>https://example.com</link></dataitem>
+			</datalist></recordinfo>`,
+			[]ForwardRecord{{DataType: forwardRecordLink, Title: "News", Url: "https://example.com",
+				ThumbPath: "Rec/link1_t.jpg", Records: []ForwardRecord{}}}},
+		{"nested element", `<recordinfo><datalist>
+			<dataitem datatype="17"><recordxml><recordinfo><datalist>
+			<dataitem datatype="1"><datadesc>inner</datadesc></dataitem>
+			</datalist></recordinfo></recordxml></dataitem>
+			</datalist></recordinfo>`,
+			[]ForwardRecord{{DataType: forwardRecordNested, Records: []ForwardRecord{
+				{DataType: forwardRecordText, Text: "inner", Records: []ForwardRecord{}}}}}},
+		{"nested escaped", `<recordinfo><datalist>
+			<dataitem datatype="17"><recordxml>&lt;recordinfo&gt;&lt;datalist&gt;&lt;dataitem datatype="2" dataid="img1"&gt;&lt;/dataitem&gt;&lt;/datalist&gt;&lt;/recordinfo&gt;</recordxml></dataitem>
+			</datalist></recordinfo>`,
+			[]ForwardRecord{{DataType: forwardRecordNested, Records: []ForwardRecord{
+				{DataType: forwardRecordImage, ImagePath: "Rec/img1.jpg", ThumbPath: "Rec/img1_t.jpg", Records: []ForwardRecord{}}}}}},
+	}
+
+	for _, test := range tests {
+		doc := etree.NewDocument()
+		if err := doc.ReadFromString(test.xml); err != nil {
+			t.Fatalf("%s: ReadFromString: %v", test.name, err)
+		}
+		got := parseForwardRecords(doc.SelectElement("recordinfo"), media)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: parseForwardRecords = %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
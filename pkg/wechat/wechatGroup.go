@@ -0,0 +1,298 @@
+package wechat
+
+import (
+	"log"
+	"sort"
+	"strings"
+)
+
+// groupResponseLimit bounds WeChatGroupAnalytics.Responses
+const groupResponseLimit = 50
+
+const (
+	GroupEventJoin   = SystemMessageJoin
+	GroupEventRemove = SystemMessageRemove
+	GroupEventLeave  = SystemMessageLeave
+	GroupEventRename = SystemMessageRename
+)
+
+// WeChatGroupEvent is a membership change parsed from a system message.
+// Names are as shown in the message, user names are empty when the name
+// does not match a current member.
+type WeChatGroupEvent struct {
+	Type            string   `json:"Type"`
+	Timestamp       int64    `json:"Timestamp"`
+	Actor           string   `json:"Actor"`
+	ActorUserName   string   `json:"ActorUserName"`
+	Targets         []string `json:"Targets"`
+	TargetUserNames []string `json:"TargetUserNames"`
+	GroupName       string   `json:"GroupName"`
+	Content         string   `json:"Content"`
+}
+
+// WeChatGroupMember is the activity of a member, ResponseTime is the
+// median time in seconds the member took to reply to another member, 0
+// when unknown.
+type WeChatGroupMember struct {
+	UserInfo      WeChatUserInfo `json:"UserInfo"`
+	Total         int            `json:"Total"`
+	FirstDate     string         `json:"FirstDate"`
+	LastDate      string         `json:"LastDate"`
+	LastTimestamp int64          `json:"LastTimestamp"`
+	ActiveDays    int            `json:"ActiveDays"`
+	PeakHour      int            `json:"PeakHour"`
+	InGroup       bool           `json:"InGroup"`
+	ResponseTime  int64          `json:"ResponseTime"`
+}
+
+// WeChatGroupResponse is how often and how fast UserName replied to
+// ReplyTo, a reply is a message following one of ReplyTo within
+// statMaxResponseTime.
+type WeChatGroupResponse struct {
+	UserName     string `json:"UserName"`
+	ReplyTo      string `json:"ReplyTo"`
+	Total        int    `json:"Total"`
+	ResponseTime int64  `json:"ResponseTime"`
+}
+
+// WeChatGroupAnalytics holds the member activity of a group. Responses
+// lists the most frequent member pairs, at most groupResponseLimit.
+type WeChatGroupAnalytics struct {
+	ChatRoom      string                `json:"ChatRoom"`
+	Total         int                   `json:"Total"`
+	Members       []WeChatGroupMember   `json:"Members"`
+	SilentMembers []WeChatUserInfo      `json:"SilentMembers"`
+	Events        []WeChatGroupEvent    `json:"Events"`
+	Responses     []WeChatGroupResponse `json:"Responses"`
+}
+
+// parseGroupEvent returns nil when content is no membership change. Names
+// of self are set to self.NickName, user names are only set for self.
+func parseGroupEvent(subType int, content string, self *WeChatUserInfo) *WeChatGroupEvent {
+	system := parseSystemMessage(subType, content, self)
+	switch system.kind {
+	case GroupEventJoin, GroupEventRemove, GroupEventLeave, GroupEventRename:
+	default:
+		return nil
+	}
+
+	event := &WeChatGroupEvent{Type: system.kind, Content: system.text, GroupName: system.groupName}
+	if system.actor != nil {
+		event.Actor = system.actor.name
+		event.ActorUserName = system.actor.userName
+	}
+	event.Targets = make([]string, len(system.targets))
+	event.TargetUserNames = make([]string, len(system.targets))
+	for i, target := range system.targets {
+		event.Targets[i] = target.name
+		event.TargetUserNames[i] = target.userName
+	}
+
+	return event
+}
+
+// groupResponses collects the reply gaps of every member pair, messages
+// are added oldest first.
+type groupResponses struct {
+	gaps       map[[2]string][]int64
+	lastSender string
+	lastTime   int64
+}
+
+func newGroupResponses() *groupResponses {
+	return &groupResponses{gaps: make(map[[2]string][]int64)}
+}
+
+func (r *groupResponses) add(sender string, createTime int64) {
+	if len(r.lastSender) > 0 && r.lastSender != sender {
+		if gap := createTime - r.lastTime; gap >= 0 && gap <= statMaxResponseTime {
+			pair := [2]string{sender, r.lastSender}
+			r.gaps[pair] = append(r.gaps[pair], gap)
+		}
+	}
+	r.lastSender = sender
+	r.lastTime = createTime
+}
+
+// responseTime returns the median reply gap of userName to anyone.
+func (r *groupResponses) responseTime(userName string) int64 {
+	gaps := make([]int64, 0)
+	for pair, pairGaps := range r.gaps {
+		if pair[0] == userName {
+			gaps = append(gaps, pairGaps...)
+		}
+	}
+
+	return median(gaps)
+}
+
+// pairs returns the n member pairs with the most replies.
+func (r *groupResponses) pairs(n int) []WeChatGroupResponse {
+	responses := make([]WeChatGroupResponse, 0, len(r.gaps))
+	for pair, gaps := range r.gaps {
+		responses = append(responses, WeChatGroupResponse{UserName: pair[0], ReplyTo: pair[1],
+			Total: len(gaps), ResponseTime: median(gaps)})
+	}
+	sort.Slice(responses, func(i, j int) bool {
+		if responses[i].Total != responses[j].Total {
+			return responses[i].Total > responses[j].Total
+		}
+		if responses[i].UserName != responses[j].UserName {
+			return responses[i].UserName < responses[j].UserName
+		}
+		return responses[i].ReplyTo < responses[j].ReplyTo
+	})
+
+	if len(responses) > n {
+		responses = responses[:n]
+	}
+
+	return responses
+}
+
+// wechatChatRoomUserNames lists every member of chatroom, including the
+// ones that are not contacts and have no user info.
+func (P *WechatDataProvider) wechatChatRoomUserNames(chatroom string) []string {
+	userNames := make([]string, 0)
+	var userNameListStr string
+	err := P.wechatQueryRow(P.microMsg, "select ifnull(UserNameList,'') from ChatRoom where ChatRoomName=?;", chatroom).Scan(&userNameListStr)
+	if err != nil {
+		log.Println("select ChatRoom failed:", chatroom, err)
+		return userNames
+	}
+
+	for _, userName := range strings.Split(userNameListStr, "^G") {
+		if len(userName) > 0 {
+			userNames = append(userNames, userName)
+		}
+	}
+
+	return userNames
+}
+
+// wechatGroupMemberInfo falls back to the user name and the group display
+// name for members that are not contacts.
+func (P *WechatDataProvider) wechatGroupMemberInfo(userName string, displayNames map[string]string) WeChatUserInfo {
+	if info, err := P.WechatGetUserInfoByNameOnCache(userName); err == nil {
+		return *info
+	}
+
+	return WeChatUserInfo{UserName: userName, NickName: displayNames[userName]}
+}
+
+type groupMemberStat struct {
+	member WeChatGroupMember
+	days   map[int64]bool
+	hours  [24]int
+	first  int64
+}
+
+// WeChatGetGroupAnalytics ranks the members of chatroom by message count
+// and lists the membership changes, oldest first. Current members without
+// any message, or without one in the last silentDays days of the group
+// when silentDays > 0, are silent.
+func (P *WechatDataProvider) WeChatGetGroupAnalytics(chatroom string, silentDays int) (*WeChatGroupAnalytics, error) {
+	analytics := &WeChatGroupAnalytics{ChatRoom: chatroom}
+	analytics.Members = make([]WeChatGroupMember, 0)
+	analytics.SilentMembers = make([]WeChatUserInfo, 0)
+	analytics.Events = make([]WeChatGroupEvent, 0)
+
+	current := make(map[string]bool)
+	for _, userName := range P.wechatChatRoomUserNames(chatroom) {
+		current[userName] = true
+	}
+	names := P.wechatChatRoomNames(chatroom)
+	displayNames := P.wechatChatRoomDisplayNames(chatroom)
+
+	stats := make(map[string]*groupMemberStat)
+	responses := newGroupResponses()
+	var lastTime int64
+	err := P.wechatScanStatRows(chatroom, true, func(row *wechatStatRow) {
+		if isSystemMessage(row.msgType) {
+			if event := parseGroupEvent(row.subType, row.content, P.SelfInfo); event != nil {
+				event.Timestamp = row.createTime
+				analytics.Events = append(analytics.Events, *event)
+			}
+			return
+		}
+
+		sender := P.SelfInfo.UserName
+		if row.isSender != 1 {
+			sender = bytesExtraSenderName(row.bytesExtra)
+		}
+		if len(sender) == 0 {
+			return
+		}
+
+		stat, ok := stats[sender]
+		if !ok {
+			stat = &groupMemberStat{days: make(map[int64]bool), first: row.createTime}
+			stats[sender] = stat
+		}
+		t := localTime(row.createTime)
+		stat.member.Total += 1
+		stat.member.LastTimestamp = row.createTime
+		stat.days[dayNumber(t)] = true
+		stat.hours[t.Hour()] += 1
+		analytics.Total += 1
+		responses.add(sender, row.createTime)
+		lastTime = row.createTime
+	})
+	if err != nil {
+		log.Println("wechatScanStatRows failed:", err)
+		return nil, err
+	}
+
+	for i := range analytics.Events {
+		event := &analytics.Events[i]
+		if len(event.ActorUserName) == 0 {
+			event.ActorUserName = names[event.Actor]
+		}
+		for j, target := range event.Targets {
+			if len(event.TargetUserNames[j]) == 0 {
+				event.TargetUserNames[j] = names[target]
+			}
+		}
+	}
+
+	for userName, stat := range stats {
+		member := stat.member
+		member.UserInfo = P.wechatGroupMemberInfo(userName, displayNames)
+		member.FirstDate = localTime(stat.first).Format("2006-01-02")
+		member.LastDate = localTime(member.LastTimestamp).Format("2006-01-02")
+		member.ActiveDays = len(stat.days)
+		for hour, count := range stat.hours {
+			if count > stat.hours[member.PeakHour] {
+				member.PeakHour = hour
+			}
+		}
+		member.InGroup = current[userName]
+		member.ResponseTime = responses.responseTime(userName)
+		analytics.Members = append(analytics.Members, member)
+	}
+	sort.Slice(analytics.Members, func(i, j int) bool {
+		if analytics.Members[i].Total != analytics.Members[j].Total {
+			return analytics.Members[i].Total > analytics.Members[j].Total
+		}
+		return analytics.Members[i].LastTimestamp > analytics.Members[j].LastTimestamp
+	})
+	analytics.Responses = responses.pairs(groupResponseLimit)
+
+	silentSince := int64(0)
+	if silentDays > 0 {
+		silentSince = lastTime - int64(silentDays)*86400
+	}
+	for userName := range current {
+		stat, ok := stats[userName]
+		if ok && (silentDays <= 0 || stat.member.LastTimestamp >= silentSince) {
+			continue
+		}
+
+		analytics.SilentMembers = append(analytics.SilentMembers, P.wechatGroupMemberInfo(userName, displayNames))
+	}
+	sort.Slice(analytics.SilentMembers, func(i, j int) bool {
+		return analytics.SilentMembers[i].UserName < analytics.SilentMembers[j].UserName
+	})
+
+	return analytics, nil
+}
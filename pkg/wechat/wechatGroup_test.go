@@ -0,0 +1,52 @@
+package wechat
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGroupResponses(t *testing.T) {
+	responses := newGroupResponses()
+	messages := []struct {
+		sender string
+		time   int64
+	}{
+		{"a", 0},
+		{"b", 10},
+		{"b", 20},
+		{"a", 50},
+		{"c", 60},
+		{"a", 60 + statMaxResponseTime + 1},
+		{"b", 60 + statMaxResponseTime + 31},
+	}
+	for _, msg := range messages {
+		responses.add(msg.sender, msg.time)
+	}
+
+	want := []WeChatGroupResponse{
+		{UserName: "b", ReplyTo: "a", Total: 2, ResponseTime: 20},
+		{UserName: "a", ReplyTo: "b", Total: 1, ResponseTime: 30},
+		{UserName: "c", ReplyTo: "a", Total: 1, ResponseTime: 10},
+	}
+	if got := responses.pairs(10); !reflect.DeepEqual(got, want) {
+		t.Errorf("pairs = %+v, want %+v", got, want)
+	}
+	if got := responses.pairs(1); !reflect.DeepEqual(got, want[:1]) {
+		t.Errorf("pairs(1) = %+v, want %+v", got, want[:1])
+	}
+
+	tests := []struct {
+		userName string
+		want     int64
+	}{
+		{"a", 30},
+		{"b", 20},
+		{"c", 10},
+		{"d", 0},
+	}
+	for _, test := range tests {
+		if got := responses.responseTime(test.userName); got != test.want {
+			t.Errorf("responseTime(%s) = %d, want %d", test.userName, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package wechat
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"wechatDataBackup/pkg/utils"
+)
+
+const (
+	headImgLegacyExt = ".headimg"
+	headImgHDSuffix  = "_hd"
+)
+
+var headImgExts = []string{".jpg", ".png", ".gif", ".webp", ".bmp", ".ico"}
+
+// headImgFileNames returns the possible file names of userName's head
+// image, best resolution first and the old extensionless export last.
+func headImgFileNames(userName string) (hd []string, small []string) {
+	for _, ext := range headImgExts {
+		hd = append(hd, userName+headImgHDSuffix+ext)
+		small = append(small, userName+ext)
+	}
+	hd = append(hd, userName+headImgHDSuffix+headImgLegacyExt)
+	small = append(small, userName+headImgLegacyExt)
+
+	return hd, small
+}
+
+type wechatHeadImgCache struct {
+	once  sync.Once
+	files map[string]bool
+}
+
+// load indexes FileStorage\HeadImage once.
+func (c *wechatHeadImgCache) load(resPath string) {
+	c.once.Do(func() {
+		c.files = make(map[string]bool)
+		entries, err := os.ReadDir(fmt.Sprintf("%s\\FileStorage\\HeadImage", resPath))
+		if err != nil {
+			return
+		}
+
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				c.files[entry.Name()] = true
+			}
+		}
+		log.Println("HeadImage cache number:", len(c.files))
+	})
+}
+
+func (c *wechatHeadImgCache) find(names []string) string {
+	for _, name := range names {
+		if c.files[name] {
+			return name
+		}
+	}
+
+	return ""
+}
+
+// wechatGetLocalHeadImg returns the best local head image of userName, the
+// exported big one, then the cached big url, the exported small one and
+// at last the cached small url.
+func (P *WechatDataProvider) wechatGetLocalHeadImg(userName, bigHeadImgUrl, smallHeadImgUrl string) string {
+	P.headImgCache.load(P.resPath)
+	hd, small := headImgFileNames(userName)
+	if name := P.headImgCache.find(hd); name != "" {
+		return fmt.Sprintf("%s\\FileStorage\\HeadImage\\%s", P.prefixResPath, name)
+	}
+
+	if path := P.assetCache.Lookup(bigHeadImgUrl); path != "" {
+		return path
+	}
+
+	if name := P.headImgCache.find(small); name != "" {
+		return fmt.Sprintf("%s\\FileStorage\\HeadImage\\%s", P.prefixResPath, name)
+	}
+
+	return P.assetCache.Lookup(smallHeadImgUrl)
+}
+
+// findLocalHeadImg is wechatGetLocalHeadImg for callers without a provider.
+func findLocalHeadImg(resPath, prefixRes, userName string) string {
+	hd, small := headImgFileNames(userName)
+	for _, name := range append(hd, small...) {
+		if _, err := os.Stat(fmt.Sprintf("%s\\FileStorage\\HeadImage\\%s", resPath, name)); err == nil {
+			return fmt.Sprintf("%s\\FileStorage\\HeadImage\\%s", prefixRes, name)
+		}
+	}
+
+	return ""
+}
+
+// writeHeadImg saves buf as <userName><suffix><ext>, the extension comes
+// from the image content and falls back to .headimg.
+func writeHeadImg(headImgPath, userName, suffix string, buf []byte) {
+	if len(userName) == 0 || len(buf) == 0 {
+		return
+	}
+
+	ext := utils.GetImageExt(buf)
+	if ext == "" {
+		ext = headImgLegacyExt
+	}
+
+	imgPath := fmt.Sprintf("%s\\%s%s%s", headImgPath, userName, suffix, ext)
+	if _, err := os.Stat(imgPath); err == nil {
+		return
+	}
+
+	if err := os.WriteFile(imgPath, buf, 0666); err != nil {
+		log.Println("WriteFile:", imgPath, err)
+	}
+}
+
+func tableHasColumn(db *sql.DB, table, column string) bool {
+	count := 0
+	err := db.QueryRow("select count(*) from pragma_table_info(?) where name=? COLLATE NOCASE;", table, column).Scan(&count)
+	if err != nil {
+		log.Println("pragma_table_info failed:", table, err)
+		return false
+	}
+
+	return count > 0
+}
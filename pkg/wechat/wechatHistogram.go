@@ -0,0 +1,135 @@
+package wechat
+
+import (
+	"fmt"
+	"log"
+	"sort"
+)
+
+const (
+	HistogramDay   = "day"
+	HistogramMonth = "month"
+	HistogramYear  = "year"
+)
+
+var histogramLayouts = map[string]string{
+	HistogramDay:   "2006-01-02",
+	HistogramMonth: "2006-01",
+	HistogramYear:  "2006",
+}
+
+type WeChatMessageHistogramItem struct {
+	Date     string `json:"Date"`
+	Sent     int    `json:"Sent"`
+	Received int    `json:"Received"`
+	Total    int    `json:"Total"`
+}
+
+type WeChatMessageHistogram struct {
+	UserName    string                       `json:"UserName"`
+	Granularity string                       `json:"Granularity"`
+	Items       []WeChatMessageHistogramItem `json:"Items"`
+	Total       int                          `json:"Total"`
+}
+
+// wechatMessageBucket counts the messages of a timeBucket, sent or received.
+type wechatMessageBucket struct {
+	bucket   int64
+	isSender int
+	count    int
+}
+
+// wechatGetMessageBuckets returns the message counts of userName per
+// timeBucket, or of all talkers when userName is empty.
+func (P *WechatDataProvider) wechatGetMessageBuckets(userName string) ([]wechatMessageBucket, error) {
+	buckets := make([]wechatMessageBucket, 0)
+	for index, msgDB := range P.msgDBs {
+		querySql := "select CreateTime/?, IsSender, count(*) from MSG group by 1, 2;"
+		args := []interface{}{timeBucket}
+		if len(userName) > 0 {
+			if P.wechatTalkerShard(userName, index) == nil {
+				continue
+			}
+			querySql = "select CreateTime/?, IsSender, count(*) from MSG where StrTalker=? group by 1, 2;"
+			args = append(args, userName)
+		}
+
+		shardBuckets, err := P.wechatQueryMessageBuckets(msgDB, querySql, args...)
+		if err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, shardBuckets...)
+	}
+
+	return buckets, nil
+}
+
+func (P *WechatDataProvider) wechatQueryMessageBuckets(msgDB *wechatMsgDB, querySql string, args ...interface{}) ([]wechatMessageBucket, error) {
+	rows, err := P.wechatQuery(msgDB.db, querySql, args...)
+	if err != nil {
+		log.Printf("%s failed %v\n", querySql, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	buckets := make([]wechatMessageBucket, 0)
+	for rows.Next() {
+		var b wechatMessageBucket
+		if err := rows.Scan(&b.bucket, &b.isSender, &b.count); err != nil {
+			log.Println("rows.Scan failed", err)
+			return nil, err
+		}
+		buckets = append(buckets, b)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Println("rows.Scan failed", err)
+		return nil, err
+	}
+
+	return buckets, nil
+}
+
+// WeChatGetMessageHistogram returns the sent and received message counts
+// of userName per day, month or year in the configured time zone, oldest
+// first. An empty userName counts the messages of all talkers.
+func (P *WechatDataProvider) WeChatGetMessageHistogram(userName string, granularity string) (*WeChatMessageHistogram, error) {
+	layout, ok := histogramLayouts[granularity]
+	if !ok {
+		return nil, fmt.Errorf("unknown granularity: %s", granularity)
+	}
+
+	buckets, err := P.wechatGetMessageBuckets(userName)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make(map[string]*WeChatMessageHistogramItem)
+	for _, b := range buckets {
+		date := localTime(b.bucket * timeBucket).Format(layout)
+		item, ok := items[date]
+		if !ok {
+			item = &WeChatMessageHistogramItem{Date: date}
+			items[date] = item
+		}
+
+		if b.isSender == 1 {
+			item.Sent += b.count
+		} else {
+			item.Received += b.count
+		}
+		item.Total += b.count
+	}
+
+	histogram := &WeChatMessageHistogram{UserName: userName, Granularity: granularity}
+	histogram.Items = make([]WeChatMessageHistogramItem, 0, len(items))
+	for _, item := range items {
+		histogram.Items = append(histogram.Items, *item)
+	}
+	sort.Slice(histogram.Items, func(i, j int) bool {
+		return histogram.Items[i].Date < histogram.Items[j].Date
+	})
+	histogram.Total = len(histogram.Items)
+
+	return histogram, nil
+}
@@ -0,0 +1,312 @@
+package wechat
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/beevik/etree"
+)
+
+// MediaInfo is what the message records about its picture, video or file.
+// Sizes are in bytes and Duration in seconds. Width and Height are those of
+// the original picture, 0 when unknown. A video only records the size of
+// its thumbnail, which has the aspect ratio of the video.
+type MediaInfo struct {
+	Width       int    `json:"Width"`
+	Height      int    `json:"Height"`
+	ThumbWidth  int    `json:"ThumbWidth"`
+	ThumbHeight int    `json:"ThumbHeight"`
+	Md5         string `json:"Md5"`
+	Size        int64  `json:"Size"`
+	HdSize      int64  `json:"HdSize"`
+	Duration    int    `json:"Duration"`
+}
+
+// WeChatMediaStatus tells which local files of a message exist.
+type WeChatMediaStatus struct {
+	MsgSvrId string `json:"MsgSvrId"`
+	HasMedia bool   `json:"HasMedia"`
+	HasThumb bool   `json:"HasThumb"`
+}
+
+// localResPath returns the path on disk of a path returned to the frontend,
+// empty when path is not under the resource directory.
+func (P *WechatDataProvider) localResPath(path string) string {
+	if len(path) == 0 || !strings.HasPrefix(path, P.prefixResPath) {
+		return ""
+	}
+
+	return P.resPath + path[len(P.prefixResPath):]
+}
+
+// resFileExists reports whether the file of a frontend path exists.
+func (P *WechatDataProvider) resFileExists(path string) bool {
+	localPath := P.localResPath(path)
+	if len(localPath) == 0 {
+		return false
+	}
+
+	info, err := os.Stat(localPath)
+	return err == nil && !info.IsDir()
+}
+
+func attrInt(e *etree.Element, key string) int {
+	value, _ := strconv.Atoi(e.SelectAttrValue(key, "0"))
+	return value
+}
+
+func attrInt64(e *etree.Element, key string) int64 {
+	value, _ := strconv.ParseInt(e.SelectAttrValue(key, "0"), 10, 64)
+	return value
+}
+
+// wechatMessageFileParse fills in the attachment of a file message from its
+// uncompressed content.
+func (P *WechatDataProvider) wechatMessageFileParse(msg *WeChatMessage, root *xmlDocument) {
+	totalLen := root.FindElementValue("/msg/appmsg/appattach/totallen")
+	if size, err := strconv.ParseInt(totalLen, 10, 64); err == nil {
+		msg.FileInfo.FileSize = totalLen
+		msg.MediaInfo.Size = size
+	}
+	msg.FileInfo.FileExt = root.FindElementValue("/msg/appmsg/appattach/fileext")
+	if len(msg.FileInfo.FileName) == 0 {
+		msg.FileInfo.FileName = root.FindElementValue("/msg/appmsg/title")
+	}
+	msg.MediaInfo.Md5 = root.FindElementValue("/msg/appmsg/md5")
+}
+
+// wechatMessageMediaHandle parses the img or videomsg content of picture
+// and video messages, the files are not looked at, see
+// WeChatGetMediaStatus.
+func (P *WechatDataProvider) wechatMessageMediaHandle(msg *WeChatMessage) {
+	if msg.Type != Wechat_Message_Type_Picture && msg.Type != Wechat_Message_Type_Video {
+		return
+	}
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromString(msg.Content); err != nil {
+		return
+	}
+
+	if img := doc.FindElement("/msg/img"); img != nil {
+		msg.MediaInfo.Md5 = img.SelectAttrValue("md5", "")
+		msg.MediaInfo.Size = attrInt64(img, "length")
+		msg.MediaInfo.HdSize = attrInt64(img, "hdlength")
+		for _, prefix := range []string{"cdnhd", "cdnmid"} {
+			msg.MediaInfo.Width = attrInt(img, prefix+"width")
+			msg.MediaInfo.Height = attrInt(img, prefix+"height")
+			if msg.MediaInfo.Width > 0 && msg.MediaInfo.Height > 0 {
+				break
+			}
+		}
+		msg.MediaInfo.ThumbWidth = attrInt(img, "cdnthumbwidth")
+		msg.MediaInfo.ThumbHeight = attrInt(img, "cdnthumbheight")
+	} else if video := doc.FindElement("/msg/videomsg"); video != nil {
+		msg.MediaInfo.Md5 = video.SelectAttrValue("md5", "")
+		msg.MediaInfo.Size = attrInt64(video, "length")
+		msg.MediaInfo.Duration = attrInt(video, "playlength")
+		msg.MediaInfo.ThumbWidth = attrInt(video, "cdnthumbwidth")
+		msg.MediaInfo.ThumbHeight = attrInt(video, "cdnthumbheight")
+	}
+}
+
+// WeChatGetMediaStatus checks which files of the picture, video or file
+// message svrId of userName exist, only its paths are resolved.
+func (P *WechatDataProvider) WeChatGetMediaStatus(userName string, svrId string) (*WeChatMediaStatus, error) {
+	msg, err := P.wechatFindMessageByServerId(userName, svrId)
+	if err != nil {
+		log.Println("wechatFindMessageByServerId failed:", err)
+		return nil, err
+	}
+	status := P.wechatMediaStatus(msg)
+	return &status, nil
+}
+
+// WeChatGetMediaStatusList is WeChatGetMediaStatus for a page of messages
+// of userName, each shard holding userName is queried once. Unknown
+// messages are left out, the list is in no particular order.
+func (P *WechatDataProvider) WeChatGetMediaStatusList(userName string, svrIds []string) ([]WeChatMediaStatus, error) {
+	list := make([]WeChatMediaStatus, 0, len(svrIds))
+	ids := make([]interface{}, 0, len(svrIds))
+	for _, svrId := range svrIds {
+		id, err := strconv.ParseInt(svrId, 10, 64)
+		if err != nil {
+			return list, fmt.Errorf("invalid MsgSvrID %s: %v", svrId, err)
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return list, nil
+	}
+
+	condition := fmt.Sprintf(" And MsgSvrID in (%s)", sqlPlaceholders(len(ids)))
+	for _, info := range P.shardIndex[userName] {
+		rows, err := P.wechatQueryMessageList(info.index, userName, len(ids), Message_Search_Forward, condition, ids)
+		if err != nil {
+			return list, err
+		}
+		for i := range rows {
+			list = append(list, P.wechatMediaStatus(&rows[i]))
+		}
+	}
+
+	return list, nil
+}
+
+// wechatMediaStatus checks the files of msg, a row of
+// wechatQueryMessageList.
+func (P *WechatDataProvider) wechatMediaStatus(msg *WeChatMessage) WeChatMediaStatus {
+	P.wechatMessageExtraHandle(msg)
+	msg.handled |= msgHandledExtra
+
+	status := WeChatMediaStatus{MsgSvrId: msg.MsgSvrId}
+	switch msg.Type {
+	case Wechat_Message_Type_Picture:
+		status.HasMedia = P.resFileExists(msg.ImagePath)
+		status.HasThumb = P.resFileExists(msg.ThumbPath)
+	case Wechat_Message_Type_Video:
+		status.HasMedia = P.resFileExists(msg.VideoPath)
+		status.HasThumb = P.resFileExists(msg.ThumbPath)
+	case Wechat_Message_Type_Misc:
+		if msg.SubType == Wechat_Misc_Message_File {
+			status.HasMedia = P.resFileExists(msg.FileInfo.FilePath)
+		}
+	}
+
+	return status
+}
+
+// media types of the files a message references
+const (
+	MediaTypeImage = "image"
+	MediaTypeVideo = "video"
+	MediaTypeVoice = "voice"
+	MediaTypeFile  = "file"
+	MediaTypeEmoji = "emoji"
+	MediaTypeThumb = "thumb"
+	MediaTypeOther = "other"
+)
+
+// messageMedia is a file referenced by a message, as a frontend path.
+type messageMedia struct {
+	path      string
+	mediaType string
+}
+
+// messageMediaFiles returns the files msg references, the original before
+// its thumbnail. Paths may be empty or point at missing files.
+func messageMediaFiles(msg *WeChatMessage) []messageMedia {
+	thumb := func(path string) messageMedia { return messageMedia{path, MediaTypeThumb} }
+	files := make([]messageMedia, 0, 2)
+	switch msg.Type {
+	case Wechat_Message_Type_Picture:
+		files = append(files, messageMedia{msg.ImagePath, MediaTypeImage}, thumb(msg.ThumbPath))
+	case Wechat_Message_Type_Voice:
+		files = append(files, messageMedia{msg.VoicePath, MediaTypeVoice})
+	case Wechat_Message_Type_Visit_Card:
+		files = append(files, messageMedia{msg.VisitInfo.LocalHeadImgUrl, MediaTypeOther})
+	case Wechat_Message_Type_Video:
+		files = append(files, messageMedia{msg.VideoPath, MediaTypeVideo}, thumb(msg.ThumbPath))
+	case Wechat_Message_Type_Emoji:
+		files = append(files, messageMedia{msg.EmojiPath, MediaTypeEmoji})
+	case Wechat_Message_Type_Location:
+		files = append(files, thumb(msg.LocationInfo.ThumbPath))
+	case Wechat_Message_Type_Misc:
+		switch msg.SubType {
+		case Wechat_Misc_Message_Music, Wechat_Misc_Message_TingListen:
+			files = append(files, thumb(msg.MusicInfo.ThumbPath))
+		case Wechat_Misc_Message_ThirdVideo, Wechat_Misc_Message_CardLink, Wechat_Misc_Message_Applet,
+			Wechat_Misc_Message_Applet2, Wechat_Misc_Message_Game:
+			files = append(files, thumb(msg.ThumbPath))
+		case Wechat_Misc_Message_File:
+			files = append(files, messageMedia{msg.FileInfo.FilePath, MediaTypeFile})
+		case Wechat_Misc_Message_Channels, Wechat_Misc_Message_Live:
+			files = append(files, thumb(msg.ChannelsInfo.ThumbPath))
+		case Wechat_Misc_Message_ForwardMessage:
+			for _, path := range forwardRecordPaths(msg.ForwardInfo.Records) {
+				files = append(files, messageMedia{path, MediaTypeOther})
+			}
+		}
+	}
+
+	return files
+}
+
+// mediaMessageCondition is the " And ..." clause selecting the messages
+// messageMediaFiles can return files for.
+func mediaMessageCondition() (string, []interface{}) {
+	condition := " And (Type in (?, ?, ?, ?, ?, ?) OR (Type=? And SubType in (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)))"
+	args := []interface{}{Wechat_Message_Type_Picture, Wechat_Message_Type_Voice, Wechat_Message_Type_Visit_Card,
+		Wechat_Message_Type_Video, Wechat_Message_Type_Emoji, Wechat_Message_Type_Location,
+		Wechat_Message_Type_Misc, Wechat_Misc_Message_Music, Wechat_Misc_Message_TingListen,
+		Wechat_Misc_Message_ThirdVideo, Wechat_Misc_Message_CardLink, Wechat_Misc_Message_Applet,
+		Wechat_Misc_Message_Applet2, Wechat_Misc_Message_Game, Wechat_Misc_Message_File,
+		Wechat_Misc_Message_Channels, Wechat_Misc_Message_Live, Wechat_Misc_Message_ForwardMessage}
+
+	return condition, args
+}
+
+// wechatMessageMediaPathHandle resolves only the paths messageMediaFiles
+// returns, without the decoding and lookups of wechatMessageHandle.
+func (P *WechatDataProvider) wechatMessageMediaPathHandle(msg *WeChatMessage) {
+	P.wechatMessageExtraHandle(msg)
+	msg.handled |= msgHandledExtra
+	switch msg.Type {
+	case Wechat_Message_Type_Voice:
+		msg.VoicePath = P.wechatGetVoicePath(msg.MsgSvrId)
+	case Wechat_Message_Type_Emoji:
+		P.wechatMessageEmojiHandle(msg)
+	case Wechat_Message_Type_Visit_Card:
+		P.wechatMessageVisitHandke(msg)
+	case Wechat_Message_Type_Misc:
+		P.wechatMessageCompressContentHandle(msg)
+		msg.handled |= msgHandledContent
+	}
+}
+
+// wechatScanMediaMessages calls fn with the messages of userName, or of
+// every session when userName is empty, that can reference files, newest
+// first. Only their paths are resolved.
+func (P *WechatDataProvider) wechatScanMediaMessages(userName string, fn func(msg *WeChatMessage)) error {
+	condition, conditionArgs := mediaMessageCondition()
+	return P.wechatScanMessages(userName, condition, conditionArgs, func(msg *WeChatMessage) {
+		P.wechatMessageMediaPathHandle(msg)
+		fn(msg)
+	})
+}
+
+// wechatScanMessages calls fn with the unhandled messages of userName, or
+// of every session when userName is empty, matching the " And ..."
+// condition, newest shard first.
+func (P *WechatDataProvider) wechatScanMessages(userName string, condition string, conditionArgs []interface{}, fn func(msg *WeChatMessage)) error {
+	batchSize := 600
+	for index := range P.msgDBs {
+		if len(userName) > 0 && P.wechatTalkerShard(userName, index) == nil {
+			continue
+		}
+
+		var position string
+		var positionArgs []interface{}
+		for {
+			args := append(append([]interface{}{}, positionArgs...), conditionArgs...)
+			batch, err := P.wechatQueryMessageList(index, userName, batchSize, Message_Search_Forward, position+condition, args)
+			if err != nil {
+				return err
+			}
+
+			for i := range batch {
+				fn(&batch[i])
+			}
+
+			if len(batch) < batchSize {
+				break
+			}
+			position, positionArgs = messageCursorOf(&batch[len(batch)-1]).sqlCondition(Message_Search_Forward)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,143 @@
+package wechat
+
+import (
+	"log"
+	"sort"
+)
+
+// WeChatMissingMedia is a message with missing files. ThumbOnly is set when
+// the original is missing but its thumbnail exists. NotRecorded lists the
+// media types the message has no path for, these are not in MissingPaths.
+type WeChatMissingMedia struct {
+	MsgSvrId     string   `json:"MsgSvrId"`
+	Type         int      `json:"Type"`
+	SubType      int      `json:"SubType"`
+	CreateTime   int64    `json:"CreateTime"`
+	MissingPaths []string `json:"MissingPaths"`
+	NotRecorded  []string `json:"NotRecorded"`
+	ThumbOnly    bool     `json:"ThumbOnly"`
+}
+
+// WeChatSessionMediaAudit counts the picture, video, voice and file messages
+// of a session. Missing have neither the original nor a thumbnail,
+// ThumbOnly have only the thumbnail and MissingThumb have the original but
+// not its thumbnail. NotRecorded have a file whose path the message does
+// not record, they are counted in the others as well.
+type WeChatSessionMediaAudit struct {
+	UserName     string               `json:"UserName"`
+	Total        int                  `json:"Total"`
+	Missing      int                  `json:"Missing"`
+	ThumbOnly    int                  `json:"ThumbOnly"`
+	MissingThumb int                  `json:"MissingThumb"`
+	NotRecorded  int                  `json:"NotRecorded"`
+	Items        []WeChatMissingMedia `json:"Items"`
+}
+
+type WeChatMediaAudit struct {
+	Sessions     []WeChatSessionMediaAudit `json:"Sessions"`
+	Total        int                       `json:"Total"`
+	Missing      int                       `json:"Missing"`
+	ThumbOnly    int                       `json:"ThumbOnly"`
+	MissingThumb int                       `json:"MissingThumb"`
+	NotRecorded  int                       `json:"NotRecorded"`
+}
+
+// auditMessageCondition is the " And ..." clause selecting the picture,
+// video, voice and file messages.
+func auditMessageCondition() (string, []interface{}) {
+	condition := " And (Type in (?, ?, ?) OR (Type=? And SubType=?))"
+	args := []interface{}{Wechat_Message_Type_Picture, Wechat_Message_Type_Voice, Wechat_Message_Type_Video,
+		Wechat_Message_Type_Misc, Wechat_Misc_Message_File}
+
+	return condition, args
+}
+
+// add checks the files of msg with exists and counts it.
+func (audit *WeChatSessionMediaAudit) add(msg *WeChatMessage, exists func(path string) bool) {
+	audit.Total += 1
+
+	item := WeChatMissingMedia{MsgSvrId: msg.MsgSvrId, Type: msg.Type, SubType: msg.SubType, CreateTime: msg.CreateTime}
+	item.MissingPaths = make([]string, 0)
+	item.NotRecorded = make([]string, 0)
+	hasMedia, hasThumb, needThumb := true, false, false
+	for _, media := range messageMediaFiles(msg) {
+		found := false
+		if len(media.path) == 0 {
+			item.NotRecorded = append(item.NotRecorded, media.mediaType)
+		} else if found = exists(media.path); !found {
+			item.MissingPaths = append(item.MissingPaths, media.path)
+		}
+
+		if media.mediaType == MediaTypeThumb {
+			needThumb = true
+			hasThumb = found
+		} else if !found {
+			hasMedia = false
+		}
+	}
+	if len(item.MissingPaths) == 0 && len(item.NotRecorded) == 0 {
+		return
+	}
+
+	if !hasMedia && hasThumb {
+		item.ThumbOnly = true
+		audit.ThumbOnly += 1
+	} else if !hasMedia {
+		audit.Missing += 1
+	} else if needThumb {
+		audit.MissingThumb += 1
+	}
+	if len(item.NotRecorded) > 0 {
+		audit.NotRecorded += 1
+	}
+	audit.Items = append(audit.Items, item)
+}
+
+// WeChatGetMediaAudit reports the picture, video, voice and file messages
+// whose files are missing, for userName or for every session when
+// userName is empty. Only the paths of the messages are resolved and
+// stat'ed. Sessions are sorted by missing files, their items newest
+// first.
+func (P *WechatDataProvider) WeChatGetMediaAudit(userName string) (*WeChatMediaAudit, error) {
+	sessions := make(map[string]*WeChatSessionMediaAudit)
+	condition, conditionArgs := auditMessageCondition()
+	err := P.wechatScanMessages(userName, condition, conditionArgs, func(msg *WeChatMessage) {
+		P.wechatMessageExtraHandle(msg)
+		msg.handled |= msgHandledExtra
+		if msg.Type == Wechat_Message_Type_Voice {
+			msg.VoicePath = P.wechatGetVoicePath(msg.MsgSvrId)
+		}
+
+		session, ok := sessions[msg.Talker]
+		if !ok {
+			session = &WeChatSessionMediaAudit{UserName: msg.Talker, Items: make([]WeChatMissingMedia, 0)}
+			sessions[msg.Talker] = session
+		}
+		session.add(msg, P.resFileExists)
+	})
+	if err != nil {
+		log.Println("wechatScanMessages failed:", userName, err)
+		return nil, err
+	}
+
+	audit := &WeChatMediaAudit{}
+	audit.Sessions = make([]WeChatSessionMediaAudit, 0, len(sessions))
+	for _, session := range sessions {
+		sort.Slice(session.Items, func(i, j int) bool { return session.Items[i].CreateTime > session.Items[j].CreateTime })
+		audit.Total += session.Total
+		audit.Missing += session.Missing
+		audit.ThumbOnly += session.ThumbOnly
+		audit.MissingThumb += session.MissingThumb
+		audit.NotRecorded += session.NotRecorded
+		audit.Sessions = append(audit.Sessions, *session)
+	}
+
+	sort.Slice(audit.Sessions, func(i, j int) bool {
+		if len(audit.Sessions[i].Items) != len(audit.Sessions[j].Items) {
+			return len(audit.Sessions[i].Items) > len(audit.Sessions[j].Items)
+		}
+		return audit.Sessions[i].UserName < audit.Sessions[j].UserName
+	})
+
+	return audit, nil
+}
@@ -0,0 +1,53 @@
+package wechat
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSessionMediaAuditAdd(t *testing.T) {
+	files := map[string]bool{"img": true, "thumb": true, "video": true, "voice": true}
+	exists := func(path string) bool { return files[path] }
+
+	tests := []struct {
+		name string
+		msg  WeChatMessage
+		want *WeChatMissingMedia
+	}{
+		{"complete", WeChatMessage{Type: Wechat_Message_Type_Picture, ImagePath: "img", ThumbPath: "thumb"}, nil},
+		{"thumb only", WeChatMessage{Type: Wechat_Message_Type_Picture, ImagePath: "img2", ThumbPath: "thumb"},
+			&WeChatMissingMedia{MissingPaths: []string{"img2"}, NotRecorded: []string{}, ThumbOnly: true}},
+		{"missing", WeChatMessage{Type: Wechat_Message_Type_Video, VideoPath: "video2", ThumbPath: "thumb2"},
+			&WeChatMissingMedia{MissingPaths: []string{"video2", "thumb2"}, NotRecorded: []string{}}},
+		{"missing thumb", WeChatMessage{Type: Wechat_Message_Type_Video, VideoPath: "video", ThumbPath: "thumb2"},
+			&WeChatMissingMedia{MissingPaths: []string{"thumb2"}, NotRecorded: []string{}}},
+		{"not recorded", WeChatMessage{Type: Wechat_Message_Type_Picture, ThumbPath: "thumb"},
+			&WeChatMissingMedia{MissingPaths: []string{}, NotRecorded: []string{MediaTypeImage}, ThumbOnly: true}},
+		{"voice", WeChatMessage{Type: Wechat_Message_Type_Voice, VoicePath: "voice"}, nil},
+	}
+
+	for _, test := range tests {
+		audit := &WeChatSessionMediaAudit{Items: make([]WeChatMissingMedia, 0)}
+		audit.add(&test.msg, exists)
+		if test.want == nil {
+			if len(audit.Items) != 0 {
+				t.Errorf("%s: items = %+v, want none", test.name, audit.Items)
+			}
+			continue
+		}
+		test.want.Type = test.msg.Type
+		if len(audit.Items) != 1 || !reflect.DeepEqual(audit.Items[0], *test.want) {
+			t.Errorf("%s: items = %+v, want %+v", test.name, audit.Items, *test.want)
+		}
+	}
+
+	audit := &WeChatSessionMediaAudit{Items: make([]WeChatMissingMedia, 0)}
+	for _, test := range tests {
+		audit.add(&test.msg, exists)
+	}
+	want := WeChatSessionMediaAudit{Total: 6, Missing: 1, ThumbOnly: 2, MissingThumb: 1, NotRecorded: 1}
+	audit.Items = nil
+	if !reflect.DeepEqual(*audit, want) {
+		t.Errorf("counts = %+v, want %+v", *audit, want)
+	}
+}
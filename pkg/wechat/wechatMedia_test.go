@@ -0,0 +1,68 @@
+package wechat
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestMediaMessageCondition(t *testing.T) {
+	condition, args := mediaMessageCondition()
+	if n := strings.Count(condition, "?"); n != len(args) {
+		t.Fatalf("mediaMessageCondition has %d placeholders for %d args", n, len(args))
+	}
+
+	// every type messageMediaFiles returns files for must be selected, the
+	// args are the types, then Misc and its sub types
+	types, subTypes := args[:6], args[7:]
+	for _, msg := range []WeChatMessage{
+		{Type: Wechat_Message_Type_Picture},
+		{Type: Wechat_Message_Type_Voice},
+		{Type: Wechat_Message_Type_Video},
+		{Type: Wechat_Message_Type_Emoji},
+		{Type: Wechat_Message_Type_Location},
+		{Type: Wechat_Message_Type_Visit_Card},
+		{Type: Wechat_Message_Type_Misc, SubType: Wechat_Misc_Message_File},
+		{Type: Wechat_Message_Type_Misc, SubType: Wechat_Misc_Message_ForwardMessage},
+		{Type: Wechat_Message_Type_Misc, SubType: Wechat_Misc_Message_Channels},
+	} {
+		found := slices.Contains(types, interface{}(msg.Type))
+		if msg.Type == Wechat_Message_Type_Misc {
+			found = slices.Contains(subTypes, interface{}(msg.SubType))
+		}
+		if !found {
+			t.Errorf("mediaMessageCondition misses %d/%d", msg.Type, msg.SubType)
+		}
+	}
+}
+
+func TestMessageMediaHandle(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  WeChatMessage
+		want MediaInfo
+	}{
+		{"picture", WeChatMessage{Type: Wechat_Message_Type_Picture,
+			Content: `<msg><img md5="abc" length="1000" hdlength="5000" cdnhdwidth="1080" cdnhdheight="1920" cdnmidwidth="540" cdnmidheight="960" cdnthumbwidth="120" cdnthumbheight="213"/></msg>`},
+			MediaInfo{Width: 1080, Height: 1920, ThumbWidth: 120, ThumbHeight: 213, Md5: "abc", Size: 1000, HdSize: 5000}},
+		{"picture without hd", WeChatMessage{Type: Wechat_Message_Type_Picture,
+			Content: `<msg><img md5="abc" cdnmidwidth="540" cdnmidheight="960" cdnthumbwidth="120" cdnthumbheight="213"/></msg>`},
+			MediaInfo{Width: 540, Height: 960, ThumbWidth: 120, ThumbHeight: 213, Md5: "abc"}},
+		{"thumbnail only", WeChatMessage{Type: Wechat_Message_Type_Picture,
+			Content: `<msg><img cdnthumbwidth="120" cdnthumbheight="213"/></msg>`},
+			MediaInfo{ThumbWidth: 120, ThumbHeight: 213}},
+		{"video", WeChatMessage{Type: Wechat_Message_Type_Video,
+			Content: `<msg><videomsg md5="def" length="2048" playlength="12" cdnthumbwidth="288" cdnthumbheight="512"/></msg>`},
+			MediaInfo{ThumbWidth: 288, ThumbHeight: 512, Md5: "def", Size: 2048, Duration: 12}},
+		{"invalid", WeChatMessage{Type: Wechat_Message_Type_Video, Content: `<msg>`}, MediaInfo{}},
+		{"text", WeChatMessage{Type: Wechat_Message_Type_Text, Content: `<msg><img md5="abc"/></msg>`}, MediaInfo{}},
+	}
+
+	P := &WechatDataProvider{}
+	for _, test := range tests {
+		P.wechatMessageMediaHandle(&test.msg)
+		if test.msg.MediaInfo != test.want {
+			t.Errorf("%s: MediaInfo = %+v, want %+v", test.name, test.msg.MediaInfo, test.want)
+		}
+	}
+}
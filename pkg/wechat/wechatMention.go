@@ -0,0 +1,181 @@
+package wechat
+
+import (
+	"fmt"
+	"log"
+	"slices"
+)
+
+// WeChatMention is a chat room message mentioning self. JumpCursor opens
+// the session at the message, which leads the Forward half of the page.
+type WeChatMention struct {
+	Message    WeChatMessage `json:"Message"`
+	GroupName  string        `json:"GroupName"`
+	JumpCursor string        `json:"JumpCursor"`
+}
+
+// WeChatMentionList is a page of mentions. Total counts the mentions of
+// all pages and is only set on the first page. HasMore is false on the last page, whose NextCursor is empty,
+// a full page may still be followed by an empty last one.
+type WeChatMentionList struct {
+	Total      int             `json:"Total"`
+	Rows       []WeChatMention `json:"Rows"`
+	NextCursor string          `json:"NextCursor"`
+	HasMore    bool            `json:"HasMore"`
+}
+
+// mentionsSelf reports whether source mentions self or all.
+func mentionsSelf(source *MessageSourceInfo, selfName string) bool {
+	return source.AtAll || slices.Contains(source.AtUserList, selfName)
+}
+
+// wechatMentionCondition is the " And ..." clause of the received messages
+// of chatRooms that may mention self. The instr clauses only narrow the
+// rows down, the msgsource is checked after decoding.
+func (P *WechatDataProvider) wechatMentionCondition(chatRooms []string) (string, []interface{}) {
+	condition := fmt.Sprintf(" And StrTalker in (%s) And IsSender=0 And (instr(BytesExtra, ?)>0 OR instr(BytesExtra, ?)>0)",
+		sqlPlaceholders(len(chatRooms)))
+	args := append(stringsToArgs(chatRooms), []byte(P.SelfInfo.UserName), []byte(mentionAll))
+
+	return condition, args
+}
+
+// wechatCountMentions counts the chat room messages that mention self or
+// @all in all shards.
+func (P *WechatDataProvider) wechatCountMentions() (int, error) {
+	total := 0
+	for index := range P.msgDBs {
+		chatRooms := P.wechatShardChatRooms(index)
+		if len(chatRooms) == 0 {
+			continue
+		}
+
+		condition, args := P.wechatMentionCondition(chatRooms)
+		err := func() error {
+			querySql := "select ifnull(BytesExtra,'') from MSG where 1=1" + condition + ";"
+			rows, err := P.wechatQuery(P.msgDBs[index].db, querySql, args...)
+			if err != nil {
+				log.Printf("%s failed %v\n", querySql, err)
+				return err
+			}
+			defer rows.Close()
+
+			for rows.Next() {
+				var bytesExtra []byte
+				if err := rows.Scan(&bytesExtra); err != nil {
+					return err
+				}
+				extra, err := decodeMessageExtra(bytesExtra)
+				if err != nil {
+					continue
+				}
+				if source := extra.msgSource(); mentionsSelf(&source, P.SelfInfo.UserName) {
+					total += 1
+				}
+			}
+
+			return rows.Err()
+		}()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return total, nil
+}
+
+// WeChatGetMentionList returns the chat room messages that mention self or
+// @all across all groups, newest first, from cursor, which is empty for the
+// newest page. Only the shards holding chat rooms are scanned.
+func (P *WechatDataProvider) WeChatGetMentionList(cursor string, pageSize int) (*WeChatMentionList, error) {
+	List := &WeChatMentionList{}
+	List.Rows = make([]WeChatMention, 0)
+	if pageSize <= 0 {
+		List.NextCursor = cursor
+		List.HasMore = true
+		return List, nil
+	}
+
+	c, err := P.decodeMessageCursor(cursor, Message_Search_Forward)
+	if err != nil {
+		log.Println("decodeMessageCursor failed:", err)
+		return List, err
+	}
+
+	if len(cursor) == 0 {
+		List.Total, err = P.wechatCountMentions()
+		if err != nil {
+			log.Println("wechatCountMentions failed:", err)
+			return List, err
+		}
+	}
+
+	batchSize := max(pageSize, 30)
+
+	var bound string
+	var boundArgs []interface{}
+	if c.isTime() {
+		bound, boundArgs = c.sqlCondition(Message_Search_Forward)
+	}
+
+	index := 0
+	if !c.isTime() {
+		index = c.shard
+	}
+
+	last := c
+	for ; index < len(P.msgDBs); index++ {
+		if c.isTime() && P.msgDBs[index].startTime > c.time {
+			continue
+		}
+		chatRooms := P.wechatShardChatRooms(index)
+		if len(chatRooms) == 0 {
+			continue
+		}
+		condition, conditionArgs := P.wechatMentionCondition(chatRooms)
+
+		var position string
+		var positionArgs []interface{}
+		if !c.isTime() && index == c.shard {
+			position, positionArgs = c.sqlCondition(Message_Search_Forward)
+		}
+
+		for {
+			args := append(append(append([]interface{}{}, boundArgs...), positionArgs...), conditionArgs...)
+			batch, err := P.wechatQueryMessageList(index, "", batchSize, Message_Search_Forward, bound+position+condition, args)
+			if err != nil {
+				return List, err
+			}
+
+			for i := range batch {
+				msg := &batch[i]
+				last = messageCursorOf(msg)
+				P.wechatMessageExtraHandle(msg)
+				msg.handled |= msgHandledExtra
+				if !mentionsSelf(&msg.SourceInfo, P.SelfInfo.UserName) {
+					continue
+				}
+
+				P.wechatMessageHandle(msg)
+				mention := WeChatMention{Message: *msg}
+				if info, err := P.WechatGetUserInfoByNameOnCache(msg.Talker); err == nil {
+					mention.GroupName = userDisplayName(info)
+				}
+				mention.JumpCursor = P.encodeMessageCursor(jumpCursorOf(msg))
+				List.Rows = append(List.Rows, mention)
+				if len(List.Rows) >= pageSize {
+					List.NextCursor = P.encodeMessageCursor(last)
+					List.HasMore = true
+					return List, nil
+				}
+			}
+
+			if len(batch) < batchSize {
+				break
+			}
+			position, positionArgs = last.sqlCondition(Message_Search_Forward)
+		}
+	}
+
+	return List, nil
+}
@@ -0,0 +1,97 @@
+package wechat
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+const (
+	oggHeaderTypeBOS = 0x02
+	oggHeaderTypeEOS = 0x04
+	oggMaxSegments   = 255
+	// opusGranuleRate is the rate granule positions count at, whatever
+	// the input sample rate of the encoder was.
+	opusGranuleRate = 48000
+	opusPreSkip     = 312
+	opusVendor      = "wechatDataBackup"
+)
+
+var oggCRCTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+func oggCRC(buf []byte) uint32 {
+	var crc uint32
+	for _, b := range buf {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+// oggWriter writes a single logical Ogg stream, one packet per page.
+type oggWriter struct {
+	w        io.Writer
+	serial   uint32
+	sequence uint32
+}
+
+func newOggWriter(w io.Writer, serial uint32) *oggWriter {
+	return &oggWriter{w: w, serial: serial}
+}
+
+func (ow *oggWriter) writePacket(packet []byte, granule uint64, headerType byte) error {
+	segments := len(packet)/255 + 1
+	if segments > oggMaxSegments {
+		return io.ErrShortWrite
+	}
+
+	page := make([]byte, 27+segments, 27+segments+len(packet))
+	copy(page, "OggS")
+	page[5] = headerType
+	binary.LittleEndian.PutUint64(page[6:], granule)
+	binary.LittleEndian.PutUint32(page[14:], ow.serial)
+	binary.LittleEndian.PutUint32(page[18:], ow.sequence)
+	page[26] = byte(segments)
+	for i := 0; i < segments-1; i++ {
+		page[27+i] = 255
+	}
+	page[27+segments-1] = byte(len(packet) % 255)
+	page = append(page, packet...)
+	binary.LittleEndian.PutUint32(page[22:], oggCRC(page))
+
+	ow.sequence += 1
+	_, err := ow.w.Write(page)
+	return err
+}
+
+// writeOpusHeaders writes the OpusHead and OpusTags pages of a mono stream
+// as RFC 7845 requires before any audio packet.
+func (ow *oggWriter) writeOpusHeaders(sampleRate int) error {
+	head := make([]byte, 19)
+	copy(head, "OpusHead")
+	head[8] = 1
+	head[9] = 1
+	binary.LittleEndian.PutUint16(head[10:], opusPreSkip)
+	binary.LittleEndian.PutUint32(head[12:], uint32(sampleRate))
+	if err := ow.writePacket(head, 0, oggHeaderTypeBOS); err != nil {
+		return err
+	}
+
+	tags := []byte("OpusTags")
+	tags = binary.LittleEndian.AppendUint32(tags, uint32(len(opusVendor)))
+	tags = append(tags, opusVendor...)
+	tags = binary.LittleEndian.AppendUint32(tags, 0)
+	return ow.writePacket(tags, 0, 0)
+}
@@ -0,0 +1,172 @@
+package wechat
+
+import (
+	"container/list"
+	"database/sql"
+	"log"
+	"strings"
+	"sync"
+)
+
+// stmtCacheLimit bounds the statements kept per db handle, queries built
+// from IN lists and filters differ in text and would otherwise pile up.
+const stmtCacheLimit = 128
+
+// wechatStmtCache keeps the prepared statements of every db handle, keyed
+// by query text, so each query is parsed by sqlite only once. The least
+// recently used statement is closed once a handle has stmtCacheLimit.
+type wechatStmtCache struct {
+	mtx   sync.Mutex
+	stmts map[*sql.DB]*wechatDBStmts
+}
+
+type wechatDBStmts struct {
+	queries map[string]*list.Element
+	lru     *list.List // of *wechatCachedStmt, most recently used first
+}
+
+// wechatCachedStmt is a cached statement, an evicted statement is closed
+// by the last user releasing it.
+type wechatCachedStmt struct {
+	stmt    *sql.Stmt
+	query   string
+	users   int
+	evicted bool
+}
+
+// prepare returns the statement of query, it must be given back with
+// release once the statement has been run.
+func (c *wechatStmtCache) prepare(db *sql.DB, query string) (*wechatCachedStmt, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.stmts == nil {
+		c.stmts = make(map[*sql.DB]*wechatDBStmts)
+	}
+	dbStmts, ok := c.stmts[db]
+	if !ok {
+		dbStmts = &wechatDBStmts{queries: make(map[string]*list.Element), lru: list.New()}
+		c.stmts[db] = dbStmts
+	}
+
+	if elem, ok := dbStmts.queries[query]; ok {
+		dbStmts.lru.MoveToFront(elem)
+		cached := elem.Value.(*wechatCachedStmt)
+		cached.users += 1
+		return cached, nil
+	}
+
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	cached := &wechatCachedStmt{stmt: stmt, query: query, users: 1}
+	dbStmts.queries[query] = dbStmts.lru.PushFront(cached)
+
+	for dbStmts.lru.Len() > stmtCacheLimit {
+		old := dbStmts.lru.Remove(dbStmts.lru.Back()).(*wechatCachedStmt)
+		delete(dbStmts.queries, old.query)
+		old.evicted = true
+		if old.users == 0 {
+			closeStmt(old.stmt)
+		}
+	}
+
+	return cached, nil
+}
+
+func (c *wechatStmtCache) release(cached *wechatCachedStmt) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	cached.users -= 1
+	if cached.evicted && cached.users == 0 {
+		closeStmt(cached.stmt)
+	}
+}
+
+// close releases the statements of db, it must be called before db.Close.
+func (c *wechatStmtCache) close(db *sql.DB) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	dbStmts, ok := c.stmts[db]
+	if !ok {
+		return
+	}
+	for elem := dbStmts.lru.Front(); elem != nil; elem = elem.Next() {
+		cached := elem.Value.(*wechatCachedStmt)
+		cached.evicted = true
+		closeStmt(cached.stmt)
+	}
+	delete(c.stmts, db)
+}
+
+func (c *wechatStmtCache) closeAll() {
+	c.mtx.Lock()
+	dbs := make([]*sql.DB, 0, len(c.stmts))
+	for db := range c.stmts {
+		dbs = append(dbs, db)
+	}
+	c.mtx.Unlock()
+
+	for _, db := range dbs {
+		c.close(db)
+	}
+}
+
+func closeStmt(stmt *sql.Stmt) {
+	if err := stmt.Close(); err != nil {
+		log.Println("stmt close:", err)
+	}
+}
+
+func (P *WechatDataProvider) wechatQuery(db *sql.DB, query string, args ...interface{}) (*sql.Rows, error) {
+	cached, err := P.stmtCache.prepare(db, query)
+	if err != nil {
+		return nil, err
+	}
+	defer P.stmtCache.release(cached)
+
+	// the rows keep the statement open on their own after an eviction
+	return cached.stmt.Query(args...)
+}
+
+func (P *WechatDataProvider) wechatQueryRow(db *sql.DB, query string, args ...interface{}) *sql.Row {
+	cached, err := P.stmtCache.prepare(db, query)
+	if err != nil {
+		// let QueryRow report the prepare error through Scan
+		return db.QueryRow(query, args...)
+	}
+	defer P.stmtCache.release(cached)
+
+	return cached.stmt.QueryRow(args...)
+}
+
+func (P *WechatDataProvider) wechatExec(db *sql.DB, query string, args ...interface{}) (sql.Result, error) {
+	cached, err := P.stmtCache.prepare(db, query)
+	if err != nil {
+		return nil, err
+	}
+	defer P.stmtCache.release(cached)
+
+	return cached.stmt.Exec(args...)
+}
+
+// sqlPlaceholders returns "?, ?, ..." with n placeholders.
+func sqlPlaceholders(n int) string {
+	if n <= 0 {
+		return ""
+	}
+
+	return strings.Repeat("?, ", n-1) + "?"
+}
+
+func stringsToArgs(values []string) []interface{} {
+	args := make([]interface{}, len(values))
+	for i, v := range values {
+		args[i] = v
+	}
+
+	return args
+}
@@ -0,0 +1,45 @@
+package wechat
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestStmtCacheLimit(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("sql.Open failed: %v", err)
+	}
+	defer db.Close()
+
+	P := &WechatDataProvider{}
+	defer P.stmtCache.closeAll()
+
+	// an evicted statement stays usable for rows that are still open
+	rows, err := P.wechatQuery(db, "select 0 union all select 1;")
+	if err != nil {
+		t.Fatalf("wechatQuery failed: %v", err)
+	}
+	defer rows.Close()
+
+	for i := 1; i <= stmtCacheLimit+10; i++ {
+		var got int
+		if err := P.wechatQueryRow(db, fmt.Sprintf("select %d;", i)).Scan(&got); err != nil || got != i {
+			t.Fatalf("select %d = %d, %v", i, got, err)
+		}
+	}
+	if n := P.stmtCache.stmts[db].lru.Len(); n != stmtCacheLimit {
+		t.Errorf("%d statements cached, want %d", n, stmtCacheLimit)
+	}
+
+	count := 0
+	for rows.Next() {
+		count += 1
+	}
+	if err := rows.Err(); err != nil || count != 2 {
+		t.Errorf("rows after eviction: %d rows, %v", count, err)
+	}
+}
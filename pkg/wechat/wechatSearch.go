@@ -0,0 +1,482 @@
+package wechat
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+const (
+	SearchIndexDB = "SearchIndex.db"
+)
+
+const (
+	searchIndexBatch     = 2000
+	searchSnippetTokens  = 24
+	searchSnippetRunes   = 24
+	searchHighlightOpen  = "<mark>"
+	searchHighlightClose = "</mark>"
+	// snippet() and highlight() mark the matches with these, they are
+	// replaced with the highlight tags after the text is escaped
+	searchMarkOpen  = "\x02"
+	searchMarkClose = "\x03"
+	// the trigram tokenizer can only match keywords of 3 characters or more
+	searchMinMatchRunes = 3
+)
+
+var errSearchIndexUnavailable = errors.New("search index unavailable, fts5 is required")
+var errSearchIndexBuilding = errors.New("search index is building")
+
+// WeChatSearchResult is a matched message, Snippet and Highlight are HTML
+// escaped with the matches wrapped in <mark> tags. LocalTime is CreateTime
+// in the configured time zone.
+type WeChatSearchResult struct {
+	Talker     string         `json:"Talker"`
+	TalkerInfo WeChatUserInfo `json:"TalkerInfo"`
+	UserInfo   WeChatUserInfo `json:"UserInfo"`
+	LocalId    int            `json:"LocalId"`
+	MsgSvrId   string         `json:"MsgSvrId"`
+	Type       int            `json:"type"`
+	SubType    int            `json:"SubType"`
+	IsSender   int            `json:"IsSender"`
+	CreateTime int64          `json:"createTime"`
+	LocalTime  string         `json:"LocalTime"`
+	Snippet    string         `json:"Snippet"`
+	Highlight  string         `json:"Highlight"`
+}
+
+type WeChatSearchResultList struct {
+	KeyWord string               `json:"KeyWord"`
+	Total   int                  `json:"Total"`
+	Rows    []WeChatSearchResult `json:"Rows"`
+}
+
+// openSearchIndexDB opens the full-text index of all sessions, it returns
+// nil when sqlite is built without fts5 (build with
+// CGO_CFLAGS=-DSQLITE_ENABLE_FTS5).
+func openSearchIndexDB(path string) *sql.DB {
+	db, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		log.Printf("open db %s error: %v", path, err)
+		return nil
+	}
+
+	createMsgIndexTable := `
+	CREATE VIRTUAL TABLE IF NOT EXISTS msgIndex USING fts5(
+		content,
+		talker UNINDEXED,
+		sender UNINDEXED,
+		shard UNINDEXED,
+		localId UNINDEXED,
+		msgSvrId UNINDEXED,
+		createTime UNINDEXED,
+		type UNINDEXED,
+		subType UNINDEXED,
+		isSender UNINDEXED,
+		tokenize = 'trigram'
+	);`
+
+	_, err = db.Exec(createMsgIndexTable)
+	if err != nil {
+		log.Printf("create msgIndex table failed: %v", err)
+		db.Close()
+		return nil
+	}
+
+	createIndexProgressTable := `
+	CREATE TABLE IF NOT EXISTS indexProgress (
+		shard TEXT PRIMARY KEY,
+		lastLocalId INTEGER DEFAULT 0
+	);`
+
+	_, err = db.Exec(createIndexProgressTable)
+	if err != nil {
+		log.Printf("create indexProgress table failed: %v", err)
+		db.Close()
+		return nil
+	}
+
+	return db
+}
+
+// searchIndexText returns the searchable text of a message, the same
+// fields weChatMessageContains looks at.
+func searchIndexText(msg *WeChatMessage) string {
+	texts := make([]string, 0, 2)
+	switch msg.Type {
+	case Wechat_Message_Type_Text:
+		texts = append(texts, msg.Content)
+	case Wechat_Message_Type_Location:
+		texts = append(texts, msg.LocationInfo.Label, msg.LocationInfo.PoiName)
+	case Wechat_Message_Type_Misc:
+		switch msg.SubType {
+		case Wechat_Misc_Message_CardLink, Wechat_Misc_Message_ThirdVideo:
+			texts = append(texts, msg.LinkInfo.Title, msg.LinkInfo.Description)
+		case Wechat_Misc_Message_Applet, Wechat_Misc_Message_Applet2:
+			texts = append(texts, msg.LinkInfo.Title, msg.LinkInfo.Description, msg.AppletInfo.DisPlayName)
+		case Wechat_Misc_Message_Refer:
+			texts = append(texts, msg.Content, msg.ReferInfo.Content)
+		case Wechat_Misc_Message_File:
+			texts = append(texts, msg.FileInfo.FileName)
+		case Wechat_Misc_Message_TEXT:
+			texts = append(texts, msg.Content)
+		case Wechat_Misc_Message_ForwardMessage:
+			texts = append(texts, msg.ForwardInfo.Title, msg.ForwardInfo.Description)
+		case Wechat_Misc_Message_Game:
+			texts = append(texts, msg.LinkInfo.Title, msg.GameInfo.Name)
+		case Wechat_Misc_Message_RedPacket:
+			texts = append(texts, msg.RedPacketInfo.Greeting)
+		case Wechat_Misc_Message_Notice:
+			texts = append(texts, msg.NoticeInfo.Text)
+		}
+	}
+
+	result := make([]string, 0, len(texts))
+	for _, text := range texts {
+		if text = strings.TrimSpace(text); len(text) > 0 {
+			result = append(result, text)
+		}
+	}
+
+	return strings.Join(result, "\n")
+}
+
+// WeChatBuildSearchIndex indexes every message added since the last build,
+// each shard remembers the last localId it has indexed.
+func (P *WechatDataProvider) WeChatBuildSearchIndex(progress chan<- string) error {
+	defer close(progress)
+	if P.searchIndex == nil {
+		progress <- fmt.Sprintf("{\"status\":\"error\", \"result\":\"%v\"}", errSearchIndexUnavailable)
+		return errSearchIndexUnavailable
+	}
+
+	if !atomic.CompareAndSwapInt32(&P.searchBuilding, 0, 1) {
+		progress <- fmt.Sprintf("{\"status\":\"error\", \"result\":\"%v\"}", errSearchIndexBuilding)
+		return errSearchIndexBuilding
+	}
+	defer atomic.StoreInt32(&P.searchBuilding, 0)
+
+	if !P.wechatBackgroundStart() {
+		return nil
+	}
+	defer P.bgWg.Done()
+
+	progress <- "{\"status\":\"processing\", \"result\":\"build search index start\", \"progress\": 0}"
+	total := 0
+	lastLocalIds := make([]int64, len(P.msgDBs))
+	for i, msgDB := range P.msgDBs {
+		lastLocalIds[i] = P.wechatSearchIndexProgress(msgDB)
+		count := 0
+		err := P.wechatQueryRow(msgDB.db, "select count(*) from MSG where localId>? And Type in (?, ?, ?);", lastLocalIds[i],
+			Wechat_Message_Type_Text, Wechat_Message_Type_Location, Wechat_Message_Type_Misc).Scan(&count)
+		if err != nil {
+			log.Println("count MSG failed:", msgDB.path, err)
+		}
+		total += count
+	}
+	log.Println("search index pending:", total)
+
+	handled := 0
+	lastPercent := 0
+	for i, msgDB := range P.msgDBs {
+		for {
+			select {
+			case <-P.quit:
+				log.Println("build search index quit")
+				return nil
+			default:
+			}
+
+			n, lastLocalId, err := P.wechatIndexMsgBatch(msgDB, lastLocalIds[i])
+			if err != nil {
+				log.Println("wechatIndexMsgBatch failed:", msgDB.path, err)
+				progress <- fmt.Sprintf("{\"status\":\"error\", \"result\":\"%v\"}", err)
+				return err
+			}
+			if n == 0 {
+				break
+			}
+			lastLocalIds[i] = lastLocalId
+			handled += n
+
+			if total > 0 {
+				percent := min(handled*100/total, 99)
+				if percent > lastPercent {
+					lastPercent = percent
+					progress <- fmt.Sprintf("{\"status\":\"processing\", \"result\":\"build search index doing\", \"progress\": %d}", percent)
+				}
+			}
+		}
+	}
+
+	progress <- "{\"status\":\"processing\", \"result\":\"build search index end\", \"progress\": 100}"
+	return nil
+}
+
+// wechatSearchIndexProgress returns the last localId indexed for msgDB, a
+// shard that has been exported again with less messages starts over.
+func (P *WechatDataProvider) wechatSearchIndexProgress(msgDB *wechatMsgDB) int64 {
+	shard := filepath.Base(msgDB.path)
+	var lastLocalId, maxLocalId int64
+	err := P.wechatQueryRow(P.searchIndex, "select lastLocalId from indexProgress where shard=?;", shard).Scan(&lastLocalId)
+	if err != nil {
+		return 0
+	}
+
+	err = P.wechatQueryRow(msgDB.db, "select ifnull(max(localId),0) from MSG;").Scan(&maxLocalId)
+	if err != nil || maxLocalId >= lastLocalId {
+		return lastLocalId
+	}
+
+	log.Printf("%s changed, reindex %d > %d\n", shard, lastLocalId, maxLocalId)
+	if _, err := P.wechatExec(P.searchIndex, "delete from msgIndex where shard=?;", shard); err != nil {
+		log.Println("delete msgIndex failed:", err)
+	}
+	if _, err := P.wechatExec(P.searchIndex, "delete from indexProgress where shard=?;", shard); err != nil {
+		log.Println("delete indexProgress failed:", err)
+	}
+
+	return 0
+}
+
+func (P *WechatDataProvider) wechatIndexMsgBatch(msgDB *wechatMsgDB, lastLocalId int64) (int, int64, error) {
+	querySql := "select localId,MsgSvrID,Type,SubType,IsSender,CreateTime,ifnull(StrTalker,'') as StrTalker, ifnull(StrContent,'') as StrContent,ifnull(CompressContent,'') as CompressContent,ifnull(BytesExtra,'') as BytesExtra from MSG where localId>? And Type in (?, ?, ?) order by localId asc limit ?;"
+	rows, err := P.wechatQuery(msgDB.db, querySql, lastLocalId, Wechat_Message_Type_Text, Wechat_Message_Type_Location, Wechat_Message_Type_Misc, searchIndexBatch)
+	if err != nil {
+		return 0, lastLocalId, err
+	}
+
+	messages := make([]WeChatMessage, 0, searchIndexBatch)
+	for rows.Next() {
+		var MsgSvrID int64
+		message := WeChatMessage{}
+		err = rows.Scan(&message.LocalId, &MsgSvrID, &message.Type, &message.SubType, &message.IsSender, &message.CreateTime,
+			&message.Talker, &message.Content, &message.compressContent, &message.bytesExtra)
+		if err != nil {
+			rows.Close()
+			return 0, lastLocalId, err
+		}
+		message.MsgSvrId = fmt.Sprintf("%d", MsgSvrID)
+		message.IsChatRoom = strings.HasSuffix(message.Talker, "@chatroom")
+		messages = append(messages, message)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, lastLocalId, err
+	}
+
+	if len(messages) == 0 {
+		return 0, lastLocalId, nil
+	}
+
+	shard := filepath.Base(msgDB.path)
+	tx, err := P.searchIndex.Begin()
+	if err != nil {
+		return 0, lastLocalId, err
+	}
+
+	insertSql := "INSERT INTO msgIndex (content, talker, sender, shard, localId, msgSvrId, createTime, type, subType, isSender) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?);"
+	for i := range messages {
+		msg := &messages[i]
+		P.wechatMessageExtraHandle(msg)
+		P.wechatMessageCompressContentHandle(msg)
+		P.wechatMessageLocationHandke(msg)
+		content := searchIndexText(msg)
+		if len(content) == 0 {
+			continue
+		}
+
+		_, err := tx.Exec(insertSql, content, msg.Talker, msg.UserInfo.UserName, shard, msg.LocalId, msg.MsgSvrId, msg.CreateTime, msg.Type, msg.SubType, msg.IsSender)
+		if err != nil {
+			tx.Rollback()
+			return 0, lastLocalId, err
+		}
+	}
+
+	lastLocalId = int64(messages[len(messages)-1].LocalId)
+	_, err = tx.Exec("INSERT OR REPLACE INTO indexProgress (shard, lastLocalId) VALUES (?, ?);", shard, lastLocalId)
+	if err != nil {
+		tx.Rollback()
+		return 0, lastLocalId, err
+	}
+
+	return len(messages), lastLocalId, tx.Commit()
+}
+
+// WeChatSearchMessages searches keyWord in every session, or only in
+// userName when it is not empty, newest first.
+func (P *WechatDataProvider) WeChatSearchMessages(keyWord, userName string, pageIndex, pageSize int) (*WeChatSearchResultList, error) {
+	List := &WeChatSearchResultList{}
+	List.Rows = make([]WeChatSearchResult, 0)
+	List.KeyWord = keyWord
+
+	if P.searchIndex == nil {
+		return List, errSearchIndexUnavailable
+	}
+
+	keyWord = strings.TrimSpace(keyWord)
+	if len(keyWord) == 0 {
+		return List, nil
+	}
+
+	useMatch := utf8.RuneCountInString(keyWord) >= searchMinMatchRunes
+	condition := "msgIndex MATCH ?"
+	arg := "\"" + strings.ReplaceAll(keyWord, "\"", "\"\"") + "\""
+	columns := fmt.Sprintf("snippet(msgIndex, 0, '%s', '%s', '...', %d), highlight(msgIndex, 0, '%s', '%s')",
+		searchMarkOpen, searchMarkClose, searchSnippetTokens, searchMarkOpen, searchMarkClose)
+	if !useMatch {
+		condition = "content LIKE ? ESCAPE '\\'"
+		arg = "%" + sqlLikeEscape(keyWord) + "%"
+		columns = "content, content"
+	}
+
+	args := []interface{}{arg}
+	if len(userName) > 0 {
+		condition += " And talker=?"
+		args = append(args, userName)
+	}
+
+	err := P.wechatQueryRow(P.searchIndex, "select count(*) from msgIndex where "+condition+";", args...).Scan(&List.Total)
+	if err != nil {
+		log.Println("search count failed:", err)
+		return List, err
+	}
+
+	querySql := fmt.Sprintf("select talker, sender, localId, msgSvrId, createTime, type, subType, isSender, %s from msgIndex where %s order by createTime desc limit ?, ?;", columns, condition)
+	rows, err := P.wechatQuery(P.searchIndex, querySql, append(args, pageIndex*pageSize, pageSize)...)
+	if err != nil {
+		log.Printf("%s failed %v\n", querySql, err)
+		return List, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		result := WeChatSearchResult{}
+		var sender string
+		err := rows.Scan(&result.Talker, &sender, &result.LocalId, &result.MsgSvrId, &result.CreateTime,
+			&result.Type, &result.SubType, &result.IsSender, &result.Snippet, &result.Highlight)
+		if err != nil {
+			log.Println("rows.Scan failed", err)
+			return List, err
+		}
+
+		result.LocalTime = localTimeText(result.CreateTime)
+		if useMatch {
+			result.Snippet = searchMarkup(result.Snippet)
+			result.Highlight = searchMarkup(result.Highlight)
+		} else {
+			result.Snippet = searchSnippet(result.Snippet, keyWord)
+			result.Highlight = searchHighlight(result.Highlight, keyWord)
+		}
+
+		if info, err := P.WechatGetUserInfoByNameOnCache(result.Talker); err == nil {
+			result.TalkerInfo = *info
+		}
+
+		if result.IsSender == 1 {
+			result.UserInfo = *P.SelfInfo
+		} else if len(sender) > 0 {
+			if info, err := P.WechatGetUserInfoByNameOnCache(sender); err == nil {
+				result.UserInfo = *info
+			} else {
+				result.UserInfo.UserName = sender
+			}
+		} else {
+			result.UserInfo = result.TalkerInfo
+		}
+
+		List.Rows = append(List.Rows, result)
+	}
+
+	return List, rows.Err()
+}
+
+func sqlLikeEscape(s string) string {
+	replacer := strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_")
+	return replacer.Replace(s)
+}
+
+// searchMarkup escapes text marked by snippet() or highlight() and turns
+// the marks into highlight tags.
+func searchMarkup(text string) string {
+	replacer := strings.NewReplacer(searchMarkOpen, searchHighlightOpen, searchMarkClose, searchHighlightClose)
+	return replacer.Replace(html.EscapeString(text))
+}
+
+// searchMatches returns the rune ranges of the matches of keyWord in runes.
+// Case is ignored like LIKE and the trigram tokenizer do.
+func searchMatches(runes []rune, keyWord string) [][2]int {
+	matches := make([][2]int, 0)
+	n := utf8.RuneCountInString(keyWord)
+	if n == 0 {
+		return matches
+	}
+
+	for i := 0; i+n <= len(runes); {
+		if strings.EqualFold(string(runes[i:i+n]), keyWord) {
+			matches = append(matches, [2]int{i, i + n})
+			i += n
+		} else {
+			i += 1
+		}
+	}
+
+	return matches
+}
+
+// searchEscape escapes runes and wraps the matches in highlight tags.
+func searchEscape(runes []rune, matches [][2]int) string {
+	var b strings.Builder
+	last := 0
+	for _, match := range matches {
+		b.WriteString(html.EscapeString(string(runes[last:match[0]])))
+		b.WriteString(searchHighlightOpen)
+		b.WriteString(html.EscapeString(string(runes[match[0]:match[1]])))
+		b.WriteString(searchHighlightClose)
+		last = match[1]
+	}
+	b.WriteString(html.EscapeString(string(runes[last:])))
+
+	return b.String()
+}
+
+func searchHighlight(content, keyWord string) string {
+	runes := []rune(content)
+	return searchEscape(runes, searchMatches(runes, keyWord))
+}
+
+// searchSnippet cuts content around the first keyWord like snippet() does
+// for fts5 queries.
+func searchSnippet(content, keyWord string) string {
+	runes := []rune(content)
+	matches := searchMatches(runes, keyWord)
+	start, end := 0, utf8.RuneCountInString(keyWord)
+	if len(matches) > 0 {
+		start, end = matches[0][0], matches[0][1]
+	}
+	from := max(start-searchSnippetRunes/2, 0)
+	to := min(end+searchSnippetRunes/2, len(runes))
+
+	inside := make([][2]int, 0, len(matches))
+	for _, match := range matches {
+		if match[0] >= from && match[1] <= to {
+			inside = append(inside, [2]int{match[0] - from, match[1] - from})
+		}
+	}
+
+	snippet := searchEscape(runes[from:to], inside)
+	if from > 0 {
+		snippet = "..." + snippet
+	}
+	if to < len(runes) {
+		snippet += "..."
+	}
+
+	return snippet
+}
@@ -0,0 +1,63 @@
+package wechat
+
+import "testing"
+
+func TestSearchHighlight(t *testing.T) {
+	tests := []struct {
+		content string
+		keyWord string
+		want    string
+	}{
+		{"hello world", "wo", "hello <mark>wo</mark>rld"},
+		{"Hello hello", "he", "<mark>He</mark>llo <mark>he</mark>llo"},
+		{"你好你好", "你好", "<mark>你好</mark><mark>你好</mark>"},
+		{"<b>ab</b>", "ab", "&lt;b&gt;<mark>ab</mark>&lt;/b&gt;"},
+		{"<script>", "sc", "&lt;<mark>sc</mark>ript&gt;"},
+		{"no match", "xy", "no match"},
+		{"aaa", "aa", "<mark>aa</mark>a"},
+	}
+
+	for _, test := range tests {
+		if got := searchHighlight(test.content, test.keyWord); got != test.want {
+			t.Errorf("searchHighlight(%q, %q) = %q, want %q", test.content, test.keyWord, got, test.want)
+		}
+	}
+}
+
+func TestSearchSnippet(t *testing.T) {
+	tests := []struct {
+		content string
+		keyWord string
+		want    string
+	}{
+		{"short ok", "ok", "short <mark>ok</mark>"},
+		{"0123456789abcdefghijOKklmnopqrstuvwxyz0123456789", "ok",
+			"...89abcdefghij<mark>OK</mark>klmnopqrstuv..."},
+		{"<img src=x onerror=alert(1)> ok", "ok", "...r=alert(1)&gt; <mark>ok</mark>"},
+		{"abcdefghijklmnopqrstuvwxyz", "zz", "abcdefghijklmn..."},
+		{"", "ok", ""},
+	}
+
+	for _, test := range tests {
+		if got := searchSnippet(test.content, test.keyWord); got != test.want {
+			t.Errorf("searchSnippet(%q, %q) = %q, want %q", test.content, test.keyWord, got, test.want)
+		}
+	}
+}
+
+func TestSearchMarkup(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"a \x02b\x03 c", "a <mark>b</mark> c"},
+		{"<i>\x02x\x03</i>", "&lt;i&gt;<mark>x</mark>&lt;/i&gt;"},
+		{"\"q\" & 'a'", "&#34;q&#34; &amp; &#39;a&#39;"},
+	}
+
+	for _, test := range tests {
+		if got := searchMarkup(test.text); got != test.want {
+			t.Errorf("searchMarkup(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
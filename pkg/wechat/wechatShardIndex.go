@@ -0,0 +1,200 @@
+package wechat
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// wechatTalkerShard is what a MSG shard holds of one talker.
+type wechatTalkerShard struct {
+	index   int
+	minTime int64
+	maxTime int64
+	count   int
+}
+
+type WeChatMessageCount struct {
+	UserName string `json:"UserName"`
+	Total    int    `json:"Total"`
+}
+
+// shardFingerprint changes whenever messages are added to or removed from
+// the shard. localId only grows so it catches additions, the row count
+// catches deletions that keep the newest message.
+func (P *WechatDataProvider) shardFingerprint(msgDB *wechatMsgDB) string {
+	var maxLocalId, count int64
+	err := P.wechatQueryRow(msgDB.db, "select ifnull(max(localId), 0), count(*) from MSG;").Scan(&maxLocalId, &count)
+	if err != nil {
+		log.Println("select max localId failed:", msgDB.path, err)
+	}
+
+	return fmt.Sprintf("%d:%d:%d:%d", maxLocalId, count, msgDB.startTime, msgDB.endTime)
+}
+
+// wechatBuildShardIndex fills P.shardIndex with the talkers of every shard.
+// The result is kept in Sidecar.db and a shard is only scanned again when
+// its fingerprint changed.
+func (P *WechatDataProvider) wechatBuildShardIndex() {
+	P.shardIndex = make(map[string][]wechatTalkerShard)
+	for index, msgDB := range P.msgDBs {
+		shard := filepath.Base(msgDB.path)
+		fingerprint := P.shardFingerprint(msgDB)
+
+		talkers, err := P.wechatLoadShardIndex(shard, fingerprint, index)
+		if err != nil || talkers == nil {
+			talkers, err = P.wechatScanShardIndex(msgDB, index)
+			if err != nil {
+				log.Println("wechatScanShardIndex failed:", msgDB.path, err)
+				continue
+			}
+			if err := P.wechatSaveShardIndex(shard, fingerprint, talkers); err != nil {
+				log.Println("wechatSaveShardIndex failed:", msgDB.path, err)
+			}
+		}
+
+		for talker, info := range talkers {
+			P.shardIndex[talker] = append(P.shardIndex[talker], info)
+		}
+	}
+
+	for _, shards := range P.shardIndex {
+		sort.Slice(shards, func(i, j int) bool { return shards[i].index < shards[j].index })
+	}
+	log.Println("shard index talker number:", len(P.shardIndex))
+}
+
+// wechatLoadShardIndex returns nil when Sidecar.db has no index of the
+// shard with this fingerprint.
+func (P *WechatDataProvider) wechatLoadShardIndex(shard, fingerprint string, index int) (map[string]wechatTalkerShard, error) {
+	if P.sidecar == nil {
+		return nil, nil
+	}
+
+	var saved string
+	err := P.wechatQueryRow(P.sidecar, "select fingerprint from shardInfo where shard=?;", shard).Scan(&saved)
+	if err != nil || saved != fingerprint {
+		return nil, nil
+	}
+
+	rows, err := P.wechatQuery(P.sidecar, "select talker, minTime, maxTime, count from talkerShard where shard=?;", shard)
+	if err != nil {
+		log.Println("select talkerShard failed:", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	talkers := make(map[string]wechatTalkerShard)
+	for rows.Next() {
+		var talker string
+		info := wechatTalkerShard{index: index}
+		if err := rows.Scan(&talker, &info.minTime, &info.maxTime, &info.count); err != nil {
+			log.Println("rows.Scan failed", err)
+			return nil, err
+		}
+		talkers[talker] = info
+	}
+
+	return talkers, rows.Err()
+}
+
+func (P *WechatDataProvider) wechatScanShardIndex(msgDB *wechatMsgDB, index int) (map[string]wechatTalkerShard, error) {
+	log.Println("scan shard index:", msgDB.path)
+	querySql := "select ifnull(StrTalker,''), min(CreateTime), max(CreateTime), count(*) from MSG group by StrTalker;"
+	rows, err := P.wechatQuery(msgDB.db, querySql)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	talkers := make(map[string]wechatTalkerShard)
+	for rows.Next() {
+		var talker string
+		info := wechatTalkerShard{index: index}
+		if err := rows.Scan(&talker, &info.minTime, &info.maxTime, &info.count); err != nil {
+			return nil, err
+		}
+		if len(talker) > 0 {
+			talkers[talker] = info
+		}
+	}
+
+	return talkers, rows.Err()
+}
+
+func (P *WechatDataProvider) wechatSaveShardIndex(shard, fingerprint string, talkers map[string]wechatTalkerShard) (err error) {
+	if P.sidecar == nil {
+		return nil
+	}
+
+	tx, err := P.sidecar.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if _, err = tx.Exec("DELETE FROM talkerShard WHERE shard=?;", shard); err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare("INSERT INTO talkerShard (talker, shard, minTime, maxTime, count) VALUES (?, ?, ?, ?, ?);")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for talker, info := range talkers {
+		if _, err = stmt.Exec(talker, shard, info.minTime, info.maxTime, info.count); err != nil {
+			return err
+		}
+	}
+
+	if _, err = tx.Exec("INSERT OR REPLACE INTO shardInfo (shard, fingerprint) VALUES (?, ?);", shard, fingerprint); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// wechatTalkerShard returns what shard index holds of userName, nil when
+// the shard has no message of userName.
+func (P *WechatDataProvider) wechatTalkerShard(userName string, index int) *wechatTalkerShard {
+	for i := range P.shardIndex[userName] {
+		if P.shardIndex[userName][i].index == index {
+			return &P.shardIndex[userName][i]
+		}
+	}
+
+	return nil
+}
+
+// wechatShardChatRooms returns the chat rooms with messages in the shard
+// index, sorted.
+func (P *WechatDataProvider) wechatShardChatRooms(index int) []string {
+	chatRooms := make([]string, 0)
+	for talker := range P.shardIndex {
+		if strings.HasSuffix(talker, "@chatroom") && P.wechatTalkerShard(talker, index) != nil {
+			chatRooms = append(chatRooms, talker)
+		}
+	}
+	sort.Strings(chatRooms)
+
+	return chatRooms
+}
+
+// WeChatGetMessageCount returns the number of messages of userName in all
+// shards.
+func (P *WechatDataProvider) WeChatGetMessageCount(userName string) *WeChatMessageCount {
+	count := &WeChatMessageCount{UserName: userName}
+	for _, info := range P.shardIndex[userName] {
+		count.Total += info.count
+	}
+
+	return count
+}
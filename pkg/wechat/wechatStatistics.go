@@ -0,0 +1,370 @@
+package wechat
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	statTopNumber = 10
+	// a reply later than this is a new conversation, not a response
+	statMaxResponseTime = 24 * 3600
+)
+
+var statEmoticonRegexp = regexp.MustCompile(`\[[\p{Han}A-Za-z]{1,10}\]`)
+
+type WeChatTypeCount struct {
+	Type    int `json:"Type"`
+	SubType int `json:"SubType"`
+	Total   int `json:"Total"`
+}
+
+type WeChatEmojiCount struct {
+	Emoji string `json:"Emoji"`
+	Path  string `json:"Path"`
+	Total int    `json:"Total"`
+}
+
+type WeChatStreak struct {
+	StartDate string `json:"StartDate"`
+	EndDate   string `json:"EndDate"`
+	Days      int    `json:"Days"`
+}
+
+// WeChatChatReport is the chat report of a contact or group. Heatmap rows
+// are weekdays from Sunday, columns hours of the day, both in the
+// configured time zone. Response times are in seconds, 0 when unknown, and
+// only computed for one-to-one sessions, see WeChatGroupAnalytics for the
+// response times between group members.
+type WeChatChatReport struct {
+	UserName           string             `json:"UserName"`
+	IsChatRoom         bool               `json:"IsChatRoom"`
+	Total              int                `json:"Total"`
+	Sent               int                `json:"Sent"`
+	Received           int                `json:"Received"`
+	SentRatio          float64            `json:"SentRatio"`
+	Types              []WeChatTypeCount  `json:"Types"`
+	HourHeatmap        [24]int            `json:"HourHeatmap"`
+	WeekdayHeatmap     [7]int             `json:"WeekdayHeatmap"`
+	Heatmap            [7][24]int         `json:"Heatmap"`
+	FirstDate          string             `json:"FirstDate"`
+	LastDate           string             `json:"LastDate"`
+	ActiveDays         int                `json:"ActiveDays"`
+	LongestStreak      WeChatStreak       `json:"LongestStreak"`
+	MyResponseTime     int64              `json:"MyResponseTime"`
+	PeerResponseTime   int64              `json:"PeerResponseTime"`
+	TopEmoji           []WeChatEmojiCount `json:"TopEmoji"`
+	TopStickers        []WeChatEmojiCount `json:"TopStickers"`
+	TimeZone           string             `json:"TimeZone"`
+	GeneratedTimestamp int64              `json:"GeneratedTimestamp"`
+}
+
+// wechatStatRow is the part of a message the statistics look at, content
+// is only read for text, emoji and system messages.
+type wechatStatRow struct {
+	createTime int64
+	msgType    int
+	subType    int
+	isSender   int
+	content    string
+	bytesExtra []byte
+}
+
+// wechatScanStatRows calls fn for every message of userName, oldest first.
+func (P *WechatDataProvider) wechatScanStatRows(userName string, withExtra bool, fn func(row *wechatStatRow)) error {
+	extraColumn := "''"
+	if withExtra {
+		extraColumn = "ifnull(BytesExtra,'')"
+	}
+	querySql := fmt.Sprintf("select CreateTime, Type, SubType, IsSender, case when Type in (?, ?, ?) then ifnull(StrContent,'') else '' end, %s from MSG where StrTalker=? order by Sequence asc, localId asc;", extraColumn)
+
+	// msgDBs are sorted newest first
+	for index := len(P.msgDBs) - 1; index >= 0; index-- {
+		if P.wechatTalkerShard(userName, index) == nil {
+			continue
+		}
+
+		err := func() error {
+			rows, err := P.wechatQuery(P.msgDBs[index].db, querySql, Wechat_Message_Type_Text, Wechat_Message_Type_Emoji,
+				Wechat_Message_Type_System, userName)
+			if err != nil {
+				log.Printf("%s failed %v\n", querySql, err)
+				return err
+			}
+			defer rows.Close()
+
+			for rows.Next() {
+				row := wechatStatRow{}
+				if err := rows.Scan(&row.createTime, &row.msgType, &row.subType, &row.isSender, &row.content, &row.bytesExtra); err != nil {
+					log.Println("rows.Scan failed", err)
+					return err
+				}
+				fn(&row)
+			}
+
+			return rows.Err()
+		}()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// dayNumber returns the days since 1970-01-01 of a local time, so that
+// consecutive days differ by one across DST changes.
+func dayNumber(t time.Time) int64 {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).Unix() / 86400
+}
+
+func dayNumberDate(day int64) string {
+	return time.Unix(day*86400, 0).UTC().Format("2006-01-02")
+}
+
+func longestStreak(days map[int64]bool) WeChatStreak {
+	sorted := make([]int64, 0, len(days))
+	for day := range days {
+		sorted = append(sorted, day)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	streak := WeChatStreak{}
+	start := 0
+	for i := range sorted {
+		if i > 0 && sorted[i] != sorted[i-1]+1 {
+			start = i
+		}
+		if i-start+1 > streak.Days {
+			streak.Days = i - start + 1
+			streak.StartDate = dayNumberDate(sorted[start])
+			streak.EndDate = dayNumberDate(sorted[i])
+		}
+	}
+
+	return streak
+}
+
+func median(values []int64) int64 {
+	if len(values) == 0 {
+		return 0
+	}
+
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	if len(values)%2 == 1 {
+		return values[len(values)/2]
+	}
+
+	return (values[len(values)/2-1] + values[len(values)/2]) / 2
+}
+
+func topEmojiCounts(counts map[string]int, n int) []WeChatEmojiCount {
+	top := make([]WeChatEmojiCount, 0, len(counts))
+	for emoji, total := range counts {
+		top = append(top, WeChatEmojiCount{Emoji: emoji, Total: total})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Total != top[j].Total {
+			return top[i].Total > top[j].Total
+		}
+		return top[i].Emoji < top[j].Emoji
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+
+	return top
+}
+
+func isEmojiRune(r rune) bool {
+	return (r >= 0x1F300 && r <= 0x1FAFF) || (r >= 0x2600 && r <= 0x27BF)
+}
+
+// wechatChatReport computes the report of userName from all its messages.
+func (P *WechatDataProvider) wechatChatReport(userName string) (*WeChatChatReport, error) {
+	report := &WeChatChatReport{UserName: userName, IsChatRoom: strings.HasSuffix(userName, "@chatroom")}
+	report.TimeZone = GetTimeZone()
+	report.GeneratedTimestamp = time.Now().Unix()
+
+	types := make(map[[2]int]int)
+	days := make(map[int64]bool)
+	emoji := make(map[string]int)
+	stickers := make(map[string]int)
+	stickerUrls := make(map[string]string)
+	myResponses := make([]int64, 0)
+	peerResponses := make([]int64, 0)
+	var firstTime, lastTime int64
+	lastSender := -1
+
+	err := P.wechatScanStatRows(userName, false, func(row *wechatStatRow) {
+		if isSystemMessage(row.msgType) {
+			return
+		}
+
+		report.Total += 1
+		if row.isSender == 1 {
+			report.Sent += 1
+		} else {
+			report.Received += 1
+		}
+
+		subType := 0
+		if row.msgType == Wechat_Message_Type_Misc {
+			subType = row.subType
+		}
+		types[[2]int{row.msgType, subType}] += 1
+
+		t := localTime(row.createTime)
+		report.HourHeatmap[t.Hour()] += 1
+		report.WeekdayHeatmap[t.Weekday()] += 1
+		report.Heatmap[t.Weekday()][t.Hour()] += 1
+		days[dayNumber(t)] = true
+
+		if firstTime == 0 {
+			firstTime = row.createTime
+		}
+		if !report.IsChatRoom && lastSender != -1 && lastSender != row.isSender {
+			if gap := row.createTime - lastTime; gap >= 0 && gap <= statMaxResponseTime {
+				if row.isSender == 1 {
+					myResponses = append(myResponses, gap)
+				} else {
+					peerResponses = append(peerResponses, gap)
+				}
+			}
+		}
+		lastTime = row.createTime
+		lastSender = row.isSender
+
+		switch row.msgType {
+		case Wechat_Message_Type_Text:
+			for _, e := range statEmoticonRegexp.FindAllString(row.content, -1) {
+				emoji[e] += 1
+			}
+			for _, r := range row.content {
+				if isEmojiRune(r) {
+					emoji[string(r)] += 1
+				}
+			}
+		case Wechat_Message_Type_Emoji:
+			emojiMsg := EmojiMsg{}
+			if err := xml.Unmarshal([]byte(row.content), &emojiMsg); err == nil && emojiMsg.Emoji.Md5 != "" {
+				stickers[emojiMsg.Emoji.Md5] += 1
+				stickerUrls[emojiMsg.Emoji.Md5] = emojiMsg.Emoji.CdnURL
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if report.Total == 0 {
+		report.Types = make([]WeChatTypeCount, 0)
+		report.TopEmoji = make([]WeChatEmojiCount, 0)
+		report.TopStickers = make([]WeChatEmojiCount, 0)
+		return report, nil
+	}
+
+	report.SentRatio = float64(report.Sent) / float64(report.Total)
+	report.FirstDate = localTime(firstTime).Format("2006-01-02")
+	report.LastDate = localTime(lastTime).Format("2006-01-02")
+	report.ActiveDays = len(days)
+	report.LongestStreak = longestStreak(days)
+	report.MyResponseTime = median(myResponses)
+	report.PeerResponseTime = median(peerResponses)
+
+	report.Types = make([]WeChatTypeCount, 0, len(types))
+	for key, total := range types {
+		report.Types = append(report.Types, WeChatTypeCount{Type: key[0], SubType: key[1], Total: total})
+	}
+	sort.Slice(report.Types, func(i, j int) bool { return report.Types[i].Total > report.Types[j].Total })
+
+	report.TopEmoji = topEmojiCounts(emoji, statTopNumber)
+	report.TopStickers = topEmojiCounts(stickers, statTopNumber)
+	for i := range report.TopStickers {
+		md5 := report.TopStickers[i].Emoji
+		report.TopStickers[i].Path = P.wechatGetAssetPath(stickerUrls[md5])
+		if localPath := P.wechatGetEmojiLocalPath(md5); localPath != "" {
+			report.TopStickers[i].Path = localPath
+		}
+	}
+
+	return report, nil
+}
+
+// wechatChatReportTable creates the report cache in UserData.db, which
+// may predate it.
+func (P *WechatDataProvider) wechatChatReportTable() bool {
+	if P.userData == nil {
+		return false
+	}
+
+	P.chatReportOnce.Do(func() {
+		createChatReportTable := `
+		CREATE TABLE IF NOT EXISTS chatReport (
+			userName TEXT PRIMARY KEY,
+			fingerprint TEXT,
+			report TEXT,
+			timestamp INT
+		);`
+		if _, err := P.userData.Exec(createChatReportTable); err != nil {
+			log.Printf("create chatReport table failed: %v", err)
+			return
+		}
+		P.chatReportReady = true
+	})
+
+	return P.chatReportReady
+}
+
+// chatReportFingerprint changes when messages of userName are added or the
+// time zone changes.
+func (P *WechatDataProvider) chatReportFingerprint(userName string) string {
+	var maxTime int64
+	for _, info := range P.shardIndex[userName] {
+		maxTime = max(maxTime, info.maxTime)
+	}
+
+	return fmt.Sprintf("%d:%d:%s", P.WeChatGetMessageCount(userName).Total, maxTime, GetTimeZone())
+}
+
+// WeChatGetChatReport returns the chat report of a contact or group. With
+// useCache a report saved in UserData.db is returned while the messages
+// did not change, and a new one is saved.
+func (P *WechatDataProvider) WeChatGetChatReport(userName string, useCache bool) (*WeChatChatReport, error) {
+	useCache = useCache && P.wechatChatReportTable()
+	fingerprint := P.chatReportFingerprint(userName)
+
+	if useCache {
+		var saved, reportStr string
+		err := P.wechatQueryRow(P.userData, "select fingerprint, report from chatReport where userName=?;", userName).Scan(&saved, &reportStr)
+		if err == nil && saved == fingerprint {
+			report := &WeChatChatReport{}
+			if err := json.Unmarshal([]byte(reportStr), report); err == nil {
+				return report, nil
+			}
+		}
+	}
+
+	report, err := P.wechatChatReport(userName)
+	if err != nil {
+		log.Println("wechatChatReport failed:", err)
+		return nil, err
+	}
+
+	if useCache {
+		reportStr, _ := json.Marshal(report)
+		_, err := P.wechatExec(P.userData, "INSERT OR REPLACE INTO chatReport (userName, fingerprint, report, timestamp) VALUES (?, ?, ?, ?);",
+			userName, fingerprint, string(reportStr), report.GeneratedTimestamp)
+		if err != nil {
+			log.Println("save chatReport failed:", err)
+		}
+	}
+
+	return report, nil
+}
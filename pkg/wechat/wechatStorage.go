@@ -0,0 +1,164 @@
+package wechat
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// WeChatSessionStorage is the size of the files referenced by the messages
+// of a session, in total and by media type.
+type WeChatSessionStorage struct {
+	UserName string           `json:"UserName"`
+	Total    int64            `json:"Total"`
+	Files    int              `json:"Files"`
+	Types    map[string]int64 `json:"Types"`
+}
+
+type WeChatOrphanFile struct {
+	Path string `json:"Path"`
+	Size int64  `json:"Size"`
+}
+
+// WeChatStorageUsage attributes the files under FileStorage to sessions.
+// A file referenced by several sessions counts for the one of the newest
+// message. Files no message references are orphans, Orphans holds the
+// largest storageOrphanLimit of the OrphanCount.
+type WeChatStorageUsage struct {
+	Sessions    []WeChatSessionStorage `json:"Sessions"`
+	Orphans     []WeChatOrphanFile     `json:"Orphans"`
+	Total       int64                  `json:"Total"`
+	Referenced  int64                  `json:"Referenced"`
+	OrphanSize  int64                  `json:"OrphanSize"`
+	OrphanCount int                    `json:"OrphanCount"`
+}
+
+const storageOrphanLimit = 1000
+
+// storageKey is how a file is looked up, Windows paths ignore case.
+func storageKey(path string) string {
+	return strings.ToLower(filepath.Clean(path))
+}
+
+// storageMediaPaths returns the local paths of media, a voice may have been
+// exported in several formats and all of them belong to the message.
+func (P *WechatDataProvider) storageMediaPaths(media messageMedia) []string {
+	localPath := P.localResPath(media.path)
+	if len(localPath) == 0 {
+		return nil
+	}
+	if media.mediaType != MediaTypeVoice {
+		return []string{localPath}
+	}
+
+	stem := strings.TrimSuffix(localPath, filepath.Ext(localPath))
+	paths := make([]string, 0, len(voiceFormatSearchOrder))
+	for _, format := range voiceFormatSearchOrder {
+		paths = append(paths, stem+"."+format)
+	}
+
+	return paths
+}
+
+// wechatStorageFiles returns the sizes of the files under FileStorage by
+// storageKey, with their frontend paths.
+func (P *WechatDataProvider) wechatStorageFiles() (map[string]int64, map[string]string, error) {
+	sizes := make(map[string]int64)
+	paths := make(map[string]string)
+	storagePath := fmt.Sprintf("%s\\FileStorage", P.resPath)
+	err := filepath.WalkDir(storagePath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		key := storageKey(path)
+		sizes[key] = info.Size()
+		paths[key] = P.prefixResPath + path[len(P.resPath):]
+		return nil
+	})
+
+	return sizes, paths, err
+}
+
+// WeChatGetStorageUsage sums up the sizes of the files the messages of
+// every session reference, sessions sorted by size.
+func (P *WechatDataProvider) WeChatGetStorageUsage() (*WeChatStorageUsage, error) {
+	sizes, paths, err := P.wechatStorageFiles()
+	if err != nil {
+		log.Println("wechatStorageFiles failed:", err)
+		return nil, err
+	}
+
+	usage := &WeChatStorageUsage{}
+	usage.Sessions = make([]WeChatSessionStorage, 0)
+	usage.Orphans = make([]WeChatOrphanFile, 0)
+	for _, size := range sizes {
+		usage.Total += size
+	}
+
+	sessions := make(map[string]*WeChatSessionStorage)
+	claimed := make(map[string]bool)
+	err = P.wechatScanMediaMessages("", func(msg *WeChatMessage) {
+		for _, media := range messageMediaFiles(msg) {
+			for _, localPath := range P.storageMediaPaths(media) {
+				key := storageKey(localPath)
+				size, ok := sizes[key]
+				if !ok || claimed[key] {
+					continue
+				}
+				claimed[key] = true
+
+				session, ok := sessions[msg.Talker]
+				if !ok {
+					session = &WeChatSessionStorage{UserName: msg.Talker, Types: make(map[string]int64)}
+					sessions[msg.Talker] = session
+				}
+				session.Total += size
+				session.Files += 1
+				session.Types[media.mediaType] += size
+			}
+		}
+	})
+	if err != nil {
+		log.Println("wechatScanMediaMessages failed:", err)
+		return nil, err
+	}
+
+	for _, session := range sessions {
+		usage.Referenced += session.Total
+		usage.Sessions = append(usage.Sessions, *session)
+	}
+
+	for key, size := range sizes {
+		if !claimed[key] {
+			usage.Orphans = append(usage.Orphans, WeChatOrphanFile{Path: paths[key], Size: size})
+			usage.OrphanSize += size
+		}
+	}
+	usage.OrphanCount = len(usage.Orphans)
+
+	sort.Slice(usage.Sessions, func(i, j int) bool {
+		if usage.Sessions[i].Total != usage.Sessions[j].Total {
+			return usage.Sessions[i].Total > usage.Sessions[j].Total
+		}
+		return usage.Sessions[i].UserName < usage.Sessions[j].UserName
+	})
+	sort.Slice(usage.Orphans, func(i, j int) bool {
+		if usage.Orphans[i].Size != usage.Orphans[j].Size {
+			return usage.Orphans[i].Size > usage.Orphans[j].Size
+		}
+		return usage.Orphans[i].Path < usage.Orphans[j].Path
+	})
+	if len(usage.Orphans) > storageOrphanLimit {
+		usage.Orphans = usage.Orphans[:storageOrphanLimit]
+	}
+
+	return usage, nil
+}
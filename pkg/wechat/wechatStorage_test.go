@@ -0,0 +1,33 @@
+package wechat
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStorageMediaPaths(t *testing.T) {
+	P := &WechatDataProvider{resPath: "D:\\export", prefixResPath: "\\res"}
+
+	tests := []struct {
+		name  string
+		media messageMedia
+		want  []string
+	}{
+		{"empty", messageMedia{"", MediaTypeImage}, nil},
+		{"not local", messageMedia{"https://example.com/a.jpg", MediaTypeThumb}, nil},
+		{"image", messageMedia{"\\res\\FileStorage\\MsgAttach\\a.jpg", MediaTypeImage},
+			[]string{"D:\\export\\FileStorage\\MsgAttach\\a.jpg"}},
+		{"voice", messageMedia{"\\res\\FileStorage\\Voice\\123.mp3", MediaTypeVoice}, []string{
+			"D:\\export\\FileStorage\\Voice\\123.mp3",
+			"D:\\export\\FileStorage\\Voice\\123.wav",
+			"D:\\export\\FileStorage\\Voice\\123.ogg",
+			"D:\\export\\FileStorage\\Voice\\123.silk",
+		}},
+	}
+
+	for _, test := range tests {
+		if got := P.storageMediaPaths(test.media); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: storageMediaPaths = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package wechat
+
+import (
+	"regexp"
+	"strings"
+	"wechatDataBackup/pkg/utils"
+
+	"github.com/beevik/etree"
+)
+
+// SystemInfo.Kind of a system (type 10000 or 10002) message
+const (
+	SystemMessagePat       = "pat"
+	SystemMessageRecall    = "recall"
+	SystemMessageJoin      = "join"
+	SystemMessageRemove    = "remove"
+	SystemMessageLeave     = "leave"
+	SystemMessageRename    = "rename"
+	SystemMessageRedPacket = "redpacket"
+	SystemMessagePrivacy   = "privacy"
+	SystemMessageNotice    = "notice"
+	SystemMessageOther     = "other"
+)
+
+// SystemInfo.JoinBy of a join message
+const (
+	SystemJoinByInvite = "invite"
+	SystemJoinByQRCode = "qrcode"
+)
+
+// SystemInfo is a classified system message. Actor and Targets are
+// resolved to contacts or group members, a name that can not be resolved
+// only has its NickName set.
+type SystemInfo struct {
+	Kind      string           `json:"Kind"`
+	JoinBy    string           `json:"JoinBy"`
+	Actor     WeChatUserInfo   `json:"Actor"`
+	Targets   []WeChatUserInfo `json:"Targets"`
+	GroupName string           `json:"GroupName"`
+	SendId    string           `json:"SendId"`
+}
+
+// systemName is a name shown in a system message, userName is set for
+// "你" and for the wxids of pat messages.
+type systemName struct {
+	name     string
+	userName string
+}
+
+type systemMessage struct {
+	kind      string
+	joinBy    string
+	text      string
+	actor     *systemName
+	targets   []systemName
+	groupName string
+	sendId    string
+}
+
+// systemMessagePattern matches the text of a system message, a group
+// index of 0 is not used and an empty group, "你" or "我" means self.
+type systemMessagePattern struct {
+	kind       string
+	joinBy     string
+	re         *regexp.Regexp
+	actor      int
+	target     int
+	selfTarget bool
+	groupName  int
+}
+
+var systemMessagePatterns = []systemMessagePattern{
+	{kind: SystemMessagePat, re: regexp.MustCompile(`^(?:"(.+?)"|我|你)\s*拍了拍\s*自己`), actor: 1, target: 1},
+	{kind: SystemMessagePat, re: regexp.MustCompile(`^(?:"(.+?)"|我|你)\s*拍了拍\s*(?:"(.+?)"|我|你)`), actor: 1, target: 2},
+	{kind: SystemMessageRecall, re: regexp.MustCompile(`^(?:"(.+?)"\s*|你)撤回了一条消息`), actor: 1},
+	{kind: SystemMessageJoin, joinBy: SystemJoinByInvite, re: regexp.MustCompile(`^(?:"(.+?)"|你)邀请你和"(.+)"加入了群聊`), actor: 1, target: 2, selfTarget: true},
+	{kind: SystemMessageJoin, joinBy: SystemJoinByInvite, re: regexp.MustCompile(`^(?:"(.+?)"|你)邀请(?:"(.+)"|你)加入了群聊`), actor: 1, target: 2},
+	{kind: SystemMessageJoin, joinBy: SystemJoinByQRCode, re: regexp.MustCompile(`^(?:"(.+?)"|你)通过扫描(?:"(.+?)"|你)分享的二维码加入群聊`), actor: 2, target: 1},
+	{kind: SystemMessageJoin, joinBy: SystemJoinByQRCode, re: regexp.MustCompile(`^你通过扫描二维码加入群聊`), selfTarget: true},
+	{kind: SystemMessageRemove, re: regexp.MustCompile(`^你被"(.+?)"移出群聊`), actor: 1, selfTarget: true},
+	{kind: SystemMessageRemove, re: regexp.MustCompile(`^(?:"(.+?)"|你)将"(.+)"移出了群聊`), actor: 1, target: 2},
+	{kind: SystemMessageLeave, re: regexp.MustCompile(`^(?:"(.+?)"|你)退出了群聊`), actor: 1, target: 1},
+	{kind: SystemMessageRename, re: regexp.MustCompile(`^(?:"(.+?)"|你)修改群名为“(.+)”`), actor: 1, groupName: 2},
+	{kind: SystemMessageRedPacket, re: regexp.MustCompile(`^(你|.+?)领取了(你|.+?)的红包`), actor: 1, target: 2},
+	{kind: SystemMessageRedPacket, re: regexp.MustCompile(`^你的红包已被领完`), selfTarget: true},
+	{kind: SystemMessageRedPacket, re: regexp.MustCompile(`^(你|.+?)的红包已过期`), target: 1},
+	{kind: SystemMessagePrivacy, re: regexp.MustCompile(`^"(.+?)"与群里其他人都不是(?:微信)?朋友关系`), target: 1},
+	{kind: SystemMessagePrivacy, re: regexp.MustCompile(`^(.+?)开启了朋友验证`), actor: 1},
+	{kind: SystemMessagePrivacy, re: regexp.MustCompile(`不是朋友关系|隐私安全`)},
+}
+
+var (
+	systemSendIdRe   = regexp.MustCompile(`sendid=(\d+)`)
+	systemTemplateRe = regexp.MustCompile(`"?\$\{(.+?)\}"?`)
+)
+
+// parseSystemPat parses the sysmsg of a pat, its names are wxids.
+func parseSystemPat(pat *etree.Element) *systemMessage {
+	msg := &systemMessage{kind: SystemMessagePat, text: elementValue(pat, "template")}
+	from := elementValue(pat, "fromusername")
+	if len(from) > 0 {
+		msg.actor = &systemName{userName: from}
+	}
+
+	msg.targets = make([]systemName, 0)
+	if patted := elementValue(pat, "pattedusername"); len(patted) > 0 {
+		msg.targets = append(msg.targets, systemName{userName: patted})
+	}
+
+	return msg
+}
+
+// parseSystemMessage classifies a system message by its content, unknown
+// messages are SystemMessageOther, or SystemMessageNotice for the notice
+// sub types.
+func parseSystemMessage(subType int, content string, self *WeChatUserInfo) *systemMessage {
+	if strings.HasPrefix(content, "<sysmsg") {
+		doc := etree.NewDocument()
+		if err := doc.ReadFromString(content); err == nil {
+			if pat := doc.FindElement("/sysmsg/pat"); pat != nil {
+				return parseSystemPat(pat)
+			}
+			if replace := doc.FindElement("/sysmsg/revokemsg/replacemsg"); replace != nil {
+				content = replace.Text()
+			}
+		}
+	}
+
+	text := strings.TrimSpace(utils.Html2Text(content))
+	msg := &systemMessage{kind: SystemMessageOther, text: text, targets: make([]systemName, 0)}
+	text = strings.TrimSpace(strings.TrimPrefix(text, "\U0001F9E7"))
+	for _, pattern := range systemMessagePatterns {
+		match := pattern.re.FindStringSubmatch(text)
+		if match == nil {
+			continue
+		}
+
+		name := func(index int) systemName {
+			if match[index] == "" || match[index] == "你" || match[index] == "我" {
+				return systemName{name: self.NickName, userName: self.UserName}
+			}
+			return systemName{name: match[index]}
+		}
+
+		msg.kind = pattern.kind
+		msg.joinBy = pattern.joinBy
+		if pattern.actor > 0 {
+			actor := name(pattern.actor)
+			msg.actor = &actor
+		}
+		if pattern.selfTarget {
+			msg.targets = append(msg.targets, systemName{name: self.NickName, userName: self.UserName})
+		}
+		if pattern.target > 0 {
+			target := name(pattern.target)
+			if len(target.userName) > 0 {
+				msg.targets = append(msg.targets, target)
+			} else {
+				for _, n := range strings.Split(target.name, "、") {
+					msg.targets = append(msg.targets, systemName{name: n})
+				}
+			}
+		}
+		if pattern.groupName > 0 {
+			msg.groupName = match[pattern.groupName]
+		}
+		break
+	}
+
+	if msg.kind == SystemMessageRedPacket {
+		if match := systemSendIdRe.FindStringSubmatch(content); match != nil {
+			msg.sendId = match[1]
+		}
+	}
+
+	if msg.kind == SystemMessageOther && (subType == Wechat_System_Message_Notice || subType == Wechat_System_Message_Notice2) {
+		msg.kind = SystemMessageNotice
+	} else if msg.kind == SystemMessageOther && subType == Wechat_System_Message_Tickle {
+		msg.kind = SystemMessagePat
+	}
+
+	return msg
+}
+
+func userDisplayName(info *WeChatUserInfo) string {
+	if len(info.ReMark) > 0 {
+		return info.ReMark
+	}
+
+	return info.NickName
+}
+
+// wechatChatRoomNames maps the nick names, remarks and group display names
+// of the members of chatroom to their user names, the list is read once
+// per chat room.
+func (P *WechatDataProvider) wechatChatRoomNames(chatroom string) map[string]string {
+	if names, ok := P.chatRoomNameCache.Load(chatroom); ok {
+		return names.(map[string]string)
+	}
+
+	names := make(map[string]string)
+	if userList, err := P.WeChatGetChatRoomUserList(chatroom); err == nil {
+		for _, info := range userList.Users {
+			for _, name := range []string{info.NickName, info.ReMark} {
+				if len(name) > 0 {
+					names[name] = info.UserName
+				}
+			}
+		}
+	}
+	// system messages show the group display name when one is set
+	for userName, displayName := range P.wechatChatRoomDisplayNames(chatroom) {
+		names[displayName] = userName
+	}
+	names[P.SelfInfo.NickName] = P.SelfInfo.UserName
+	P.chatRoomNameCache.Store(chatroom, names)
+
+	return names
+}
+
+// wechatSystemUser resolves a name of a system message of talker.
+func (P *WechatDataProvider) wechatSystemUser(talker string, name systemName) WeChatUserInfo {
+	userName := name.userName
+	if len(userName) == 0 {
+		if strings.HasSuffix(talker, "@chatroom") {
+			userName = P.wechatChatRoomNames(talker)[name.name]
+		} else if info, err := P.WechatGetUserInfoByNameOnCache(talker); err == nil &&
+			(info.NickName == name.name || info.ReMark == name.name) {
+			userName = talker
+		}
+	}
+
+	if len(userName) > 0 {
+		if info, err := P.WechatGetUserInfoByNameOnCache(userName); err == nil {
+			return *info
+		}
+	}
+
+	return WeChatUserInfo{UserName: userName, NickName: name.name}
+}
+
+// wechatMessageSystemHandle classifies a system message and resolves its
+// actor and targets. The content of a pat is rendered from its template,
+// "我" for self and the quoted display name for others.
+func (P *WechatDataProvider) wechatMessageSystemHandle(msg *WeChatMessage) {
+	if !isSystemMessage(msg.Type) {
+		return
+	}
+
+	system := parseSystemMessage(msg.SubType, msg.systemContent, P.SelfInfo)
+	msg.SystemInfo.Kind = system.kind
+	msg.SystemInfo.JoinBy = system.joinBy
+	msg.SystemInfo.GroupName = system.groupName
+	msg.SystemInfo.SendId = system.sendId
+	if system.actor != nil {
+		msg.SystemInfo.Actor = P.wechatSystemUser(msg.Talker, *system.actor)
+	}
+	msg.SystemInfo.Targets = make([]WeChatUserInfo, 0, len(system.targets))
+	for _, target := range system.targets {
+		msg.SystemInfo.Targets = append(msg.SystemInfo.Targets, P.wechatSystemUser(msg.Talker, target))
+	}
+
+	// the content of a type 10002 message is the sysmsg XML
+	if msg.Type == Wechat_Message_Type_SysMsg {
+		msg.Content = system.text
+	}
+
+	if strings.Contains(system.text, "${") {
+		msg.Content = systemTemplateRe.ReplaceAllStringFunc(system.text, func(s string) string {
+			userName := systemTemplateRe.FindStringSubmatch(s)[1]
+			if userName == P.SelfInfo.UserName {
+				return "我"
+			}
+			info := P.wechatSystemUser(msg.Talker, systemName{userName: userName})
+			if name := userDisplayName(&info); len(name) > 0 {
+				return "\"" + name + "\""
+			}
+			return "\"" + userName + "\""
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package wechat
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSystemMessage(t *testing.T) {
+	self := &WeChatUserInfo{UserName: "wxid_self", NickName: "me"}
+	me := systemName{name: "me", userName: "wxid_self"}
+
+	tests := []struct {
+		name    string
+		subType int
+		content string
+		want    systemMessage
+	}{
+		{"recall", 0, `"Alice" 撤回了一条消息`,
+			systemMessage{kind: SystemMessageRecall, text: `"Alice" 撤回了一条消息`, actor: &systemName{name: "Alice"}}},
+		{"self recall", 0, `你撤回了一条消息`,
+			systemMessage{kind: SystemMessageRecall, text: `你撤回了一条消息`, actor: &me}},
+		{"sysmsg recall", 0,
+			`<sysmsg type="revokemsg"><revokemsg><replacemsg><![CDATA["Bob" 撤回了一条消息]]></replacemsg></revokemsg></sysmsg>`,
+			systemMessage{kind: SystemMessageRecall, text: `"Bob" 撤回了一条消息`, actor: &systemName{name: "Bob"}}},
+		{"sysmsg pat", 0,
+			`<sysmsg type="pat"><pat><fromusername>wxid_a</fromusername><pattedusername>wxid_b</pattedusername><template><![CDATA["${wxid_a}" 拍了拍 "${wxid_b}"]]></template></pat></sysmsg>`,
+			systemMessage{kind: SystemMessagePat, text: `"${wxid_a}" 拍了拍 "${wxid_b}"`,
+				actor: &systemName{userName: "wxid_a"}, targets: []systemName{{userName: "wxid_b"}}}},
+		{"pat", 0, `"Alice" 拍了拍 "Bob"`,
+			systemMessage{kind: SystemMessagePat, text: `"Alice" 拍了拍 "Bob"`,
+				actor: &systemName{name: "Alice"}, targets: []systemName{{name: "Bob"}}}},
+		{"invite", 0, `"Alice"邀请"Bob、Carol"加入了群聊`,
+			systemMessage{kind: SystemMessageJoin, joinBy: SystemJoinByInvite, text: `"Alice"邀请"Bob、Carol"加入了群聊`,
+				actor: &systemName{name: "Alice"}, targets: []systemName{{name: "Bob"}, {name: "Carol"}}}},
+		{"invite self", 0, `"Alice"邀请你和"Bob"加入了群聊`,
+			systemMessage{kind: SystemMessageJoin, joinBy: SystemJoinByInvite, text: `"Alice"邀请你和"Bob"加入了群聊`,
+				actor: &systemName{name: "Alice"}, targets: []systemName{me, {name: "Bob"}}}},
+		{"qrcode", 0, `"Bob"通过扫描"Alice"分享的二维码加入群聊`,
+			systemMessage{kind: SystemMessageJoin, joinBy: SystemJoinByQRCode, text: `"Bob"通过扫描"Alice"分享的二维码加入群聊`,
+				actor: &systemName{name: "Alice"}, targets: []systemName{{name: "Bob"}}}},
+		{"removed", 0, `你被"Alice"移出群聊`,
+			systemMessage{kind: SystemMessageRemove, text: `你被"Alice"移出群聊`,
+				actor: &systemName{name: "Alice"}, targets: []systemName{me}}},
+		{"rename", 0, `"Alice"修改群名为“New”`,
+			systemMessage{kind: SystemMessageRename, text: `"Alice"修改群名为“New”`,
+				actor: &systemName{name: "Alice"}, targets: []systemName{}, groupName: "New"}},
+		{"red packet", 0, `<img src="SystemMessages_HongbaoIcon.png"/>  Bob领取了你的<_wc_custom_link_ href="weixin://weixinhongbao/opendetail?sendid=1000039">红包</_wc_custom_link_>`,
+			systemMessage{kind: SystemMessageRedPacket, text: "\U0001F9E7  Bob领取了你的红包",
+				actor: &systemName{name: "Bob"}, targets: []systemName{me}, sendId: "1000039"}},
+		{"notice", Wechat_System_Message_Notice, `something new`,
+			systemMessage{kind: SystemMessageNotice, text: `something new`, targets: []systemName{}}},
+		{"tickle", Wechat_System_Message_Tickle, `someone did something`,
+			systemMessage{kind: SystemMessagePat, text: `someone did something`, targets: []systemName{}}},
+		{"other", 0, `something new`,
+			systemMessage{kind: SystemMessageOther, text: `something new`, targets: []systemName{}}},
+	}
+
+	for _, test := range tests {
+		got := parseSystemMessage(test.subType, test.content, self)
+		if test.want.targets == nil {
+			test.want.targets = []systemName{}
+		}
+		if !reflect.DeepEqual(*got, test.want) {
+			t.Errorf("%s: parseSystemMessage = %+v, want %+v", test.name, *got, test.want)
+		}
+	}
+}
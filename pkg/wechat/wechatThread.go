@@ -0,0 +1,301 @@
+package wechat
+
+import (
+	"log"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pierrec/lz4"
+)
+
+// wechatReference is a refer message quoting another message.
+type wechatReference struct {
+	svrId  int64
+	talker string
+}
+
+// wechatReferIndex tracks the shards in the refer index by fingerprint.
+// The index lives in Sidecar.db, refers keeps it per shard when there is
+// no Sidecar.db.
+type wechatReferIndex struct {
+	mtx          sync.Mutex
+	checked      time.Time
+	fingerprints map[string]string
+	refers       map[string]map[int64][]wechatReference
+}
+
+// WeChatThreadNode is a message with the messages quoting it, oldest
+// first.
+type WeChatThreadNode struct {
+	Message WeChatMessage      `json:"Message"`
+	Replies []WeChatThreadNode `json:"Replies"`
+}
+
+// WeChatMessageThread is the quote tree a message belongs to, Root is the
+// first message of the quote chain and Focus the requested one.
+type WeChatMessageThread struct {
+	Root  WeChatThreadNode `json:"Root"`
+	Focus string           `json:"Focus"`
+	Total int              `json:"Total"`
+}
+
+const (
+	// quote chains longer than this are cut, a chain can loop in broken data
+	threadMaxDepth = 64
+	// how long the refer index is trusted before its shards are checked
+	referCheckInterval = 30 * time.Second
+)
+
+var referSvrIdRe = regexp.MustCompile(`<refermsg>[\s\S]*?<svrid>(\d+)</svrid>`)
+
+func uncompressContent(compressContent []byte) ([]byte, error) {
+	content := make([]byte, len(compressContent)*10)
+	n, err := lz4.UncompressBlock(compressContent, content)
+	if err != nil {
+		return nil, err
+	}
+
+	return content[:n], nil
+}
+
+// wechatUpdateReferIndex brings the refer index, the refer messages by the
+// MsgSvrID they quote, up to date. Like the shard index it is kept in
+// Sidecar.db and a shard is only scanned again when its fingerprint
+// changed. The shards are checked at most every referCheckInterval, a
+// shard that failed is retried at the next check.
+func (P *WechatDataProvider) wechatUpdateReferIndex() {
+	P.referIndex.mtx.Lock()
+	defer P.referIndex.mtx.Unlock()
+
+	if time.Since(P.referIndex.checked) < referCheckInterval {
+		return
+	}
+	P.referIndex.checked = time.Now()
+	if P.referIndex.fingerprints == nil {
+		P.referIndex.fingerprints = make(map[string]string)
+		P.referIndex.refers = make(map[string]map[int64][]wechatReference)
+	}
+
+	for _, msgDB := range P.msgDBs {
+		shard := filepath.Base(msgDB.path)
+		fingerprint := P.shardFingerprint(msgDB)
+		if P.referIndex.fingerprints[shard] == fingerprint {
+			continue
+		}
+
+		if P.wechatReferFingerprint(shard) != fingerprint {
+			refers, err := P.wechatScanReferIndex(msgDB)
+			if err != nil {
+				log.Println("wechatScanReferIndex failed:", msgDB.path, err)
+				continue
+			}
+			if P.sidecar == nil {
+				P.referIndex.refers[shard] = refers
+			} else if err := P.wechatSaveReferIndex(shard, fingerprint, refers); err != nil {
+				log.Println("wechatSaveReferIndex failed:", msgDB.path, err)
+				continue
+			}
+		}
+		P.referIndex.fingerprints[shard] = fingerprint
+	}
+}
+
+// wechatReferFingerprint returns the fingerprint of the shard the refer
+// index in Sidecar.db was built from, empty when there is none.
+func (P *WechatDataProvider) wechatReferFingerprint(shard string) string {
+	if P.sidecar == nil {
+		return ""
+	}
+
+	var saved string
+	if err := P.wechatQueryRow(P.sidecar, "select fingerprint from referShard where shard=?;", shard).Scan(&saved); err != nil {
+		return ""
+	}
+
+	return saved
+}
+
+func (P *WechatDataProvider) wechatScanReferIndex(msgDB *wechatMsgDB) (map[int64][]wechatReference, error) {
+	log.Println("scan refer index:", msgDB.path)
+	querySql := "select MsgSvrID, ifnull(StrTalker,''), ifnull(CompressContent,'') from MSG where Type=? And SubType=?;"
+	rows, err := P.wechatQuery(msgDB.db, querySql, Wechat_Message_Type_Misc, Wechat_Misc_Message_Refer)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refers := make(map[int64][]wechatReference)
+	for rows.Next() {
+		var reference wechatReference
+		var compressContent []byte
+		if err := rows.Scan(&reference.svrId, &reference.talker, &compressContent); err != nil {
+			return nil, err
+		}
+
+		content, err := uncompressContent(compressContent)
+		if err != nil {
+			continue
+		}
+		match := referSvrIdRe.FindSubmatch(content)
+		if match == nil {
+			continue
+		}
+		referSvrId, err := strconv.ParseInt(string(match[1]), 10, 64)
+		if err != nil || referSvrId == 0 {
+			continue
+		}
+		refers[referSvrId] = append(refers[referSvrId], reference)
+	}
+
+	return refers, rows.Err()
+}
+
+func (P *WechatDataProvider) wechatSaveReferIndex(shard, fingerprint string, refers map[int64][]wechatReference) (err error) {
+	if P.sidecar == nil {
+		return nil
+	}
+
+	tx, err := P.sidecar.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if _, err = tx.Exec("DELETE FROM referIndex WHERE shard=?;", shard); err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare("INSERT INTO referIndex (shard, MsgSvrID, referSvrID, talker) VALUES (?, ?, ?, ?);")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for referSvrId, references := range refers {
+		for _, reference := range references {
+			if _, err = stmt.Exec(shard, reference.svrId, referSvrId, reference.talker); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err = tx.Exec("INSERT OR REPLACE INTO referShard (shard, fingerprint) VALUES (?, ?);", shard, fingerprint); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// wechatMessageReplies returns the messages of userName quoting svrId.
+func (P *WechatDataProvider) wechatMessageReplies(userName string, svrId string) []wechatReference {
+	id, err := strconv.ParseInt(svrId, 10, 64)
+	if err != nil {
+		return nil
+	}
+	P.wechatUpdateReferIndex()
+
+	replies := make([]wechatReference, 0)
+	if P.sidecar == nil {
+		P.referIndex.mtx.Lock()
+		defer P.referIndex.mtx.Unlock()
+		for _, refers := range P.referIndex.refers {
+			for _, reference := range refers[id] {
+				if reference.talker == userName {
+					replies = append(replies, reference)
+				}
+			}
+		}
+		return replies
+	}
+
+	rows, err := P.wechatQuery(P.sidecar, "select MsgSvrID from referIndex where referSvrID=? And talker=?;", id, userName)
+	if err != nil {
+		log.Println("select referIndex failed:", err)
+		return replies
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		reference := wechatReference{talker: userName}
+		if err := rows.Scan(&reference.svrId); err != nil {
+			log.Println("rows.Scan failed", err)
+			break
+		}
+		replies = append(replies, reference)
+	}
+
+	return replies
+}
+
+// wechatThreadNode builds the node of msg with the replies quoting it,
+// visited stops loops and a message quoted twice on one path.
+func (P *WechatDataProvider) wechatThreadNode(msg *WeChatMessage, visited map[string]bool, depth int) WeChatThreadNode {
+	visited[msg.MsgSvrId] = true
+	node := WeChatThreadNode{Message: *msg, Replies: make([]WeChatThreadNode, 0)}
+	if depth >= threadMaxDepth {
+		return node
+	}
+
+	for _, reference := range P.wechatMessageReplies(msg.Talker, msg.MsgSvrId) {
+		svrId := strconv.FormatInt(reference.svrId, 10)
+		if visited[svrId] {
+			continue
+		}
+
+		reply, err := P.wechatFindMessageByServerId(msg.Talker, svrId)
+		if err != nil {
+			continue
+		}
+		P.wechatMessageHandle(reply)
+		node.Replies = append(node.Replies, P.wechatThreadNode(reply, visited, depth+1))
+	}
+
+	sort.SliceStable(node.Replies, func(i, j int) bool {
+		return node.Replies[i].Message.CreateTime < node.Replies[j].Message.CreateTime
+	})
+
+	return node
+}
+
+// WeChatGetMessageThread returns the quote tree of the message svrId of
+// userName: up the chain of messages it quoted to the first one, and from
+// there down every message quoting a message of the tree.
+func (P *WechatDataProvider) WeChatGetMessageThread(userName string, svrId string) (*WeChatMessageThread, error) {
+	msg, err := P.wechatFindMessageByServerId(userName, svrId)
+	if err != nil {
+		log.Println("wechatFindMessageByServerId failed:", err)
+		return nil, err
+	}
+	P.wechatMessageHandle(msg)
+
+	root := msg
+	seen := map[string]bool{msg.MsgSvrId: true}
+	for depth := 0; depth < threadMaxDepth; depth++ {
+		if root.Type != Wechat_Message_Type_Misc || root.SubType != Wechat_Misc_Message_Refer || root.ReferInfo.Svrid == 0 {
+			break
+		}
+
+		quoted, err := P.wechatFindMessageByServerId(root.Talker, strconv.FormatInt(root.ReferInfo.Svrid, 10))
+		if err != nil || seen[quoted.MsgSvrId] {
+			break
+		}
+		seen[quoted.MsgSvrId] = true
+		P.wechatMessageHandle(quoted)
+		root = quoted
+	}
+
+	thread := &WeChatMessageThread{Focus: msg.MsgSvrId}
+	visited := make(map[string]bool)
+	thread.Root = P.wechatThreadNode(root, visited, 0)
+	thread.Total = len(visited)
+
+	return thread, nil
+}
@@ -0,0 +1,100 @@
+package wechat
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultTimeZone is the zone of the old hardcoded UTC+8 date queries.
+const DefaultTimeZone = "Asia/Shanghai"
+
+// timeBucket is the SQL granularity of date queries in seconds, every zone
+// offset in use is a multiple of 15 minutes.
+const timeBucket = 900
+
+var timeZoneName = DefaultTimeZone
+var timeZoneLoc = loadDefaultLocation()
+var timeZoneMtx sync.Mutex
+
+func loadDefaultLocation() *time.Location {
+	loc, err := time.LoadLocation(DefaultTimeZone)
+	if err != nil {
+		return time.FixedZone("CST", 8*3600)
+	}
+
+	return loc
+}
+
+// SetTimeZone sets the IANA zone used for dates, statistics and date
+// filters, an empty name selects DefaultTimeZone.
+func SetTimeZone(name string) error {
+	if name == "" {
+		name = DefaultTimeZone
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return fmt.Errorf("unknown time zone %s: %v", name, err)
+	}
+
+	timeZoneMtx.Lock()
+	timeZoneName = name
+	timeZoneLoc = loc
+	timeZoneMtx.Unlock()
+	log.Println("SetTimeZone:", name)
+	return nil
+}
+
+func GetTimeZone() string {
+	timeZoneMtx.Lock()
+	defer timeZoneMtx.Unlock()
+	return timeZoneName
+}
+
+func timeLocation() *time.Location {
+	timeZoneMtx.Lock()
+	defer timeZoneMtx.Unlock()
+	return timeZoneLoc
+}
+
+// localTime converts a CreateTime into the configured zone.
+func localTime(timestamp int64) time.Time {
+	return time.Unix(timestamp, 0).In(timeLocation())
+}
+
+// localTimeText formats a CreateTime in the configured zone, it is what
+// the frontend and exported data show instead of the viewer's local time.
+func localTimeText(timestamp int64) string {
+	return localTime(timestamp).Format("2006-01-02 15:04:05")
+}
+
+// parseLocalDate parses a "2006-01-02" date as midnight in the configured
+// zone.
+func parseLocalDate(date string) (int64, error) {
+	t, err := time.ParseInLocation("2006-01-02", date, timeLocation())
+	if err != nil {
+		return 0, err
+	}
+
+	return t.Unix(), nil
+}
+
+// bucketsToDates converts CreateTime/timeBucket values into the distinct
+// local dates, newest first.
+func bucketsToDates(buckets []int64) []string {
+	seen := make(map[string]bool)
+	dates := make([]string, 0)
+	for _, bucket := range buckets {
+		date := localTime(bucket * timeBucket).Format("2006-01-02")
+		if !seen[date] {
+			seen[date] = true
+			dates = append(dates, date)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(dates)))
+
+	return dates
+}
@@ -0,0 +1,29 @@
+package wechat
+
+import "testing"
+
+func TestLocalTimeText(t *testing.T) {
+	defer SetTimeZone(GetTimeZone())
+
+	tests := []struct {
+		zone string
+		want string
+	}{
+		{"", "2024-01-01 08:30:00"},
+		{"UTC", "2024-01-01 00:30:00"},
+		{"America/New_York", "2023-12-31 19:30:00"},
+	}
+
+	for _, test := range tests {
+		if err := SetTimeZone(test.zone); err != nil {
+			t.Fatalf("SetTimeZone(%q) failed: %v", test.zone, err)
+		}
+		if got := localTimeText(1704069000); got != test.want {
+			t.Errorf("%q: localTimeText = %q, want %q", test.zone, got, test.want)
+		}
+	}
+
+	if err := SetTimeZone("Nowhere/Zone"); err == nil {
+		t.Error("SetTimeZone accepted an unknown zone")
+	}
+}
@@ -0,0 +1,508 @@
+package wechat
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/git-jiadong/go-lame"
+	"github.com/git-jiadong/go-silk"
+	"gopkg.in/hraban/opus.v2"
+)
+
+const (
+	VoiceFormatMp3  = "mp3"
+	VoiceFormatWav  = "wav"
+	VoiceFormatOgg  = "ogg"
+	VoiceFormatSilk = "silk"
+)
+
+const (
+	defaultVoiceSampleRate = 24000
+	defaultVoiceQuality    = 5
+	waveformSampleRate     = 8000
+	voiceWaveformPoints    = 40
+	opusFrameMs            = 20
+	opusMaxPacketSize      = 4000
+)
+
+var errVoiceFormatUnsupported = errors.New("voice format unsupported")
+
+// voiceFormatSearchOrder is the order used to look for an exported voice
+// file when the configured format does not exist on disk.
+var voiceFormatSearchOrder = []string{VoiceFormatMp3, VoiceFormatWav, VoiceFormatOgg, VoiceFormatSilk}
+
+var silkSampleRates = map[int]bool{
+	8000:  true,
+	12000: true,
+	16000: true,
+	24000: true,
+	32000: true,
+	44100: true,
+	48000: true,
+}
+
+// opusSampleRates are the input rates libopus accepts, 44100 is not one.
+var opusSampleRates = map[int]bool{
+	8000:  true,
+	12000: true,
+	16000: true,
+	24000: true,
+	48000: true,
+}
+
+type VoiceExportConfig struct {
+	Format     string `json:"Format"`
+	Bitrate    int    `json:"Bitrate"`
+	SampleRate int    `json:"SampleRate"`
+	KeepSilk   bool   `json:"KeepSilk"`
+}
+
+var voiceConfig = VoiceExportConfig{
+	Format:     VoiceFormatMp3,
+	Bitrate:    0,
+	SampleRate: defaultVoiceSampleRate,
+	KeepSilk:   true,
+}
+var voiceConfigMtx sync.Mutex
+
+func SetVoiceExportConfig(config VoiceExportConfig) error {
+	switch config.Format {
+	case VoiceFormatMp3, VoiceFormatWav, VoiceFormatOgg, VoiceFormatSilk:
+	case "":
+		config.Format = VoiceFormatMp3
+	default:
+		return fmt.Errorf("unknown voice format: %s", config.Format)
+	}
+
+	if config.SampleRate == 0 {
+		config.SampleRate = defaultVoiceSampleRate
+	}
+	if !silkSampleRates[config.SampleRate] {
+		return fmt.Errorf("unsupported sample rate: %d", config.SampleRate)
+	}
+	if config.Format == VoiceFormatOgg && !opusSampleRates[config.SampleRate] {
+		return fmt.Errorf("unsupported opus sample rate: %d", config.SampleRate)
+	}
+
+	if config.Bitrate < 0 || config.Bitrate > 320 {
+		return fmt.Errorf("unsupported bitrate: %d", config.Bitrate)
+	}
+	if config.Format == VoiceFormatOgg && config.Bitrate > 0 && config.Bitrate < 6 {
+		return fmt.Errorf("unsupported opus bitrate: %d", config.Bitrate)
+	}
+
+	voiceConfigMtx.Lock()
+	voiceConfig = config
+	voiceConfigMtx.Unlock()
+	log.Printf("SetVoiceExportConfig: %+v\n", config)
+	return nil
+}
+
+func GetVoiceExportConfig() VoiceExportConfig {
+	voiceConfigMtx.Lock()
+	defer voiceConfigMtx.Unlock()
+	return voiceConfig
+}
+
+// VoiceInfo Duration is in milliseconds, Waveform holds peak values 0-100.
+type VoiceInfo struct {
+	Duration int   `json:"Duration"`
+	Waveform []int `json:"Waveform"`
+}
+
+func voiceFilePath(voicePath string, msgSvrID int64, format string) string {
+	return fmt.Sprintf("%s\\%d.%s", voicePath, msgSvrID, format)
+}
+
+// findVoiceFile returns the voice file of msgSvrID, trying the configured
+// format first and then every other format that may have been exported.
+func findVoiceFile(voicePath string, msgSvrID int64, format string) (string, string) {
+	formats := append([]string{format}, voiceFormatSearchOrder...)
+	for _, f := range formats {
+		path := voiceFilePath(voicePath, msgSvrID, f)
+		if _, err := os.Stat(path); err == nil {
+			return path, f
+		}
+	}
+
+	return "", ""
+}
+
+// exportVoiceFile writes the voice in the configured format unless that
+// file was already exported, a file of another format does not count. It
+// returns nil info when the file exists and hasInfo is set.
+func exportVoiceFile(buf []byte, voicePath string, msgSvrID int64, config VoiceExportConfig, hasInfo bool) (*VoiceInfo, error) {
+	var pcm []byte
+	var err error
+	if _, serr := os.Stat(voiceFilePath(voicePath, msgSvrID, config.Format)); serr != nil {
+		pcm, err = writeVoiceFile(buf, voicePath, msgSvrID, config)
+	} else if hasInfo {
+		return nil, nil
+	}
+
+	if pcm == nil {
+		pcm, _ = silkDecode(buf, waveformSampleRate)
+	}
+
+	return silkVoiceInfo(buf, pcm), err
+}
+
+func writeVoiceFile(buf []byte, voicePath string, msgSvrID int64, config VoiceExportConfig) ([]byte, error) {
+	silkPath := voiceFilePath(voicePath, msgSvrID, VoiceFormatSilk)
+	if config.Format == VoiceFormatSilk {
+		return nil, os.WriteFile(silkPath, buf, 0666)
+	}
+
+	pcm, err := silkToVoice(buf, voiceFilePath(voicePath, msgSvrID, config.Format), config)
+	if err != nil || config.KeepSilk {
+		if werr := os.WriteFile(silkPath, buf, 0666); werr != nil {
+			log.Println("WriteFile:", silkPath, werr)
+		}
+	}
+
+	return pcm, err
+}
+
+func silkDecode(silkBuf []byte, sampleRate int) ([]byte, error) {
+	silkReader := bytes.NewReader(silkBuf)
+
+	var pcmBuffer bytes.Buffer
+	sr := silk.NewWriter(&pcmBuffer)
+	sr.Decoder.SetSampleRate(sampleRate)
+	silkReader.WriteTo(sr)
+	sr.Close()
+
+	if pcmBuffer.Len() == 0 {
+		return nil, errors.New("silk decode failed")
+	}
+
+	return pcmBuffer.Bytes(), nil
+}
+
+func silkToVoice(silkBuf []byte, outPath string, config VoiceExportConfig) ([]byte, error) {
+	var encode func(pcm []byte, w io.Writer, config VoiceExportConfig) error
+	switch config.Format {
+	case VoiceFormatMp3:
+		encode = pcmToMp3
+	case VoiceFormatWav:
+		encode = pcmToWav
+	case VoiceFormatOgg:
+		encode = pcmToOgg
+	default:
+		return nil, errVoiceFormatUnsupported
+	}
+
+	pcm, err := silkDecode(silkBuf, config.SampleRate)
+	if err != nil {
+		return nil, fmt.Errorf("%v %s", err, outPath)
+	}
+
+	of, err := os.Create(outPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := encode(pcm, of, config); err != nil {
+		of.Close()
+		os.Remove(outPath)
+		return nil, err
+	}
+
+	return pcm, of.Close()
+}
+
+func pcmToMp3(pcm []byte, w io.Writer, config VoiceExportConfig) error {
+	wr := lame.NewWriter(w)
+	wr.Encoder.SetInSamplerate(config.SampleRate)
+	wr.Encoder.SetOutSamplerate(config.SampleRate)
+	wr.Encoder.SetNumChannels(1)
+	wr.Encoder.SetQuality(defaultVoiceQuality)
+	if config.Bitrate > 0 {
+		wr.Encoder.SetBitrate(config.Bitrate)
+	}
+	// IMPORTANT!
+	wr.Encoder.InitParams()
+
+	if _, err := bytes.NewReader(pcm).WriteTo(wr); err != nil {
+		return err
+	}
+
+	return wr.Close()
+}
+
+func pcmToWav(pcm []byte, w io.Writer, config VoiceExportConfig) error {
+	const channels = 1
+	const bitsPerSample = 16
+	byteRate := config.SampleRate * channels * bitsPerSample / 8
+
+	header := struct {
+		ChunkID       [4]byte
+		ChunkSize     uint32
+		Format        [4]byte
+		Subchunk1ID   [4]byte
+		Subchunk1Size uint32
+		AudioFormat   uint16
+		NumChannels   uint16
+		SampleRate    uint32
+		ByteRate      uint32
+		BlockAlign    uint16
+		BitsPerSample uint16
+		Subchunk2ID   [4]byte
+		Subchunk2Size uint32
+	}{
+		ChunkID:       [4]byte{'R', 'I', 'F', 'F'},
+		ChunkSize:     uint32(36 + len(pcm)),
+		Format:        [4]byte{'W', 'A', 'V', 'E'},
+		Subchunk1ID:   [4]byte{'f', 'm', 't', ' '},
+		Subchunk1Size: 16,
+		AudioFormat:   1,
+		NumChannels:   channels,
+		SampleRate:    uint32(config.SampleRate),
+		ByteRate:      uint32(byteRate),
+		BlockAlign:    channels * bitsPerSample / 8,
+		BitsPerSample: bitsPerSample,
+		Subchunk2ID:   [4]byte{'d', 'a', 't', 'a'},
+		Subchunk2Size: uint32(len(pcm)),
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+
+	_, err := w.Write(pcm)
+	return err
+}
+
+// pcmToOgg encodes 16 bits mono pcm into 20ms Opus packets in an Ogg
+// container, the last frame is padded with silence.
+func pcmToOgg(pcm []byte, w io.Writer, config VoiceExportConfig) error {
+	enc, err := opus.NewEncoder(config.SampleRate, 1, opus.AppVoIP)
+	if err != nil {
+		return err
+	}
+	if config.Bitrate > 0 {
+		if err := enc.SetBitrate(config.Bitrate * 1000); err != nil {
+			return err
+		}
+	}
+
+	ow := newOggWriter(w, uint32(time.Now().UnixNano()))
+	if err := ow.writeOpusHeaders(config.SampleRate); err != nil {
+		return err
+	}
+
+	frameSize := config.SampleRate * opusFrameMs / 1000
+	samples := len(pcm) / 2
+	frame := make([]int16, frameSize)
+	packet := make([]byte, opusMaxPacketSize)
+	for offset := 0; offset < samples || offset == 0; offset += frameSize {
+		for i := range frame {
+			frame[i] = 0
+			if offset+i < samples {
+				frame[i] = int16(binary.LittleEndian.Uint16(pcm[(offset+i)*2:]))
+			}
+		}
+
+		n, err := enc.Encode(frame, packet)
+		if err != nil {
+			return err
+		}
+
+		// The granule of the last page marks where the real samples end,
+		// so players trim the padding.
+		end := offset + frameSize
+		headerType := byte(0)
+		if end >= samples {
+			end = samples
+			headerType = oggHeaderTypeEOS
+		}
+		granule := uint64(opusPreSkip + end*opusGranuleRate/config.SampleRate)
+		if err := ow.writePacket(packet[:n], granule, headerType); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// silkFrameCount counts the 20ms frames of a SILK v3 stream, each frame
+// is a little-endian int16 length followed by its payload.
+func silkFrameCount(silkBuf []byte) int {
+	header := []byte("#!SILK_V3")
+	if len(silkBuf) > 0 && silkBuf[0] == 0x02 {
+		silkBuf = silkBuf[1:]
+	}
+	if !bytes.HasPrefix(silkBuf, header) {
+		return 0
+	}
+
+	frames := 0
+	offset := len(header)
+	for offset+2 <= len(silkBuf) {
+		size := int(int16(binary.LittleEndian.Uint16(silkBuf[offset:])))
+		offset += 2
+		if size <= 0 || offset+size > len(silkBuf) {
+			break
+		}
+		offset += size
+		frames += 1
+	}
+
+	return frames
+}
+
+func silkVoiceInfo(silkBuf []byte, pcm []byte) *VoiceInfo {
+	info := &VoiceInfo{}
+	info.Duration = silkFrameCount(silkBuf) * silk.FRAME_LENGTH_MS
+	info.Waveform = pcmWaveform(pcm, voiceWaveformPoints)
+
+	return info
+}
+
+// pcmWaveform downsamples 16 bits mono pcm into points peak values scaled
+// to 0-100.
+func pcmWaveform(pcm []byte, points int) []int {
+	waveform := make([]int, 0, points)
+	samples := len(pcm) / 2
+	if samples < points {
+		return waveform
+	}
+
+	peaks := make([]int, points)
+	maxPeak := 0
+	for i := 0; i < points; i++ {
+		start := i * samples / points
+		end := (i + 1) * samples / points
+		for j := start; j < end; j++ {
+			v := int(int16(binary.LittleEndian.Uint16(pcm[j*2:])))
+			if v < 0 {
+				v = -v
+			}
+			if v > peaks[i] {
+				peaks[i] = v
+			}
+		}
+		if peaks[i] > maxPeak {
+			maxPeak = peaks[i]
+		}
+	}
+
+	for _, peak := range peaks {
+		if maxPeak == 0 {
+			waveform = append(waveform, 0)
+			continue
+		}
+		waveform = append(waveform, peak*100/maxPeak)
+	}
+
+	return waveform
+}
+
+func (P *WechatDataProvider) wechatGetVoiceInfo(msgSvrID int64) (*VoiceInfo, error) {
+	var duration int
+	var waveform string
+	err := P.wechatQueryRow(P.sidecar, "select duration, ifnull(waveform,'') from voiceInfo where MsgSvrID=?;", msgSvrID).Scan(&duration, &waveform)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &VoiceInfo{Duration: duration, Waveform: make([]int, 0)}
+	if len(waveform) > 0 {
+		if err := json.Unmarshal([]byte(waveform), &info.Waveform); err != nil {
+			log.Println("json.Unmarshal waveform failed:", err)
+		}
+	}
+
+	return info, nil
+}
+
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func wechatSetVoiceInfo(db sqlExecer, msgSvrID int64, info *VoiceInfo) error {
+	waveform, err := json.Marshal(info.Waveform)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("INSERT OR REPLACE INTO voiceInfo (MsgSvrID, duration, waveform) VALUES (?, ?, ?)", msgSvrID, info.Duration, string(waveform))
+	return err
+}
+
+// wechatVoiceInfoIDs returns the voices the Sidecar.db at sidecarPath
+// already has the info of.
+func wechatVoiceInfoIDs(sidecarPath string) map[int64]bool {
+	ids := make(map[int64]bool)
+	if _, err := os.Stat(sidecarPath); err != nil {
+		return ids
+	}
+
+	db := openSidecarDB(sidecarPath)
+	if db == nil {
+		return ids
+	}
+	defer db.Close()
+
+	rows, err := db.Query("select MsgSvrID from voiceInfo;")
+	if err != nil {
+		log.Println("select voiceInfo failed:", err)
+		return ids
+	}
+	defer rows.Close()
+
+	var msgSvrID int64
+	for rows.Next() {
+		if err := rows.Scan(&msgSvrID); err != nil {
+			log.Println("rows.Scan failed", err)
+			break
+		}
+		ids[msgSvrID] = true
+	}
+
+	return ids
+}
+
+type wechatVoiceInfoMSG struct {
+	MsgSvrID int64
+	Info     *VoiceInfo
+}
+
+// wechatSaveVoiceInfo writes everything received on infoChan to the sidecar
+// database in a single transaction.
+func wechatSaveVoiceInfo(sidecarPath string, infoChan <-chan wechatVoiceInfoMSG) {
+	db := openSidecarDB(sidecarPath)
+	if db == nil {
+		for range infoChan {
+		}
+		return
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println("db.Begin failed:", err)
+		for range infoChan {
+		}
+		return
+	}
+
+	for msg := range infoChan {
+		if err := wechatSetVoiceInfo(tx, msg.MsgSvrID, msg.Info); err != nil {
+			log.Println("wechatSetVoiceInfo failed:", msg.MsgSvrID, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Println("tx.Commit failed:", err)
+	}
+}
@@ -0,0 +1,181 @@
+package wechat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestSetVoiceExportConfig(t *testing.T) {
+	saved := GetVoiceExportConfig()
+	defer SetVoiceExportConfig(saved)
+
+	tests := []struct {
+		config VoiceExportConfig
+		ok     bool
+	}{
+		{VoiceExportConfig{Format: VoiceFormatMp3, SampleRate: 24000}, true},
+		{VoiceExportConfig{Format: VoiceFormatWav}, true},
+		{VoiceExportConfig{Format: VoiceFormatSilk, KeepSilk: true}, true},
+		{VoiceExportConfig{}, true},
+		{VoiceExportConfig{Format: VoiceFormatOgg}, true},
+		{VoiceExportConfig{Format: VoiceFormatOgg, SampleRate: 48000, Bitrate: 32}, true},
+		{VoiceExportConfig{Format: VoiceFormatOgg, SampleRate: 44100}, false},
+		{VoiceExportConfig{Format: VoiceFormatOgg, Bitrate: 4}, false},
+		{VoiceExportConfig{Format: "flac"}, false},
+		{VoiceExportConfig{Format: VoiceFormatMp3, SampleRate: 22050}, false},
+		{VoiceExportConfig{Format: VoiceFormatMp3, Bitrate: 400}, false},
+	}
+
+	for _, test := range tests {
+		err := SetVoiceExportConfig(test.config)
+		if (err == nil) != test.ok {
+			t.Errorf("SetVoiceExportConfig(%+v) = %v, want ok %v", test.config, err, test.ok)
+		}
+	}
+}
+
+func silkFrames(prefix []byte, sizes ...int) []byte {
+	buf := append(prefix, []byte("#!SILK_V3")...)
+	for _, size := range sizes {
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(size))
+		buf = append(buf, make([]byte, size)...)
+	}
+
+	return buf
+}
+
+func TestSilkFrameCount(t *testing.T) {
+	tests := []struct {
+		name string
+		buf  []byte
+		want int
+	}{
+		{"empty", nil, 0},
+		{"no header", []byte("RIFF"), 0},
+		{"frames", silkFrames(nil, 10, 20, 30), 3},
+		{"wechat prefix", silkFrames([]byte{0x02}, 10, 20), 2},
+		{"end marker", append(silkFrames(nil, 10), 0xff, 0xff), 1},
+		{"truncated", silkFrames(nil, 10, 20)[:30], 1},
+	}
+
+	for _, test := range tests {
+		if got := silkFrameCount(test.buf); got != test.want {
+			t.Errorf("%s: silkFrameCount = %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestPcmWaveform(t *testing.T) {
+	pcm := make([]byte, 0)
+	for _, v := range []int16{100, -200, 50, 0, 400, -400, 0, 0} {
+		pcm = binary.LittleEndian.AppendUint16(pcm, uint16(v))
+	}
+
+	tests := []struct {
+		points int
+		want   []int
+	}{
+		{4, []int{50, 12, 100, 0}},
+		{2, []int{50, 100}},
+		{16, []int{}},
+	}
+
+	for _, test := range tests {
+		if got := pcmWaveform(pcm, test.points); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("pcmWaveform(%d) = %v, want %v", test.points, got, test.want)
+		}
+	}
+}
+
+type oggPage struct {
+	headerType byte
+	granule    uint64
+	sequence   uint32
+	packet     []byte
+}
+
+func parseOggPages(t *testing.T, buf []byte) []oggPage {
+	var pages []oggPage
+	for len(buf) > 0 {
+		if len(buf) < 27 || string(buf[:4]) != "OggS" {
+			t.Fatalf("bad ogg page header %q", buf)
+		}
+		segments := int(buf[26])
+		size := 0
+		for _, s := range buf[27 : 27+segments] {
+			size += int(s)
+		}
+		pageLen := 27 + segments + size
+		page := append([]byte(nil), buf[:pageLen]...)
+		crc := binary.LittleEndian.Uint32(page[22:])
+		binary.LittleEndian.PutUint32(page[22:], 0)
+		if oggCRC(page) != crc {
+			t.Fatalf("ogg page %d crc mismatch", len(pages))
+		}
+		pages = append(pages, oggPage{
+			headerType: buf[5],
+			granule:    binary.LittleEndian.Uint64(buf[6:]),
+			sequence:   binary.LittleEndian.Uint32(buf[18:]),
+			packet:     buf[27+segments : pageLen],
+		})
+		buf = buf[pageLen:]
+	}
+
+	return pages
+}
+
+func TestOggCRC(t *testing.T) {
+	// Known CRC-32 (poly 0x04c11db7, no reflection, zero init) vector.
+	if got := oggCRC([]byte("123456789")); got != 0x89a1897f {
+		t.Errorf("oggCRC = %#x, want 0x89a1897f", got)
+	}
+}
+
+func TestPcmToOgg(t *testing.T) {
+	tests := []struct {
+		name       string
+		sampleRate int
+		samples    int
+		packets    int
+	}{
+		{"empty", 16000, 0, 1},
+		{"one frame", 16000, 320, 1},
+		{"padded", 24000, 1000, 3},
+		{"48k", 48000, 4800, 5},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		config := VoiceExportConfig{Format: VoiceFormatOgg, SampleRate: test.sampleRate}
+		if err := pcmToOgg(make([]byte, test.samples*2), &buf, config); err != nil {
+			t.Fatalf("%s: pcmToOgg: %v", test.name, err)
+		}
+
+		pages := parseOggPages(t, buf.Bytes())
+		if len(pages) != test.packets+2 {
+			t.Fatalf("%s: %d pages, want %d", test.name, len(pages), test.packets+2)
+		}
+		if !bytes.HasPrefix(pages[0].packet, []byte("OpusHead")) || pages[0].headerType != oggHeaderTypeBOS {
+			t.Errorf("%s: first page is not OpusHead", test.name)
+		}
+		if got := binary.LittleEndian.Uint32(pages[0].packet[12:]); got != uint32(test.sampleRate) {
+			t.Errorf("%s: OpusHead sample rate %d", test.name, got)
+		}
+		if !bytes.HasPrefix(pages[1].packet, []byte("OpusTags")) {
+			t.Errorf("%s: second page is not OpusTags", test.name)
+		}
+		for i, page := range pages {
+			if page.sequence != uint32(i) {
+				t.Errorf("%s: page %d sequence %d", test.name, i, page.sequence)
+			}
+		}
+
+		last := pages[len(pages)-1]
+		wantGranule := uint64(opusPreSkip + test.samples*opusGranuleRate/test.sampleRate)
+		if last.headerType != oggHeaderTypeEOS || last.granule != wantGranule {
+			t.Errorf("%s: last page type %d granule %d, want EOS %d", test.name, last.headerType, last.granule, wantGranule)
+		}
+	}
+}